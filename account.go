@@ -0,0 +1,474 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// accountDeletionGrace is how long a deletion request can be cancelled before
+// the account and everything attached to it is purged.
+const accountDeletionGrace = 7 * 24 * time.Hour
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// RetiredUsername records a purged account's username. The audit log outlives
+// the account and is keyed by username, so the name is never given out again:
+// whoever took it over would see the old owner's access history.
+type RetiredUsername struct {
+	Username  string    `bson:"username"`
+	RetiredAt time.Time `bson:"retired_at"`
+}
+
+var retiredUsernamesColl *mongo.Collection
+
+func ensureAccountIndexes() error {
+	_, err := retiredUsernamesColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// usernameRetired reports whether username belonged to a purged account.
+func usernameRetired(username string) (bool, error) {
+	err := retiredUsernamesColl.FindOne(context.Background(), bson.M{"username": username}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// imageExtension picks a file extension for an exported upload.
+func imageExtension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "application/pdf":
+		return ".pdf"
+	}
+	return ".bin"
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// exportedAnalysis keeps an analysis as JSON when it parses, as text
+// otherwise.
+func exportedAnalysis(text string) interface{} {
+	var analysis interface{}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(text)), &analysis); err == nil {
+		return analysis
+	}
+	return text
+}
+
+// accountExportHandler streams a ZIP with everything stored for the user:
+// GET /account/export
+func accountExportHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		log.Printf("Error fetching user for export: %v", err)
+		httpError(w, r, "fetch_user_failed", http.StatusInternalServerError)
+		return
+	}
+
+	var prescriptions []Prescription
+	opts := options.Find().SetSort(bson.D{{Key: "upload_date", Value: 1}})
+	cursor, err := prescriptionsColl.Find(context.Background(), bson.M{"patient_id": username}, opts)
+	if err == nil {
+		err = cursor.All(context.Background(), &prescriptions)
+	}
+	if err != nil {
+		log.Printf("Error fetching prescriptions for export: %v", err)
+		httpError(w, r, "fetch_prescriptions_failed", http.StatusInternalServerError)
+		return
+	}
+
+	var chats []ChatMessage
+	opts = options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err = chatMessagesColl.Find(context.Background(), bson.M{"username": username}, opts)
+	if err == nil {
+		err = cursor.All(context.Background(), &chats)
+	}
+	if err != nil {
+		log.Printf("Error fetching chat history for export: %v", err)
+		httpError(w, r, "fetch_chat_failed", http.StatusInternalServerError)
+		return
+	}
+
+	var shares []ShareLink
+	cursor, err = shareLinksColl.Find(context.Background(), bson.M{"patient_id": username})
+	if err == nil {
+		err = cursor.All(context.Background(), &shares)
+	}
+	if err != nil {
+		log.Printf("Error fetching share links for export: %v", err)
+		httpError(w, r, "fetch_shares_failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Earlier versions of corrected analyses are the user's data too
+	var revisions []AnalysisRevision
+	opts = options.Find().SetSort(bson.D{{Key: "version", Value: 1}})
+	cursor, err = analysisRevisionsColl.Find(context.Background(), bson.M{"patient_id": username}, opts)
+	if err == nil {
+		err = cursor.All(context.Background(), &revisions)
+	}
+	if err != nil {
+		log.Printf("Error fetching analysis revisions for export: %v", err)
+		httpError(w, r, "fetch_prescriptions_failed", http.StatusInternalServerError)
+		return
+	}
+	revisionsOf := map[primitive.ObjectID][]map[string]interface{}{}
+	for _, revision := range revisions {
+		revisionsOf[revision.PrescriptionID] = append(revisionsOf[revision.PrescriptionID], map[string]interface{}{
+			"version":     revision.Version,
+			"author":      revision.Author,
+			"author_role": revision.AuthorRole,
+			"comment":     revision.Comment,
+			"fields":      revision.Fields,
+			"created_at":  revision.CreatedAt,
+			"analysis":    exportedAnalysis(revision.Analysis),
+		})
+	}
+
+	recordAudit(r, username, username, auditExport, "account")
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"cura-data-%s.zip\"", time.Now().Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// From here on the response has started; errors can only be logged
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	profile := map[string]interface{}{
+		"username":               user.Username,
+		"role":                   user.Role,
+		"pregnant":               user.Pregnant,
+		"lactating":              user.Lactating,
+		"allergies":              cleanAllergies(user.Allergies),
+		"language":               user.Language,
+		"phone":                  user.Phone,
+		"deletion_scheduled_for": user.DeletionScheduledFor,
+		"exported_at":            time.Now(),
+	}
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+
+	records := []map[string]interface{}{}
+	for _, prescription := range prescriptions {
+		record := map[string]interface{}{
+			"id":          prescription.ID.Hex(),
+			"upload_date": prescription.UploadDate,
+			"language":    prescription.Language,
+			"source":      prescription.Source,
+		}
+
+		// A held analysis is withheld here as everywhere else until it is
+		// resolved, earlier versions included
+		if prescription.Withheld() {
+			record["review_status"] = prescription.Review.Status
+		} else {
+			record["analysis"] = exportedAnalysis(prescription.Analysis)
+			record["version"] = prescription.currentVersion()
+			if prescription.OriginalAnalysis != "" {
+				record["original_analysis"] = exportedAnalysis(prescription.OriginalAnalysis)
+			}
+			if versions := revisionsOf[prescription.ID]; len(versions) > 0 {
+				record["revisions"] = versions
+			}
+		}
+
+		if !prescription.ImageID.IsZero() {
+			data, contentType, err := loadPrescriptionImage(prescription.ImageID)
+			if err != nil {
+				log.Printf("Error loading image %s for export: %v", prescription.ImageID.Hex(), err)
+			} else {
+				name := "images/" + prescription.ID.Hex() + imageExtension(contentType)
+				f, err := zw.Create(name)
+				if err == nil {
+					_, err = f.Write(data)
+				}
+				if err != nil {
+					log.Printf("Error writing export: %v", err)
+					return
+				}
+				record["image"] = name
+			}
+		}
+		records = append(records, record)
+	}
+	if err := writeZipJSON(zw, "prescriptions.json", records); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+
+	if chats == nil {
+		chats = []ChatMessage{}
+	}
+	for i, chat := range chats {
+		if chat.AudioID.IsZero() {
+			continue
+		}
+		data, contentType, err := loadChatAudio(chat.AudioID)
+		if err != nil {
+			log.Printf("Error loading voice recording %s for export: %v", chat.AudioID.Hex(), err)
+			continue
+		}
+		name := "audio/" + chat.ID.Hex() + audioExtension(contentType)
+		f, err := zw.Create(name)
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		if err != nil {
+			log.Printf("Error writing export: %v", err)
+			return
+		}
+		chats[i].AudioFile = name
+	}
+	if err := writeZipJSON(zw, "chat_history.json", chats); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+
+	links := []map[string]interface{}{}
+	for _, link := range shares {
+		links = append(links, map[string]interface{}{
+			"prescription_id":  link.PrescriptionID.Hex(),
+			"created_at":       link.CreatedAt,
+			"expires_at":       link.ExpiresAt,
+			"revoked_at":       link.RevokedAt,
+			"access_count":     link.AccessCount,
+			"last_accessed_at": link.LastAccessedAt,
+			"accesses":         recentShareAccesses(link.ID, 0),
+		})
+	}
+	if err := writeZipJSON(zw, "share_links.json", links); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+
+	events, err := patientAuditEvents(username, "", 0)
+	if err != nil {
+		log.Printf("Error fetching audit events for export: %v", err)
+		return
+	}
+	if err := writeZipJSON(zw, "access_history.json", events); err != nil {
+		log.Printf("Error writing export: %v", err)
+	}
+}
+
+// accountDeleteHandler schedules (POST, with the password as confirmation) or
+// cancels (DELETE) deletion of the logged-in user's account:
+// /account/delete
+func accountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var update bson.M
+	var scheduled *time.Time
+	switch r.Method {
+	case http.MethodPost:
+		var req DeleteAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		err := usersColl.FindOne(context.Background(), bson.M{
+			"username": username,
+			"password": hashPassword(req.Password),
+		}).Err()
+		if err == mongo.ErrNoDocuments {
+			httpError(w, r, "incorrect_password", http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("Error confirming account deletion: %v", err)
+			httpError(w, r, "internal", http.StatusInternalServerError)
+			return
+		}
+
+		when := time.Now().Add(accountDeletionGrace)
+		scheduled = &when
+		update = bson.M{"$set": bson.M{"deletion_scheduled_for": when}}
+	case http.MethodDelete:
+		update = bson.M{"$unset": bson.M{"deletion_scheduled_for": ""}}
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := usersColl.UpdateOne(context.Background(), bson.M{"username": username}, update); err != nil {
+		log.Printf("Error updating account deletion: %v", err)
+		httpError(w, r, "update_account_failed", http.StatusInternalServerError)
+		return
+	}
+	if scheduled != nil {
+		log.Printf("Account %s scheduled for deletion on %s", username, scheduled.Format(time.RFC3339))
+	} else {
+		log.Printf("Account deletion cancelled for %s", username)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deletion_scheduled_for": scheduled,
+	})
+}
+
+// purgeUser removes the user and everything stored for them: prescriptions,
+// their images, share links and their access logs, and chat history with any
+// kept voice recordings. Audit events are kept.
+func purgeUser(username string) error {
+	ctx := context.Background()
+
+	// Every upload is tagged with its owner, including ones whose
+	// prescription record is already gone
+	cursor, err := imagesBucket.Find(bson.M{"metadata.patient_id": username})
+	if err != nil {
+		return fmt.Errorf("finding images: %w", err)
+	}
+	var files []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return fmt.Errorf("decoding images: %w", err)
+	}
+	for _, file := range files {
+		if err := imagesBucket.Delete(file.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return fmt.Errorf("deleting image %s: %w", file.ID.Hex(), err)
+		}
+	}
+
+	cursor, err = audioBucket.Find(bson.M{"metadata.patient_id": username})
+	if err != nil {
+		return fmt.Errorf("finding voice recordings: %w", err)
+	}
+	files = nil
+	if err := cursor.All(ctx, &files); err != nil {
+		return fmt.Errorf("decoding voice recordings: %w", err)
+	}
+	for _, file := range files {
+		if err := audioBucket.Delete(file.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return fmt.Errorf("deleting voice recording %s: %w", file.ID.Hex(), err)
+		}
+	}
+
+	if _, err := prescriptionsColl.DeleteMany(ctx, bson.M{"patient_id": username}); err != nil {
+		return fmt.Errorf("deleting prescriptions: %w", err)
+	}
+
+	var shareIDs []primitive.ObjectID
+	cursor, err = shareLinksColl.Find(ctx, bson.M{"patient_id": username}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("finding share links: %w", err)
+	}
+	var links []ShareLink
+	if err := cursor.All(ctx, &links); err != nil {
+		return fmt.Errorf("decoding share links: %w", err)
+	}
+	for _, link := range links {
+		shareIDs = append(shareIDs, link.ID)
+	}
+	if len(shareIDs) > 0 {
+		if _, err := shareAccessesColl.DeleteMany(ctx, bson.M{"share_id": bson.M{"$in": shareIDs}}); err != nil {
+			return fmt.Errorf("deleting share accesses: %w", err)
+		}
+	}
+	if _, err := shareLinksColl.DeleteMany(ctx, bson.M{"patient_id": username}); err != nil {
+		return fmt.Errorf("deleting share links: %w", err)
+	}
+
+	if _, err := chatMessagesColl.DeleteMany(ctx, bson.M{"username": username}); err != nil {
+		return fmt.Errorf("deleting chat history: %w", err)
+	}
+	if _, err := analysisRevisionsColl.DeleteMany(ctx, bson.M{"patient_id": username}); err != nil {
+		return fmt.Errorf("deleting analysis revisions: %w", err)
+	}
+	if _, err := apiTokensColl.DeleteMany(ctx, bson.M{"username": username}); err != nil {
+		return fmt.Errorf("deleting API tokens: %w", err)
+	}
+
+	_, err = retiredUsernamesColl.UpdateOne(ctx, bson.M{"username": username},
+		bson.M{"$setOnInsert": bson.M{"retired_at": time.Now()}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("retiring username: %w", err)
+	}
+
+	// The user goes last so a failed purge is retried on the next run
+	if _, err := usersColl.DeleteOne(ctx, bson.M{"username": username}); err != nil {
+		return fmt.Errorf("deleting user: %w", err)
+	}
+
+	// The audit log is append-only and outlives the account
+	recordAudit(nil, "system", username, auditAccountDelete, "")
+	return nil
+}
+
+// purgeDueAccounts deletes every account whose grace period has ended.
+func purgeDueAccounts() {
+	cursor, err := usersColl.Find(context.Background(), bson.M{
+		"deletion_scheduled_for": bson.M{"$lte": time.Now()},
+	})
+	if err != nil {
+		log.Printf("Error finding accounts to delete: %v", err)
+		return
+	}
+	var users []User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		log.Printf("Error decoding accounts to delete: %v", err)
+		return
+	}
+
+	for _, user := range users {
+		if err := purgeUser(user.Username); err != nil {
+			log.Printf("Error deleting account %s: %v", user.Username, err)
+			continue
+		}
+		log.Printf("Deleted account %s", user.Username)
+	}
+}
+
+// runAccountDeletionWorker purges due accounts at startup and then hourly.
+func runAccountDeletionWorker() {
+	for {
+		purgeDueAccounts()
+		time.Sleep(time.Hour)
+	}
+}
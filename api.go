@@ -0,0 +1,923 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// JSON API for the mobile app under /api/v1. Requests authenticate with
+// "Authorization: Bearer <token>" (see api_tokens.go); a signed-in browser's
+// cookie works too, so the dashboard can manage tokens. Every answer is
+// JSON, errors included: {"error": "<code>", "message": "<text in the user's
+// language>"}. Routes are declared once in apiRoutes, which both serves them
+// and generates the OpenAPI document at /api/v1/openapi.json.
+
+const apiPrefix = "/api/v1"
+
+type apiContextKey struct{}
+
+// apiPrincipal is who an API request was authenticated as.
+type apiPrincipal struct {
+	Username string
+	Role     string
+	Token    *APIToken // nil for a cookie session
+}
+
+// apiRoute is one operation of the API, with what the OpenAPI document
+// needs to describe it.
+type apiRoute struct {
+	Method   string
+	Path     string // below apiPrefix, with {name} wildcards
+	Summary  string
+	Tag      string
+	Public   bool // no authentication
+	Query    []apiParam
+	Body     interface{} // JSON request body, as a zero value of its type
+	Form     []apiParam  // multipart/form-data fields instead of a JSON body
+	Status   int         // success status, 200 if zero
+	Response interface{} // JSON response, nil when there is no body
+	Produces string      // content type of a non-JSON response
+	Errors   []int       // statuses besides 401 and 404 that the route returns
+	Handler  http.HandlerFunc
+}
+
+type apiParam struct {
+	Name        string
+	Type        string // "string", "integer", "boolean" or "file"
+	Description string
+	Required    bool
+}
+
+// APIError is the body of every error response.
+type APIError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+type APILoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Device   string `json:"device,omitempty"` // shown in the token list, e.g. "Pixel 7"
+}
+
+type APISession struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"` // always "Bearer"
+	ExpiresAt time.Time `json:"expires_at"`
+	User      APIUser   `json:"user"`
+}
+
+type APIUser struct {
+	Username             string     `json:"username"`
+	Language             string     `json:"language"`
+	Pregnant             bool       `json:"pregnant"`
+	Lactating            bool       `json:"lactating"`
+	Allergies            []string   `json:"allergies"`
+	Phone                string     `json:"phone,omitempty"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+}
+
+type APICreateTokenRequest struct {
+	Name          string `json:"name"`
+	Password      string `json:"password"`                  // the account password, asked again
+	ExpiresInDays int    `json:"expires_in_days,omitempty"` // 0 for the default of 30, at most 365
+}
+
+// APINewToken is a created token; Token is only ever shown here.
+type APINewToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+type APITokenList struct {
+	Items []APIToken `json:"items"`
+}
+
+type APIPrescription struct {
+	ID                string              `json:"id"`
+	UploadDate        time.Time           `json:"upload_date"`
+	Language          string              `json:"language"`
+	Source            string              `json:"source,omitempty"` // "fhir" for imported records
+	Medicines         []string            `json:"medicines"`
+	HasImage          bool                `json:"has_image"`
+	ImageQuality      *ImageQuality       `json:"image_quality,omitempty"`
+	PromptVersion     string              `json:"prompt_version,omitempty"`
+	Model             string              `json:"model,omitempty"`
+	Version           int                 `json:"version"`            // of the analysis; above 1 once corrected
+	Review            *Review             `json:"review,omitempty"`   // set when the analysis was held for a pharmacist
+	Analysis          json.RawMessage     `json:"analysis,omitempty"` // only on single prescriptions, and not while held
+	PregnancyWarnings []SafetyWarning     `json:"pregnancy_warnings,omitempty"`
+	Reminders         []Reminder          `json:"reminders,omitempty"`
+	Confidence        *AnalysisConfidence `json:"confidence,omitempty"`      // how sure the reading of each field and medicine is
+	DuplicateMatch    string              `json:"duplicate_match,omitempty"` // "exact" when an upload of the same file reused this analysis
+}
+
+type APIPrescriptionList struct {
+	Items    []APIPrescription `json:"items"`
+	Total    int64             `json:"total"`
+	Page     int               `json:"page"`
+	PerPage  int               `json:"per_page"`
+	NextPage int               `json:"next_page,omitempty"` // absent on the last page
+}
+
+type APIAnswer struct {
+	Response string `json:"response"`
+	Cached   bool   `json:"cached"`
+}
+
+func apiRoutes() []apiRoute {
+	idRequired := []int{http.StatusBadRequest}
+	aiErrors := []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusUnprocessableEntity, http.StatusBadGateway, http.StatusServiceUnavailable}
+	return []apiRoute{
+		{Method: http.MethodGet, Path: "/openapi.json", Summary: "This document", Tag: "meta", Public: true,
+			Response: map[string]interface{}{}, Handler: apiOpenAPIHandler},
+
+		{Method: http.MethodPost, Path: "/auth/token", Summary: "Sign in and get a session token", Tag: "auth", Public: true,
+			Body: APILoginRequest{}, Status: http.StatusCreated, Response: APISession{},
+			Errors: []int{http.StatusBadRequest, http.StatusTooManyRequests}, Handler: apiLoginHandler},
+		{Method: http.MethodDelete, Path: "/auth/token", Summary: "Sign out, revoking the token used", Tag: "auth",
+			Status: http.StatusNoContent, Errors: []int{http.StatusBadRequest}, Handler: apiLogoutHandler},
+		{Method: http.MethodGet, Path: "/me", Summary: "The signed-in user's profile", Tag: "auth",
+			Response: APIUser{}, Handler: apiMeHandler},
+
+		{Method: http.MethodGet, Path: "/tokens", Summary: "List the user's tokens", Tag: "tokens",
+			Response: APITokenList{}, Handler: apiListTokensHandler},
+		{Method: http.MethodPost, Path: "/tokens", Summary: "Create a personal access token", Tag: "tokens",
+			Body: APICreateTokenRequest{}, Status: http.StatusCreated, Response: APINewToken{},
+			Errors: []int{http.StatusBadRequest}, Handler: apiCreateTokenHandler},
+		{Method: http.MethodDelete, Path: "/tokens/{id}", Summary: "Revoke a token", Tag: "tokens",
+			Status: http.StatusNoContent, Errors: idRequired, Handler: apiRevokeTokenHandler},
+
+		{Method: http.MethodGet, Path: "/prescriptions", Summary: "Search and page through prescriptions", Tag: "prescriptions",
+			Query: []apiParam{
+				{Name: "q", Type: "string", Description: "Words anywhere in the analysis; medicine names also match by their start"},
+				{Name: "medicine", Type: "string", Description: "Medicine name or its start"},
+				{Name: "prescriber", Type: "string", Description: "Prescriber name or its start"},
+				{Name: "language", Type: "string", Description: "Language code of the analysis"},
+				{Name: "from", Type: "string", Description: "Uploaded on or after this date, YYYY-MM-DD"},
+				{Name: "to", Type: "string", Description: "Uploaded on or before this date, YYYY-MM-DD"},
+				{Name: "sort", Type: "string", Description: "newest (default) or oldest"},
+				{Name: "page", Type: "integer", Description: "Page number, from 1"},
+				{Name: "per_page", Type: "integer", Description: fmt.Sprintf("Page size, default %d, at most %d", defaultHistoryPageSize, maxHistoryPageSize)},
+			},
+			Response: APIPrescriptionList{}, Errors: []int{http.StatusBadRequest}, Handler: apiListPrescriptionsHandler},
+		{Method: http.MethodPost, Path: "/prescriptions", Summary: "Upload and analyze a prescription", Tag: "prescriptions",
+			Form: []apiParam{
+				{Name: "prescription", Type: "file", Description: "JPEG, PNG, WebP or PDF, up to 15 MB", Required: true},
+				{Name: "lang", Type: "string", Description: "Language of the analysis, default the user's"},
+				{Name: "grayscale", Type: "boolean", Description: "Send the model a black-and-white copy"},
+				{Name: "force", Type: "boolean", Description: "Analyze even if the image was seen before or looks like an earlier one (409 similar_upload)"},
+			},
+			Status: http.StatusCreated, Response: APIPrescription{},
+			Errors:  append(aiErrors, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType),
+			Handler: limitAI("analyze-prescription", apiCreatePrescriptionHandler)},
+		{Method: http.MethodGet, Path: "/prescriptions/{id}", Summary: "A prescription with its analysis, warnings and reminders", Tag: "prescriptions",
+			Query:    []apiParam{{Name: "lang", Type: "string", Description: "Language of the pregnancy warnings"}},
+			Response: APIPrescription{}, Errors: idRequired, Handler: apiGetPrescriptionHandler},
+		{Method: http.MethodDelete, Path: "/prescriptions/{id}", Summary: "Delete a prescription", Tag: "prescriptions",
+			Status: http.StatusNoContent, Errors: idRequired, Handler: apiDeletePrescriptionHandler},
+		{Method: http.MethodPatch, Path: "/prescriptions/{id}/analysis", Summary: "Correct fields of the analysis, saving a new version", Tag: "prescriptions",
+			Body: CorrectionRequest{}, Response: APIPrescription{}, Errors: []int{http.StatusBadRequest, http.StatusConflict},
+			Handler: apiCorrectPrescriptionHandler},
+		{Method: http.MethodGet, Path: "/prescriptions/{id}/revisions", Summary: "Versions of the analysis and what changed between two of them", Tag: "prescriptions",
+			Query: []apiParam{
+				{Name: "from", Type: "integer", Description: "Version to compare from, default 1 (the model's)"},
+				{Name: "to", Type: "integer", Description: "Version to compare to, default the current one"},
+			},
+			Response: RevisionHistory{}, Errors: []int{http.StatusBadRequest, http.StatusConflict}, Handler: apiRevisionsHandler},
+		{Method: http.MethodGet, Path: "/prescriptions/{id}/pdf", Summary: "The analysis as a PDF report", Tag: "prescriptions",
+			Query:    []apiParam{{Name: "lang", Type: "string", Description: "Report language, default the user's"}},
+			Produces: "application/pdf", Errors: []int{http.StatusBadRequest, http.StatusConflict}, Handler: apiPrescriptionPDFHandler},
+		{Method: http.MethodGet, Path: "/prescriptions/{id}/image", Summary: "The original uploaded image", Tag: "prescriptions",
+			Produces: "image/*", Errors: idRequired, Handler: apiPrescriptionImageHandler},
+
+		{Method: http.MethodGet, Path: "/reviews", Summary: "Prescriptions waiting for a pharmacist, oldest first", Tag: "reviews",
+			Response: ReviewQueue{}, Errors: []int{http.StatusForbidden}, Handler: apiReviewQueueHandler},
+		{Method: http.MethodGet, Path: "/reviews/{id}", Summary: "A held prescription with its analysis and review", Tag: "reviews",
+			Response: ReviewItem{}, Errors: []int{http.StatusBadRequest, http.StatusForbidden}, Handler: apiGetReviewHandler},
+		{Method: http.MethodPost, Path: "/reviews/{id}", Summary: "Approve, correct or reject a held prescription", Tag: "reviews",
+			Body: ReviewDecision{}, Response: ReviewItem{}, Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusConflict},
+			Handler: apiResolveReviewHandler},
+		{Method: http.MethodGet, Path: "/reviews/{id}/image", Summary: "The uploaded image of a held prescription", Tag: "reviews",
+			Produces: "image/*", Errors: []int{http.StatusBadRequest, http.StatusForbidden}, Handler: apiReviewImageHandler},
+
+		{Method: http.MethodPost, Path: "/chat", Summary: "Ask the health assistant", Tag: "assistant",
+			Body: ChatRequest{}, Response: APIAnswer{}, Errors: aiErrors,
+			Handler: limitAI("chat", apiChatHandler)},
+		{Method: http.MethodPost, Path: "/predictions", Summary: "Predict likely conditions from symptoms", Tag: "assistant",
+			Body: DiseasePredictionRequest{}, Response: APIAnswer{}, Errors: aiErrors,
+			Handler: limitAI("predict-disease", apiPredictionHandler)},
+	}
+}
+
+// apiHandler serves every route in apiRoutes.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	byPath := map[string][]apiRoute{}
+	var paths []string
+	for _, route := range apiRoutes() {
+		if _, ok := byPath[route.Path]; !ok {
+			paths = append(paths, route.Path)
+		}
+		byPath[route.Path] = append(byPath[route.Path], route)
+	}
+	for _, path := range paths {
+		routes := byPath[path]
+		mux.HandleFunc(apiPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+			dispatchAPI(w, r, routes)
+		})
+	}
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, r, http.StatusNotFound, "not_found")
+	})
+	return mux
+}
+
+// dispatchAPI picks the route for the method and authenticates the caller.
+func dispatchAPI(w http.ResponseWriter, r *http.Request, routes []apiRoute) {
+	var allowed []string
+	for _, route := range routes {
+		if route.Method != r.Method {
+			allowed = append(allowed, route.Method)
+			continue
+		}
+		if route.Public {
+			route.Handler(w, r)
+			return
+		}
+
+		principal, err := authenticateAPIRequest(r)
+		switch {
+		case err == errInvalidToken:
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			apiError(w, r, http.StatusUnauthorized, "invalid_token")
+			return
+		case err == errNotSignedIn:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		case err != nil:
+			log.Printf("Error checking API token: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "internal")
+			return
+		}
+		route.Handler(w, r.WithContext(context.WithValue(r.Context(), apiContextKey{}, principal)))
+		return
+	}
+
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	apiError(w, r, http.StatusMethodNotAllowed, "method_not_allowed")
+}
+
+var errNotSignedIn = errors.New("no credentials")
+
+// authenticateAPIRequest checks the bearer token, or else the session cookie.
+func authenticateAPIRequest(r *http.Request) (apiPrincipal, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return apiPrincipal{}, errInvalidToken
+		}
+		record, user, err := authenticateAPIToken(strings.TrimSpace(token))
+		if err != nil {
+			return apiPrincipal{}, err
+		}
+		return apiPrincipal{Username: user.Username, Role: user.Role, Token: &record}, nil
+	}
+	if username, role, ok := getLoggedInUser(r); ok {
+		return apiPrincipal{Username: username, Role: role}, nil
+	}
+	return apiPrincipal{}, errNotSignedIn
+}
+
+// apiPrincipalFrom returns who the request was authenticated as.
+func apiPrincipalFrom(r *http.Request) (apiPrincipal, bool) {
+	principal, ok := r.Context().Value(apiContextKey{}).(apiPrincipal)
+	return principal, ok
+}
+
+// apiError writes the JSON error for an "errors." locale key.
+func apiError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	apiJSON(w, status, APIError{Error: code, Message: translate(requestLang(r), "errors."+code)})
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiObjectID parses the {name} path value, answering 400 if it is not an ID.
+func apiObjectID(w http.ResponseWriter, r *http.Request, name string) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(r.PathValue(name))
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid_id")
+		return id, false
+	}
+	return id, true
+}
+
+// apiDecode reads a JSON body into v, answering 400 if it is malformed.
+func apiDecode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return false
+	}
+	return true
+}
+
+// apiUserPrescription loads one of the caller's prescriptions, answering
+// 404 if it is missing or not theirs.
+func apiUserPrescription(w http.ResponseWriter, r *http.Request, username string) (Prescription, bool) {
+	objID, ok := apiObjectID(w, r, "id")
+	if !ok {
+		return Prescription{}, false
+	}
+	prescription, err := findUserPrescription(objID, username)
+	if err == mongo.ErrNoDocuments {
+		apiError(w, r, http.StatusNotFound, "prescription_not_found")
+		return prescription, false
+	} else if err != nil {
+		log.Printf("Error fetching prescription: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return prescription, false
+	}
+	return prescription, true
+}
+
+func apiOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, openAPIDocument(r, apiRoutes()))
+}
+
+func apiLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req APILoginRequest
+	if !apiDecode(w, r, &req) {
+		return
+	}
+	// Slows password guessing, against one account or from one address
+	if ok, wait := allowRequest("api-login", req.Username, clientIP(r)); !ok {
+		writeLimitError(w, r, "rate_limited", "limits.rate_limited", wait, nil)
+		return
+	}
+
+	var user User
+	err := usersColl.FindOne(context.Background(), bson.M{
+		"username": req.Username,
+		"password": hashPassword(req.Password),
+	}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		apiError(w, r, http.StatusUnauthorized, "invalid_credentials")
+		return
+	} else if err != nil {
+		log.Printf("Error signing in: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+
+	device := strings.TrimSpace(req.Device)
+	if device == "" {
+		device = "Mobile app"
+	}
+	record, token, err := issueAPIToken(user.Username, "session", device, apiSessionTTL)
+	if err != nil {
+		log.Printf("Error issuing API token: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	apiJSON(w, http.StatusCreated, APISession{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: *record.ExpiresAt,
+		User:      apiUserJSON(user),
+	})
+}
+
+func apiLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := apiPrincipalFrom(r)
+	if principal.Token == nil {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if _, err := revokeAPIToken(principal.Username, principal.Token.ID); err != nil {
+		log.Printf("Error revoking API token: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiUserJSON(user User) APIUser {
+	return APIUser{
+		Username:             user.Username,
+		Language:             languageOrDefault(user.Language).Code,
+		Pregnant:             user.Pregnant,
+		Lactating:            user.Lactating,
+		Allergies:            cleanAllergies(user.Allergies),
+		Phone:                user.Phone,
+		DeletionScheduledFor: user.DeletionScheduledFor,
+	}
+}
+
+func apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	apiJSON(w, http.StatusOK, apiUserJSON(user))
+}
+
+func apiListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	tokens, err := listAPITokens(username)
+	if err != nil {
+		log.Printf("Error listing API tokens: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	apiJSON(w, http.StatusOK, APITokenList{Items: tokens})
+}
+
+func apiCreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	var req APICreateTokenRequest
+	if !apiDecode(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 || req.Password == "" || req.ExpiresInDays < 0 || req.ExpiresInDays > maxPersonalTokenDays {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	// A token outlives the session that made it, so the password is asked
+	// again rather than trusting whoever holds the cookie or bearer token
+	if ok, wait := allowRequest("api-login", username, clientIP(r)); !ok {
+		writeLimitError(w, r, "rate_limited", "limits.rate_limited", wait, nil)
+		return
+	}
+	err := usersColl.FindOne(context.Background(), bson.M{
+		"username": username,
+		"password": hashPassword(req.Password),
+	}).Err()
+	if err == mongo.ErrNoDocuments {
+		apiError(w, r, http.StatusForbidden, "invalid_credentials")
+		return
+	} else if err != nil {
+		log.Printf("Error checking password: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+
+	days := req.ExpiresInDays
+	if days == 0 {
+		days = defaultPersonalTokenDays
+	}
+	ttl := time.Duration(days) * 24 * time.Hour
+	record, token, err := issueAPIToken(username, "personal", req.Name, ttl)
+	if err != nil {
+		log.Printf("Error issuing API token: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	apiJSON(w, http.StatusCreated, APINewToken{APIToken: record, Token: token})
+}
+
+func apiRevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	id, ok := apiObjectID(w, r, "id")
+	if !ok {
+		return
+	}
+	found, err := revokeAPIToken(username, id)
+	if err != nil {
+		log.Printf("Error revoking API token: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	if !found {
+		apiError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiPrescriptionJSON describes a prescription; full adds the analysis,
+// warnings, reminders and confidence.
+func apiPrescriptionJSON(username string, prescription Prescription, full bool, lang string) APIPrescription {
+	item := APIPrescription{
+		ID:            prescription.ID.Hex(),
+		UploadDate:    prescription.UploadDate,
+		Language:      prescription.Language,
+		Source:        prescription.Source,
+		Medicines:     []string{},
+		HasImage:      !prescription.ImageID.IsZero(),
+		ImageQuality:  prescription.ImageQuality,
+		PromptVersion: prescription.PromptVersion,
+		Model:         prescription.Model,
+		Version:       prescription.currentVersion(),
+		Review:        prescription.Review,
+	}
+	if prescription.Withheld() {
+		return item
+	}
+
+	item.Medicines = append(item.Medicines, prescription.MedicineNames()...)
+	if !full {
+		return item
+	}
+
+	analysis := cleanAnalysisJSON(prescription.Analysis)
+	if json.Valid([]byte(analysis)) {
+		item.Analysis = json.RawMessage(analysis)
+	} else {
+		// Keep unparseable model output readable rather than dropping it
+		item.Analysis, _ = json.Marshal(analysis)
+	}
+	item.PregnancyWarnings = userPregnancyWarnings(username, prescription.Analysis, lang)
+	item.Reminders = reminderSchedule(prescription.Analysis)
+	item.Confidence = analysisConfidence(prescription)
+	return item
+}
+
+func apiListPrescriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	query, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	history, err := searchPrescriptions(r.Context(), username, query)
+	if err != nil {
+		log.Printf("Error fetching prescriptions: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+
+	list := APIPrescriptionList{
+		Items:   []APIPrescription{},
+		Total:   history.Total,
+		Page:    query.Page,
+		PerPage: query.PerPage,
+	}
+	if history.HasNext() {
+		list.NextPage = query.Page + 1
+	}
+	for _, prescription := range history.Prescriptions {
+		list.Items = append(list.Items, apiPrescriptionJSON(username, prescription, false, ""))
+	}
+	recordListAudit(r, username, history.Prescriptions)
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiCreatePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			apiJSON(w, http.StatusRequestEntityTooLarge, APIError{Error: "file_too_big", Message: translate(requestLang(r), "upload.file_too_big")})
+			return
+		}
+		apiError(w, r, http.StatusBadRequest, "upload_failed")
+		return
+	}
+	file, header, err := r.FormFile("prescription")
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, "upload_failed")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, "upload_failed")
+		return
+	}
+
+	langCode := r.FormValue("lang")
+	if _, ok := lookupLanguage(langCode); !ok {
+		langCode = preferredLanguage(r, username)
+	}
+	result, err := analyzePrescription(r, username, AnalysisUpload{
+		Filename:       header.Filename,
+		Data:           data,
+		Language:       langCode,
+		Grayscale:      r.FormValue("grayscale") == "true",
+		Force:          r.FormValue("force") == "true",
+		SuggestSimilar: true,
+	})
+	var retake *RetakeError
+	var similar *SimilarUploadError
+	var aiErr *AIError
+	switch {
+	case errors.As(err, &retake):
+		writeRetakeError(w, r, retake.Quality)
+		return
+	case errors.As(err, &similar):
+		writeSimilarUploadError(w, r, similar.Previous)
+		return
+	case errors.As(err, &aiErr):
+		writeAIError(w, r, err)
+		return
+	case err != nil && result.Rejected:
+		message, code := uploadErrorMessage(requestLang(r), err)
+		if code == http.StatusInternalServerError {
+			log.Printf("Error processing upload: %v", err)
+		}
+		apiJSON(w, code, APIError{Error: "upload_rejected", Message: message})
+		return
+	case err != nil:
+		log.Printf("Error analyzing prescription: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "analysis_failed")
+		return
+	}
+
+	item := apiPrescriptionJSON(username, result.Prescription, true, langCode)
+	if result.Duplicate != "" {
+		skipAIQuota(w)
+		item.DuplicateMatch = result.Duplicate
+		apiJSON(w, http.StatusOK, item)
+		return
+	}
+	apiJSON(w, http.StatusCreated, item)
+}
+
+func apiGetPrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	prescription, ok := apiUserPrescription(w, r, username)
+	if !ok {
+		return
+	}
+	recordAudit(r, username, username, auditView, prescription.ID.Hex())
+	markReviewSeen(prescription)
+
+	lang := r.URL.Query().Get("lang")
+	if _, ok := lookupLanguage(lang); !ok {
+		lang = languageOrDefault(prescription.Language).Code
+	}
+	apiJSON(w, http.StatusOK, apiPrescriptionJSON(username, prescription, true, lang))
+}
+
+func apiDeletePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	objID, ok := apiObjectID(w, r, "id")
+	if !ok {
+		return
+	}
+	deleted, err := removePrescription(r, username, objID)
+	if err != nil {
+		log.Printf("Error deleting prescription: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "delete_failed")
+		return
+	}
+	if !deleted {
+		apiError(w, r, http.StatusNotFound, "prescription_not_found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiCorrectPrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	prescription, ok := apiUserPrescription(w, r, username)
+	if !ok {
+		return
+	}
+	if prescription.Withheld() {
+		apiError(w, r, http.StatusConflict, "under_review")
+		return
+	}
+	var req CorrectionRequest
+	if !apiDecode(w, r, &req) {
+		return
+	}
+	role, err := accountRole(username)
+	if err != nil {
+		writeCorrectionError(w, r, err)
+		return
+	}
+	prescription, err = correctAnalysis(r, prescription, username, role, req)
+	if err != nil {
+		writeCorrectionError(w, r, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, apiPrescriptionJSON(username, prescription, true, languageOrDefault(prescription.Language).Code))
+}
+
+func apiRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	prescription, ok := apiUserPrescription(w, r, username)
+	if !ok {
+		return
+	}
+	if prescription.Withheld() {
+		apiError(w, r, http.StatusConflict, "under_review")
+		return
+	}
+	writeRevisionHistory(w, r, username, prescription)
+}
+
+func apiPrescriptionPDFHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	prescription, ok := apiUserPrescription(w, r, username)
+	if !ok {
+		return
+	}
+	if prescription.Withheld() {
+		apiError(w, r, http.StatusConflict, "under_review")
+		return
+	}
+	lang := r.URL.Query().Get("lang")
+	if _, ok := lookupLanguage(lang); !ok {
+		lang = preferredLanguage(r, username)
+	}
+
+	recordAudit(r, username, username, auditDownload, prescription.ID.Hex())
+	writePrescriptionReport(w, r, prescription, lang, fmt.Sprintf("prescription-analysis-%s.pdf", prescription.ID.Hex()))
+}
+
+func apiPrescriptionImageHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	prescription, ok := apiUserPrescription(w, r, username)
+	if !ok {
+		return
+	}
+	if prescription.ImageID.IsZero() {
+		apiError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+
+	recordAudit(r, username, username, auditViewImage, prescription.ID.Hex())
+	data, contentType, err := loadPrescriptionImage(prescription.ImageID)
+	if err != nil {
+		log.Printf("Error loading prescription image: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write(data)
+}
+
+// apiPharmacist returns the caller's account, answering 403 unless it is a
+// pharmacist's.
+func apiPharmacist(w http.ResponseWriter, r *http.Request) (User, bool) {
+	pharmacist, ok := currentPharmacist(r)
+	if !ok {
+		apiError(w, r, http.StatusForbidden, "forbidden")
+	}
+	return pharmacist, ok
+}
+
+// apiReviewPrescription loads a held or reviewed prescription for a
+// pharmacist, answering 404 if there is none.
+func apiReviewPrescription(w http.ResponseWriter, r *http.Request) (Prescription, bool) {
+	objID, ok := apiObjectID(w, r, "id")
+	if !ok {
+		return Prescription{}, false
+	}
+	prescription, err := findReviewPrescription(objID)
+	if err == mongo.ErrNoDocuments {
+		apiError(w, r, http.StatusNotFound, "prescription_not_found")
+		return prescription, false
+	} else if err != nil {
+		log.Printf("Error fetching prescription: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return prescription, false
+	}
+	return prescription, true
+}
+
+func apiReviewQueueHandler(w http.ResponseWriter, r *http.Request) {
+	pharmacist, ok := apiPharmacist(w, r)
+	if !ok {
+		return
+	}
+	queue, err := pendingReviews(r.Context())
+	if err != nil {
+		log.Printf("Error fetching review queue: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	queue.recordAudit(r, pharmacist.Username)
+	apiJSON(w, http.StatusOK, queue)
+}
+
+func apiGetReviewHandler(w http.ResponseWriter, r *http.Request) {
+	pharmacist, ok := apiPharmacist(w, r)
+	if !ok {
+		return
+	}
+	prescription, ok := apiReviewPrescription(w, r)
+	if !ok {
+		return
+	}
+	recordAudit(r, pharmacist.Username, prescription.PatientID, auditView, prescription.ID.Hex())
+	apiJSON(w, http.StatusOK, reviewItemJSON(prescription, true))
+}
+
+func apiResolveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	pharmacist, ok := apiPharmacist(w, r)
+	if !ok {
+		return
+	}
+	prescription, ok := apiReviewPrescription(w, r)
+	if !ok {
+		return
+	}
+	var decision ReviewDecision
+	if !apiDecode(w, r, &decision) {
+		return
+	}
+	prescription, err := resolveReview(r, prescription, pharmacist, decision)
+	if err != nil {
+		writeReviewError(w, r, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, reviewItemJSON(prescription, true))
+}
+
+func apiReviewImageHandler(w http.ResponseWriter, r *http.Request) {
+	pharmacist, ok := apiPharmacist(w, r)
+	if !ok {
+		return
+	}
+	prescription, ok := apiReviewPrescription(w, r)
+	if !ok {
+		return
+	}
+	writeReviewImage(w, r, pharmacist, prescription)
+}
+
+// writeAPIAnswerError reports a failed askChat or askDiseasePrediction.
+func writeAPIAnswerError(w http.ResponseWriter, r *http.Request, err error) {
+	var aiErr *AIError
+	if errors.As(err, &aiErr) {
+		writeAIError(w, r, err)
+		return
+	}
+	log.Printf("Error answering question: %v", err)
+	apiError(w, r, http.StatusInternalServerError, "request_failed")
+}
+
+func apiChatHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	var req ChatRequest
+	if !apiDecode(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	language := languageOrDefault(preferredLanguage(r, username))
+	response, cached, err := askChat(r.Context(), username, language, req.Message)
+	if err != nil {
+		writeAPIAnswerError(w, r, err)
+		return
+	}
+	if cached {
+		skipAIQuota(w)
+	}
+	apiJSON(w, http.StatusOK, APIAnswer{Response: response, Cached: cached})
+}
+
+func apiPredictionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	var req DiseasePredictionRequest
+	if !apiDecode(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Symptoms) == "" {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	language := languageOrDefault(preferredLanguage(r, username))
+	response, cached, err := askDiseasePrediction(r.Context(), username, language, req)
+	if err != nil {
+		writeAPIAnswerError(w, r, err)
+		return
+	}
+	if cached {
+		skipAIQuota(w)
+	}
+	apiJSON(w, http.StatusOK, APIAnswer{Response: response, Cached: cached})
+}
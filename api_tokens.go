@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// API tokens authenticate /api/v1 requests as "Authorization: Bearer
+// cura_...". Session tokens come from signing in with a password (the mobile
+// app) and expire after apiSessionTTL; personal access tokens are created by
+// the user for scripts and last until they expire (after 30 days unless asked
+// for up to a year) or are revoked. Only a SHA-256 of each token is stored.
+
+const (
+	apiTokenPrefix           = "cura_"
+	apiSessionTTL            = 90 * 24 * time.Hour
+	defaultPersonalTokenDays = 30
+	maxPersonalTokenDays     = 365
+)
+
+var apiTokensColl *mongo.Collection
+
+var errInvalidToken = errors.New("invalid or expired API token")
+
+// APIToken is a stored token, without the secret itself.
+type APIToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username   string             `bson:"username" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	Kind       string             `bson:"kind" json:"kind"` // "session" or "personal"
+	Hash       string             `bson:"hash" json:"-"`
+	Prefix     string             `bson:"prefix" json:"prefix"` // start of the token, to tell them apart
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+func ensureAPITokenIndexes() error {
+	_, err := apiTokensColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		// Expired tokens are removed
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	// Tokens used to be able to never expire; those get the default expiry
+	// from now on
+	_, err = apiTokensColl.UpdateMany(context.Background(),
+		bson.M{"expires_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"expires_at": time.Now().AddDate(0, 0, defaultPersonalTokenDays)}})
+	return err
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAPIToken creates a token for username and returns it with its
+// secret, which is not stored and cannot be shown again.
+func issueAPIToken(username, kind, name string, ttl time.Duration) (APIToken, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIToken{}, "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now()
+	record := APIToken{
+		ID:        primitive.NewObjectID(),
+		Username:  username,
+		Name:      name,
+		Kind:      kind,
+		Hash:      hashAPIToken(token),
+		Prefix:    token[:len(apiTokenPrefix)+6],
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		record.ExpiresAt = &expires
+	}
+	if _, err := apiTokensColl.InsertOne(context.Background(), record); err != nil {
+		return APIToken{}, "", err
+	}
+	return record, token, nil
+}
+
+// authenticateAPIToken returns the token record and its user.
+func authenticateAPIToken(token string) (APIToken, User, error) {
+	var record APIToken
+	var user User
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return record, user, errInvalidToken
+	}
+
+	ctx := context.Background()
+	err := apiTokensColl.FindOne(ctx, bson.M{"hash": hashAPIToken(token)}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return record, user, errInvalidToken
+	} else if err != nil {
+		return record, user, err
+	}
+	// The TTL index only runs once a minute
+	if record.ExpiresAt != nil && time.Now().After(*record.ExpiresAt) {
+		return record, user, errInvalidToken
+	}
+
+	err = usersColl.FindOne(ctx, bson.M{"username": record.Username}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return record, user, errInvalidToken
+	} else if err != nil {
+		return record, user, err
+	}
+
+	// Recorded at most once a minute per token
+	now := time.Now()
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) > time.Minute {
+		apiTokensColl.UpdateOne(ctx, bson.M{"_id": record.ID}, bson.M{"$set": bson.M{"last_used_at": now}})
+	}
+	return record, user, nil
+}
+
+// listAPITokens returns username's tokens, newest first.
+func listAPITokens(username string) ([]APIToken, error) {
+	ctx := context.Background()
+	cursor, err := apiTokensColl.Find(ctx, bson.M{"username": username},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	tokens := []APIToken{}
+	err = cursor.All(ctx, &tokens)
+	return tokens, err
+}
+
+// revokeAPIToken deletes one of username's tokens, reporting whether it
+// existed.
+func revokeAPIToken(username string, id primitive.ObjectID) (bool, error) {
+	result, err := apiTokensColl.DeleteOne(context.Background(), bson.M{"_id": id, "username": username})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit actions recorded against prescription data
+const (
+	auditCreate         = "create"
+	auditImport         = "import"
+	auditView           = "view"
+	auditList           = "list" // shown in a list, e.g. with its medicine names
+	auditViewImage      = "view_image"
+	auditDownload       = "download"
+	auditEdit           = "edit"
+	auditReview         = "review"
+	auditDelete         = "delete"
+	auditShare          = "share"
+	auditShareRevoke    = "share_revoke"
+	auditSharedView     = "shared_view"
+	auditSharedDownload = "shared_download"
+	auditVerify         = "verify"
+	auditExport         = "export"
+	auditAccountDelete  = "account_delete"
+)
+
+// AuditEvent is one entry in the append-only access log. Each event's hash
+// covers its fields and the previous event's hash, so editing or removing an
+// event breaks the chain from that point on.
+type AuditEvent struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Seq      int64              `bson:"seq" json:"seq"`
+	Actor    string             `bson:"actor" json:"actor"`
+	Patient  string             `bson:"patient" json:"-"`
+	Action   string             `bson:"action" json:"action"`
+	RecordID string             `bson:"record_id,omitempty" json:"record_id,omitempty"`
+	IP       string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	Time     time.Time          `bson:"time" json:"time"`
+	PrevHash string             `bson:"prev_hash" json:"-"`
+	Hash     string             `bson:"hash" json:"hash"`
+}
+
+var (
+	auditColl *mongo.Collection
+
+	// auditMu serialises appends so each event links to the one before it
+	auditMu      sync.Mutex
+	auditTip     AuditEvent
+	auditTipRead bool
+)
+
+func auditHash(event AuditEvent) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		event.PrevHash,
+		strconv.FormatInt(event.Seq, 10),
+		event.Actor,
+		event.Patient,
+		event.Action,
+		event.RecordID,
+		event.IP,
+		event.Time.UTC().Format(time.RFC3339Nano),
+	}, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+func ensureAuditIndexes() error {
+	_, err := auditColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		// A unique sequence stops two writers from forking the chain
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "patient", Value: 1}, {Key: "time", Value: -1}}},
+	})
+	return err
+}
+
+func appendAuditEvent(event AuditEvent) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	// Mongo keeps milliseconds; hash what will be read back
+	event.Time = time.Now().UTC().Truncate(time.Millisecond)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if !auditTipRead {
+			auditTip = AuditEvent{}
+			opts := options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})
+			err := auditColl.FindOne(context.Background(), bson.M{}, opts).Decode(&auditTip)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			auditTipRead = true
+		}
+
+		event.ID = primitive.NilObjectID
+		event.Seq = auditTip.Seq + 1
+		event.PrevHash = auditTip.Hash
+		event.Hash = auditHash(event)
+
+		_, err := auditColl.InsertOne(context.Background(), event)
+		if err == nil {
+			auditTip = event
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		// Another instance appended first; re-read the tip and retry
+		auditTipRead = false
+	}
+	return fmt.Errorf("audit log is busy")
+}
+
+// recordAudit logs an access to patient's data. r may be nil for background
+// jobs. Failures are logged rather than failing the user's request.
+func recordAudit(r *http.Request, actor, patient, action, recordID string) {
+	event := AuditEvent{
+		Actor:    actor,
+		Patient:  patient,
+		Action:   action,
+		RecordID: recordID,
+	}
+	if r != nil {
+		event.IP = clientIP(r)
+	}
+	if err := appendAuditEvent(event); err != nil {
+		log.Printf("Error writing audit event (%s %s by %s): %v", action, recordID, actor, err)
+	}
+}
+
+// recordListAudit logs that actor was shown a list of prescriptions. Held ones
+// are left out, since a list shows nothing of them.
+func recordListAudit(r *http.Request, actor string, prescriptions []Prescription) {
+	for _, prescription := range prescriptions {
+		if !prescription.Withheld() {
+			recordAudit(r, actor, prescription.PatientID, auditList, prescription.ID.Hex())
+		}
+	}
+}
+
+// verifyAuditChain walks the whole log and returns the sequence number of the
+// first event that does not match its hash or link, or 0 if it is intact.
+func verifyAuditChain() (int64, int64, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}})
+	cursor, err := auditColl.Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	var count int64
+	var prev AuditEvent
+	for cursor.Next(context.Background()) {
+		var event AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return count, 0, err
+		}
+		count++
+		if event.Seq != prev.Seq+1 || event.PrevHash != prev.Hash || auditHash(event) != event.Hash {
+			return count, event.Seq, nil
+		}
+		prev = event
+	}
+	return count, 0, cursor.Err()
+}
+
+func checkAuditChain() {
+	count, broken, err := verifyAuditChain()
+	switch {
+	case err != nil:
+		log.Printf("Error verifying audit log: %v", err)
+	case broken != 0:
+		log.Printf("WARNING: audit log has been tampered with at event %d", broken)
+	default:
+		log.Printf("Audit log verified (%d events)", count)
+	}
+}
+
+// patientAuditEvents returns the access history of username's records,
+// newest first, optionally for a single record.
+func patientAuditEvents(username, recordID string, limit int64) ([]AuditEvent, error) {
+	filter := bson.M{"patient": username}
+	if recordID != "" {
+		filter["record_id"] = recordID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := auditColl.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []AuditEvent{}
+	err = cursor.All(context.Background(), &events)
+	return events, err
+}
+
+// auditHandler shows patients who accessed their records and when:
+// GET /audit[?record_id=...]
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	events, err := patientAuditEvents(username, r.URL.Query().Get("record_id"), 200)
+	if err != nil {
+		log.Printf("Error fetching audit events: %v", err)
+		httpError(w, r, "fetch_access_history_failed", http.StatusInternalServerError)
+		return
+	}
+
+	entries := []map[string]interface{}{}
+	for _, event := range events {
+		entries = append(entries, map[string]interface{}{
+			"actor":     event.Actor,
+			"action":    event.Action,
+			"record_id": event.RecordID,
+			"ip":        event.IP,
+			"time":      event.Time,
+			// Recomputed so an edited entry shows up as altered
+			"intact": auditHash(event) == event.Hash,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": entries})
+}
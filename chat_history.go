@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ChatMessage is one question and answer from the health assistant, kept so
+// users can download their history.
+type ChatMessage struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Username  string             `bson:"username" json:"-"`
+	Mode      string             `bson:"mode" json:"mode"` // "general" or "disease"
+	Message   string             `bson:"message" json:"message"`
+	Response  string             `bson:"response" json:"response"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+
+	// Voice questions store the transcript as Message; the recording is
+	// only kept when the user opted in
+	Voice     bool               `bson:"voice,omitempty" json:"voice,omitempty"`
+	Language  string             `bson:"language,omitempty" json:"language,omitempty"`
+	AudioID   primitive.ObjectID `bson:"audio_id,omitempty" json:"-"`
+	AudioFile string             `bson:"-" json:"audio,omitempty"` // path in the data export
+}
+
+var chatMessagesColl *mongo.Collection
+
+func saveChatMessage(username, mode, message, response string) {
+	_, err := chatMessagesColl.InsertOne(context.Background(), ChatMessage{
+		Username:  username,
+		Mode:      mode,
+		Message:   message,
+		Response:  response,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error saving chat message: %v", err)
+	}
+}
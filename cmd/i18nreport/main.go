@@ -0,0 +1,165 @@
+// Command i18nreport lists, per locale, the keys that still fall back to
+// English: keys missing from the locale file and values left identical to
+// the English text. It also flags placeholder mismatches, keys English does
+// not have, and keys the page templates use that English lacks.
+//
+//	go run ./cmd/i18nreport [-locales static/locales] [-templates templates]
+//
+// The exit status is 1 when any locale is missing keys or breaks a
+// placeholder, so it can run in CI.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	placeholderRe = regexp.MustCompile(`\{\w+\}`)
+	templateKeyRe = regexp.MustCompile(`(?:data-i18n="|:|\{\{t ")([a-z_]+(?:\.[A-Za-z0-9_]+)+)`)
+	letterRe      = regexp.MustCompile(`\pL`)
+)
+
+func main() {
+	localeDir := flag.String("locales", "static/locales", "directory with <lang>.json locale files")
+	templateDir := flag.String("templates", "templates", "directory with the page templates")
+	flag.Parse()
+
+	english, err := loadLocale(filepath.Join(*localeDir, "en.json"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	failed := false
+	if missing := templateKeys(*templateDir, english); len(missing) > 0 {
+		failed = true
+		fmt.Printf("templates: %d keys missing from en.json\n", len(missing))
+		printKeys(missing)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(*localeDir, "*.json"))
+	sort.Strings(files)
+	for _, f := range files {
+		lang := strings.TrimSuffix(filepath.Base(f), ".json")
+		if lang == "en" {
+			continue
+		}
+		locale, err := loadLocale(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+
+		var missing, untranslated, placeholders, extra []string
+		for key, text := range english {
+			value, ok := locale[key]
+			switch {
+			case !ok:
+				missing = append(missing, key)
+			case value == text && letterRe.MatchString(placeholderRe.ReplaceAllString(text, "")):
+				untranslated = append(untranslated, key)
+			case !samePlaceholders(text, value):
+				placeholders = append(placeholders, key)
+			}
+		}
+		for key := range locale {
+			if _, ok := english[key]; !ok {
+				extra = append(extra, key)
+			}
+		}
+
+		fmt.Printf("%s: %d missing, %d same as English, %d placeholder mismatches, %d unknown\n",
+			lang, len(missing), len(untranslated), len(placeholders), len(extra))
+		for _, group := range []struct {
+			label string
+			keys  []string
+		}{
+			{"missing", missing},
+			{"same as English", untranslated},
+			{"placeholder mismatch", placeholders},
+			{"not in en.json", extra},
+		} {
+			if len(group.keys) > 0 {
+				fmt.Printf("  %s:\n", group.label)
+				printKeys(group.keys)
+			}
+		}
+		if len(missing) > 0 || len(placeholders) > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// loadLocale reads a locale file into dotted keys, e.g. "pdf.months.1".
+func loadLocale(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dict map[string]interface{}
+	if err := json.Unmarshal(data, &dict); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	flat := map[string]string{}
+	flatten("", dict, flat)
+	return flat, nil
+}
+
+func flatten(prefix string, node map[string]interface{}, out map[string]string) {
+	for k, v := range node {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(prefix+k+".", v, out)
+		case string:
+			out[prefix+k] = v
+		}
+	}
+}
+
+func samePlaceholders(a, b string) bool {
+	pa, pb := placeholderRe.FindAllString(a, -1), placeholderRe.FindAllString(b, -1)
+	sort.Strings(pa)
+	sort.Strings(pb)
+	return strings.Join(pa, ",") == strings.Join(pb, ",")
+}
+
+// templateKeys returns the keys referenced by data-i18n, data-i18n-attr and
+// {{t "..."}} in the templates that en.json does not define.
+func templateKeys(dir string, english map[string]string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.html"))
+	seen := map[string]bool{}
+	var missing []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, m := range templateKeyRe.FindAllStringSubmatch(string(data), -1) {
+			key := m[1]
+			if _, ok := english[key]; !ok && !seen[key] {
+				seen[key] = true
+				missing = append(missing, key)
+			}
+		}
+	}
+	return missing
+}
+
+func printKeys(keys []string) {
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("    %s\n", k)
+	}
+}
@@ -0,0 +1,113 @@
+// Command smsgateway is a fake SMS gateway for trying the SMS channel
+// locally. Each line typed on stdin is delivered to the webhook as an
+// inbound SMS, and the replies are printed with their length:
+//
+//	SMS_WEBHOOK_TOKEN=secret go run ./cmd/smsgateway [-format twilio|json] [-from +919800000001]
+//
+// With -listen it also accepts the replies the server POSTs to SMS_REPLY_URL,
+// e.g. SMS_REPLY_URL=http://localhost:9090/send.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func main() {
+	webhook := flag.String("webhook", "http://localhost:8080/sms/inbound", "server's inbound SMS URL")
+	token := flag.String("token", os.Getenv("SMS_WEBHOOK_TOKEN"), "webhook token")
+	from := flag.String("from", "+919800000001", "sender number")
+	to := flag.String("to", "+919800000000", "service number")
+	format := flag.String("format", "twilio", "inbound format: twilio (form, TwiML reply) or json")
+	listen := flag.String("listen", "", "address to accept outbound messages on, e.g. :9090")
+	flag.Parse()
+
+	if *listen != "" {
+		go func() {
+			err := http.ListenAndServe(*listen, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var msg struct{ From, To, Text string }
+				if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				printMessage("sent to "+msg.To, msg.Text)
+			}))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	target := *webhook + "?token=" + url.QueryEscape(*token)
+	client := http.Client{Timeout: 2 * time.Minute}
+	scanner := bufio.NewScanner(os.Stdin)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		id := fmt.Sprintf("SM%d%d", time.Now().UnixNano(), n)
+
+		var resp *http.Response
+		var err error
+		if *format == "json" {
+			body, _ := json.Marshal(map[string]string{"from": *from, "to": *to, "text": text, "id": id})
+			resp, err = client.Post(target, "application/json", bytes.NewReader(body))
+		} else {
+			resp, err = client.PostForm(target, url.Values{"From": {*from}, "To": {*to}, "Body": {text}, "MessageSid": {id}})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		replies, err := readReplies(resp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		for _, reply := range replies {
+			printMessage("reply", reply)
+		}
+	}
+}
+
+// readReplies takes the messages from a TwiML or JSON webhook response.
+func readReplies(resp *http.Response) ([]string, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/xml") {
+		var twiml struct {
+			Messages []string `xml:"Message"`
+		}
+		err := xml.Unmarshal(body, &twiml)
+		return twiml.Messages, err
+	}
+	var reply struct {
+		Messages []string `json:"messages"`
+	}
+	err = json.Unmarshal(body, &reply)
+	return reply.Messages, err
+}
+
+func printMessage(label, text string) {
+	fmt.Printf("[%s, %d chars] %s\n", label, utf8.RuneCountInString(text), text)
+}
@@ -0,0 +1,182 @@
+// Command whatsappstub stands in for the WhatsApp Cloud API when trying the
+// bot locally. It serves the Graph API calls the server makes (media lookup
+// and download, sending messages) and prints the replies, and turns each
+// line typed on stdin into a signed webhook delivery:
+//
+//	hello                  a text message
+//	/photo rx.jpg          a photo of a prescription
+//	/doc rx.pdf            a document
+//
+// Run the server with WHATSAPP_API_URL=http://localhost:9091 and the same
+// WHATSAPP_APP_SECRET, then:
+//
+//	WHATSAPP_APP_SECRET=secret go run ./cmd/whatsappstub [-from 919800000001]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	mediaMu sync.Mutex
+	media   = map[string][]byte{}
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:9091", "address for the stand-in Graph API")
+	webhook := flag.String("webhook", "http://localhost:8080/whatsapp/webhook", "server's webhook URL")
+	secret := flag.String("secret", os.Getenv("WHATSAPP_APP_SECRET"), "app secret used to sign deliveries")
+	from := flag.String("from", "919800000001", "sender number, digits only")
+	phoneNumberID := flag.String("phone-number-id", "100000000000001", "business phone number ID")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			http.Error(w, `{"error":{"message":"missing access token"}}`, http.StatusUnauthorized)
+			return
+		}
+		path := strings.Trim(r.URL.Path, "/")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(path, "/messages"):
+			var msg struct {
+				To   string `json:"to"`
+				Text struct {
+					Body string `json:"body"`
+				} `json:"text"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Printf("--- to %s ---\n%s\n", msg.To, msg.Text.Body)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"messages": []map[string]string{{"id": fmt.Sprintf("wamid.stub%d", time.Now().UnixNano())}},
+			})
+		case r.Method == http.MethodGet && strings.HasPrefix(path, "files/"):
+			data, ok := lookupMedia(strings.TrimPrefix(path, "files/"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		case r.Method == http.MethodGet:
+			data, ok := lookupMedia(path)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":        path,
+				"url":       "http://" + *listen + "/files/" + path,
+				"mime_type": http.DetectContentType(data),
+				"file_size": len(data),
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	go func() {
+		if err := http.ListenAndServe(*listen, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		msg := map[string]interface{}{
+			"from":      *from,
+			"id":        fmt.Sprintf("wamid.in%d%d", time.Now().UnixNano(), n),
+			"timestamp": fmt.Sprint(time.Now().Unix()),
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch command {
+		case "/photo", "/doc":
+			data, err := os.ReadFile(arg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			id := fmt.Sprintf("media%d", n)
+			mediaMu.Lock()
+			media[id] = data
+			mediaMu.Unlock()
+			file := map[string]string{"id": id, "mime_type": http.DetectContentType(data)}
+			if command == "/photo" {
+				msg["type"], msg["image"] = "image", file
+			} else {
+				file["filename"] = filepath.Base(arg)
+				msg["type"], msg["document"] = "document", file
+			}
+		default:
+			msg["type"], msg["text"] = "text", map[string]string{"body": line}
+		}
+
+		if err := deliver(*webhook, *secret, *phoneNumberID, msg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+func lookupMedia(id string) ([]byte, bool) {
+	mediaMu.Lock()
+	defer mediaMu.Unlock()
+	data, ok := media[id]
+	return data, ok
+}
+
+// deliver posts msg to the webhook the way the Cloud API does.
+func deliver(webhook, secret, phoneNumberID string, msg map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"object": "whatsapp_business_account",
+		"entry": []interface{}{map[string]interface{}{
+			"id": "stub",
+			"changes": []interface{}{map[string]interface{}{
+				"field": "messages",
+				"value": map[string]interface{}{
+					"messaging_product": "whatsapp",
+					"metadata":          map[string]string{"phone_number_id": phoneNumberID},
+					"messages":          []interface{}{msg},
+				},
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
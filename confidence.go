@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Confidence of an analysis. From prescription_analysis.v4 the model rates
+// how sure it is of each field it reads ("field_confidence", at the top level
+// and per medicine) and of each medicine as a whole ("confidence"), from 0 to
+// 1. Those ratings are combined with how well each medicine matches
+// data/medicine_catalog.json: a name close to a known medicine without being
+// one, or a strength the medicine is not made in, is the usual sign of a
+// misreading. Items scoring below the catalog's low_confidence are shown
+// apart on the dashboard, in the API and in the PDF with advice to check them
+// with a pharmacist, until someone corrects them or a pharmacist reviews the
+// prescription.
+
+const (
+	// catalogNearMatch is the catalog score of a name that is a letter or
+	// two away from a known medicine.
+	catalogNearMatch = 0.5
+	// catalogOddStrength is the catalog score of a strength the medicine is
+	// not made in.
+	catalogOddStrength = 0.5
+
+	minNearMatchSimilarity = 0.8
+	minNearMatchLength     = 5
+)
+
+// MedicineCatalog is data/medicine_catalog.json. Medicines match by name or
+// alias as whole words, as in data/pregnancy_safety.json.
+type MedicineCatalog struct {
+	LowConfidence float64           `json:"low_confidence"`
+	Medicines     []CatalogMedicine `json:"medicines"`
+}
+
+type CatalogMedicine struct {
+	Name        string    `json:"name"`
+	Aliases     []string  `json:"aliases"`
+	StrengthsMg []float64 `json:"strengths_mg"`
+}
+
+// FieldConfidence is how sure we are of one item of an analysis. Paths are
+// those of corrections: "prescriber", "medicines.0.dosage", and "medicines.0"
+// for a medicine as a whole.
+type FieldConfidence struct {
+	Path       string   `json:"path"`
+	Score      float64  `json:"score"` // the lower of the model's and the catalog's
+	Model      *float64 `json:"model,omitempty"`
+	Catalog    *float64 `json:"catalog,omitempty"`
+	Suggestion string   `json:"suggestion,omitempty"` // the catalog medicine a doubtful name is closest to
+	Low        bool     `json:"low"`
+	Checked    bool     `json:"checked,omitempty"` // corrected, or the prescription was reviewed by a pharmacist
+}
+
+// AnalysisConfidence lists the items of an analysis that have a score.
+type AnalysisConfidence struct {
+	Threshold float64           `json:"threshold"`
+	Low       int               `json:"low"` // items below the threshold that nobody has checked
+	Items     []FieldConfidence `json:"items"`
+}
+
+var medicineCatalog = MedicineCatalog{LowConfidence: 0.7}
+
+func loadMedicineCatalog(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: medicine catalog not loaded: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, &medicineCatalog); err != nil {
+		log.Printf("Warning: error parsing medicine catalog: %v", err)
+	}
+}
+
+// analysisConfidence scores the fields and medicines of the prescription's
+// current analysis, or returns nil if the analysis cannot be read.
+func analysisConfidence(prescription Prescription) *AnalysisConfidence {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(prescription.Analysis)), &doc); err != nil {
+		return nil
+	}
+
+	// A field someone corrected is no longer the model's guess; a corrected
+	// name settles the medicine as a whole
+	corrected := map[string]bool{}
+	if prescription.OriginalAnalysis != "" {
+		for _, diff := range diffAnalyses(prescription.OriginalAnalysis, prescription.Analysis) {
+			corrected[diff.Path] = true
+			if medicine, ok := strings.CutSuffix(diff.Path, ".name"); ok {
+				corrected[medicine] = true
+			}
+		}
+	}
+	reviewed := prescription.Review != nil &&
+		(prescription.Review.Status == reviewApproved || prescription.Review.Status == reviewCorrected)
+
+	result := &AnalysisConfidence{Threshold: medicineCatalog.LowConfidence, Items: []FieldConfidence{}}
+	add := func(path string, model, catalog *float64, suggestion string) {
+		if model == nil && catalog == nil {
+			return
+		}
+		item := FieldConfidence{Path: path, Score: 1, Model: model, Catalog: catalog, Suggestion: suggestion}
+		if model != nil {
+			item.Score = *model
+		}
+		if catalog != nil {
+			item.Score = min(item.Score, *catalog)
+		}
+		item.Checked = reviewed || corrected[path]
+		item.Low = !item.Checked && item.Score < result.Threshold
+		if item.Low {
+			result.Low++
+		}
+		result.Items = append(result.Items, item)
+	}
+
+	fields, _ := doc["field_confidence"].(map[string]interface{})
+	for _, field := range correctableFields {
+		add(field, confidenceValue(fields[field]), nil, "")
+	}
+
+	medicines, _ := doc["medicines"].([]interface{})
+	for i, med := range medicines {
+		medicine, ok := med.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, generic := fieldText(medicine["name"]), fieldText(medicine["generic_name"])
+		nameScore, suggestion := catalogNameScore(name, generic)
+		path := fmt.Sprintf("medicines.%d", i)
+		add(path, confidenceValue(medicine["confidence"]), nameScore, suggestion)
+
+		fields, _ := medicine["field_confidence"].(map[string]interface{})
+		for _, field := range correctableMedicineFields {
+			var catalog *float64
+			hint := ""
+			switch field {
+			case "name":
+				catalog, hint = nameScore, suggestion
+			case "dosage":
+				catalog = catalogStrengthScore(name, generic, fieldText(medicine["dosage"]))
+			}
+			add(path+"."+field, confidenceValue(fields[field]), catalog, hint)
+		}
+	}
+	return result
+}
+
+// lowConfidencePaths are the paths of the items that need checking.
+func (c *AnalysisConfidence) lowConfidencePaths() map[string]bool {
+	paths := map[string]bool{}
+	if c == nil {
+		return paths
+	}
+	for _, item := range c.Items {
+		if item.Low {
+			paths[item.Path] = true
+		}
+	}
+	return paths
+}
+
+// suggestion is the catalog medicine to offer for the item at path when it
+// needs checking.
+func (c *AnalysisConfidence) suggestion(path string) string {
+	if c == nil {
+		return ""
+	}
+	for _, item := range c.Items {
+		if item.Path == path && item.Low {
+			return item.Suggestion
+		}
+	}
+	return ""
+}
+
+// confidenceValue reads a model rating, accepting percentages, or returns
+// nil when there is none.
+func confidenceValue(v interface{}) *float64 {
+	n, ok := analysisNumber(v)
+	if !ok || n < 0 || n > 100 {
+		return nil
+	}
+	if n > 1 {
+		n /= 100
+	}
+	return &n
+}
+
+// findCatalogMedicine looks up the first of names that is in the catalog.
+func findCatalogMedicine(names ...string) (CatalogMedicine, bool) {
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		for _, entry := range medicineCatalog.Medicines {
+			if matchesDrug(name, entry.Name, entry.Aliases) {
+				return entry, true
+			}
+		}
+	}
+	return CatalogMedicine{}, false
+}
+
+// catalogNameScore scores the name as read and, when the catalog knows
+// nothing like it, the untranslated generic name: analyses in other languages
+// may write the name in their own script. The name comes first so that a
+// misreading of it is still caught when the model got the generic right.
+func catalogNameScore(name, generic string) (*float64, string) {
+	for _, n := range []string{name, generic} {
+		if score, suggestion := catalogNameMatch(n); score != nil {
+			return score, suggestion
+		}
+	}
+	return nil, ""
+}
+
+// catalogNameMatch is 1 for a name in the catalog and catalogNearMatch, with
+// the medicine it is closest to, for one that is a near miss. Names the
+// catalog does not know at all get no score: it is far from complete.
+func catalogNameMatch(name string) (*float64, string) {
+	if strings.TrimSpace(name) == "" {
+		return nil, ""
+	}
+	if _, ok := findCatalogMedicine(name); ok {
+		score := 1.0
+		return &score, ""
+	}
+
+	best, suggestion := 0.0, ""
+	for _, word := range strings.Fields(normalizeMedicineName(name)) {
+		if utf8.RuneCountInString(word) < minNearMatchLength {
+			continue
+		}
+		for _, entry := range medicineCatalog.Medicines {
+			for _, candidate := range append([]string{entry.Name}, entry.Aliases...) {
+				// Multi-word names ("Folic acid") are compared by their
+				// first word; the same word with a different rest ("Vitamin
+				// B12") is another medicine, not a misreading
+				first, _, _ := strings.Cut(strings.TrimSpace(normalizeMedicineName(candidate)), " ")
+				if first == word {
+					continue
+				}
+				if s := wordSimilarity(word, first); s > best {
+					best, suggestion = s, entry.Name
+				}
+			}
+		}
+	}
+	if best < minNearMatchSimilarity {
+		return nil, ""
+	}
+	score := catalogNearMatch
+	return &score, suggestion
+}
+
+// catalogStrengthScore is 1 when the strength in the name or dosage is one
+// the catalog medicine is made in and catalogOddStrength when it is not, or
+// nil when either is unknown.
+func catalogStrengthScore(name, generic, dosage string) *float64 {
+	entry, ok := findCatalogMedicine(name, generic)
+	if !ok || len(entry.StrengthsMg) == 0 {
+		return nil
+	}
+	strength, ok := strengthMg(name + " " + dosage)
+	if !ok {
+		return nil
+	}
+	score := catalogOddStrength
+	for _, s := range entry.StrengthsMg {
+		if math.Abs(s-strength) < 1e-6 {
+			score = 1
+			break
+		}
+	}
+	return &score
+}
+
+// wordSimilarity is 1 minus the edit distance between a and b relative to
+// the longer of the two.
+func wordSimilarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Corrections fix what the model misread. A correction sets, removes or adds
+// individual fields of an analysis and makes a new version of it: the
+// prescription keeps the latest text in analysis, so the dashboard, PDF
+// reports, reminders and safety warnings all use it, and the model's own text
+// in original_analysis. Version 1 is the model's; every later version is kept
+// in analysis_revisions with who made it and when.
+
+const (
+	maxCorrectionChanges = 50
+	maxCorrectionValue   = 500
+	maxCorrectionComment = 1000
+)
+
+var analysisRevisionsColl *mongo.Collection
+
+var (
+	errInvalidCorrection = errors.New("invalid correction")
+	errVersionConflict   = errors.New("the analysis was corrected by someone else")
+)
+
+// correctableFields are the analysis fields a correction may set; medicines
+// are corrected through correctableMedicineFields.
+var (
+	correctableFields         = []string{"patient_name", "date", "prescriber", "manufacturer", "lot_number", "expiration_date"}
+	correctableMedicineFields = []string{"name", "dosage", "purpose", "instructions", "warnings"}
+)
+
+// AnalysisChange is one edit. Paths are "prescriber", "medicines.1.dosage",
+// "medicines.2" (to remove a medicine) or "medicines" (to add one). Medicine
+// indexes refer to the version being corrected.
+type AnalysisChange struct {
+	Op    string      `json:"op,omitempty"` // "set" (default), "remove" or "add"
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"` // a string, or for "add" an object of medicine fields
+}
+
+type CorrectionRequest struct {
+	BaseVersion int              `json:"base_version"` // required: the version shown to the user; 409 if it is no longer current
+	Changes     []AnalysisChange `json:"changes"`
+	Comment     string           `json:"comment,omitempty"`
+}
+
+// AnalysisRevision is one version of an analysis.
+type AnalysisRevision struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	PrescriptionID primitive.ObjectID `bson:"prescription_id" json:"-"`
+	PatientID      string             `bson:"patient_id" json:"-"`
+	Version        int                `bson:"version" json:"version"`
+	Author         string             `bson:"author" json:"author"`           // username, or the model for version 1
+	AuthorRole     string             `bson:"author_role" json:"author_role"` // "model" or "import" for version 1, else the author's role
+	Comment        string             `bson:"comment,omitempty" json:"comment,omitempty"`
+	Fields         []string           `bson:"fields,omitempty" json:"fields,omitempty"` // paths the version changed
+	Analysis       string             `bson:"analysis" json:"-"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// FieldDiff is a field that differs between two versions; Old or New is
+// empty when a medicine was added or removed.
+type FieldDiff struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// RevisionHistory is what the revisions endpoints answer.
+type RevisionHistory struct {
+	CurrentVersion int                `json:"current_version"`
+	Revisions      []AnalysisRevision `json:"revisions"`
+	From           int                `json:"from"`
+	To             int                `json:"to"`
+	Diff           []FieldDiff        `json:"diff"`
+}
+
+func ensureRevisionIndexes() error {
+	_, err := analysisRevisionsColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "prescription_id", Value: 1}, {Key: "version", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "patient_id", Value: 1}}},
+	})
+	return err
+}
+
+// currentVersion is the version of the prescription's analysis.
+func (p Prescription) currentVersion() int {
+	return max(1, p.Version)
+}
+
+// originalAnalysis is the model's text, before any correction.
+func (p Prescription) originalAnalysis() string {
+	if p.OriginalAnalysis != "" {
+		return p.OriginalAnalysis
+	}
+	return p.Analysis
+}
+
+// accountRole is the role stored on username's account. The role in the
+// session is the one it had at sign-in and may have changed since.
+func accountRole(username string) (string, error) {
+	var user User
+	err := usersColl.FindOne(context.Background(), bson.M{"username": username},
+		options.FindOne().SetProjection(bson.M{"role": 1})).Decode(&user)
+	return user.Role, err
+}
+
+// correctAnalysis applies req to the prescription as author and saves the
+// result as the next version.
+func correctAnalysis(r *http.Request, prescription Prescription, author, role string, req CorrectionRequest) (Prescription, error) {
+	current := prescription.currentVersion()
+	// Without the version the user saw, a correction could silently undo
+	// one saved in the meantime
+	if req.BaseVersion == 0 {
+		return prescription, errInvalidCorrection
+	}
+	if req.BaseVersion != current {
+		return prescription, errVersionConflict
+	}
+	if len(req.Changes) == 0 || len(req.Changes) > maxCorrectionChanges || len(req.Comment) > maxCorrectionComment {
+		return prescription, errInvalidCorrection
+	}
+	corrected, fields, err := applyCorrections(prescription.Analysis, req.Changes)
+	if err != nil {
+		return prescription, err
+	}
+	if len(diffAnalyses(prescription.Analysis, corrected)) == 0 {
+		return prescription, errInvalidCorrection
+	}
+
+	sealed, err := encryptString(corrected)
+	if err != nil {
+		return prescription, err
+	}
+	set := bson.M{
+		"analysis":     sealed,
+		"version":      current + 1,
+		"search_terms": searchTerms(corrected),
+		"search_key":   searchKeyID,
+	}
+	// Only applies if nobody saved another version in the meantime
+	filter := bson.M{"_id": prescription.ID, "version": prescription.Version}
+	if current == 1 {
+		original, err := encryptString(prescription.Analysis)
+		if err != nil {
+			return prescription, err
+		}
+		set["original_analysis"] = original
+		filter["version"] = bson.M{"$in": bson.A{nil, 0, 1}}
+	}
+	ctx := context.Background()
+	result, err := prescriptionsColl.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return prescription, err
+	}
+	if result.MatchedCount == 0 {
+		return prescription, errVersionConflict
+	}
+
+	_, err = analysisRevisionsColl.InsertOne(ctx, AnalysisRevision{
+		PrescriptionID: prescription.ID,
+		PatientID:      prescription.PatientID,
+		Version:        current + 1,
+		Author:         author,
+		AuthorRole:     role,
+		Comment:        strings.TrimSpace(req.Comment),
+		Fields:         fields,
+		Analysis:       corrected,
+		CreatedAt:      time.Now(),
+	})
+	if err != nil {
+		// The correction stands; only its entry in the history is missing
+		log.Printf("Error saving revision %d of %s: %v", current+1, prescription.ID.Hex(), err)
+	}
+
+	recordAudit(r, author, prescription.PatientID, auditEdit, prescription.ID.Hex())
+	if current == 1 {
+		prescription.OriginalAnalysis = prescription.Analysis
+	}
+	prescription.Analysis = corrected
+	prescription.Version = current + 1
+	return prescription, nil
+}
+
+// applyCorrections returns the analysis with changes applied and the paths
+// they touched. Sets apply first, then removals, then additions, so indexes
+// always refer to the analysis as it was.
+func applyCorrections(analysis string, changes []AnalysisChange) (string, []string, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(analysis)), &doc); err != nil {
+		return "", nil, errInvalidCorrection
+	}
+	medicines, _ := doc["medicines"].([]interface{})
+
+	var fields []string
+	removed := map[int]bool{}
+	var added []interface{}
+	for _, change := range changes {
+		parts := strings.Split(change.Path, ".")
+		switch change.Op {
+		case "", "set":
+			value, ok := change.Value.(string)
+			if !ok || len(value) > maxCorrectionValue {
+				return "", nil, errInvalidCorrection
+			}
+			value = strings.TrimSpace(value)
+			switch {
+			case len(parts) == 1 && contains(correctableFields, parts[0]):
+				doc[parts[0]] = value
+			case len(parts) == 3 && parts[0] == "medicines" && contains(correctableMedicineFields, parts[2]):
+				med, ok := medicineAt(medicines, parts[1])
+				if !ok || (parts[2] == "name" && value == "") {
+					return "", nil, errInvalidCorrection
+				}
+				med[parts[2]] = value
+				switch parts[2] {
+				case "name":
+					// The generic name and alternatives were for the misread
+					// name
+					delete(med, "generic_name")
+					delete(med, "generic_alternatives")
+				case "dosage", "instructions":
+					// Reminders then follow the corrected dosage
+					delete(med, "schedule")
+				}
+			default:
+				return "", nil, errInvalidCorrection
+			}
+		case "remove":
+			if len(parts) != 2 || parts[0] != "medicines" {
+				return "", nil, errInvalidCorrection
+			}
+			if _, ok := medicineAt(medicines, parts[1]); !ok {
+				return "", nil, errInvalidCorrection
+			}
+			i, _ := strconv.Atoi(parts[1])
+			removed[i] = true
+		case "add":
+			value, ok := change.Value.(map[string]interface{})
+			if change.Path != "medicines" || !ok {
+				return "", nil, errInvalidCorrection
+			}
+			med := map[string]interface{}{}
+			for key, v := range value {
+				s, ok := v.(string)
+				if !ok || !contains(correctableMedicineFields, key) || len(s) > maxCorrectionValue {
+					return "", nil, errInvalidCorrection
+				}
+				med[key] = strings.TrimSpace(s)
+			}
+			if med["name"] == nil || med["name"] == "" {
+				return "", nil, errInvalidCorrection
+			}
+			added = append(added, med)
+		default:
+			return "", nil, errInvalidCorrection
+		}
+		fields = append(fields, change.Path)
+	}
+
+	if len(removed) > 0 || len(added) > 0 {
+		kept := []interface{}{}
+		for i, med := range medicines {
+			if !removed[i] {
+				kept = append(kept, med)
+			}
+		}
+		doc["medicines"] = append(kept, added...)
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data), fields, nil
+}
+
+func medicineAt(medicines []interface{}, index string) (map[string]interface{}, bool) {
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(medicines) {
+		return nil, false
+	}
+	med, ok := medicines[i].(map[string]interface{})
+	return med, ok
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// diffAnalyses lists the correctable fields that differ between two
+// versions. Medicines are paired by name, then in order, so removing one
+// does not show every later medicine as changed.
+func diffAnalyses(oldAnalysis, newAnalysis string) []FieldDiff {
+	var oldDoc, newDoc map[string]interface{}
+	json.Unmarshal([]byte(cleanAnalysisJSON(oldAnalysis)), &oldDoc)
+	json.Unmarshal([]byte(cleanAnalysisJSON(newAnalysis)), &newDoc)
+
+	diffs := []FieldDiff{}
+	for _, field := range correctableFields {
+		if o, n := fieldText(oldDoc[field]), fieldText(newDoc[field]); o != n {
+			diffs = append(diffs, FieldDiff{Path: field, Old: o, New: n})
+		}
+	}
+
+	oldMeds, _ := oldDoc["medicines"].([]interface{})
+	newMeds, _ := newDoc["medicines"].([]interface{})
+	pairs := map[int]int{} // new index -> old index
+	paired := map[int]bool{}
+	for j, n := range newMeds {
+		for i, o := range oldMeds {
+			if !paired[i] && strings.EqualFold(medicineField(o, "name"), medicineField(n, "name")) {
+				pairs[j], paired[i] = i, true
+				break
+			}
+		}
+	}
+	next := 0
+	for j := range newMeds {
+		if _, ok := pairs[j]; ok {
+			continue
+		}
+		for next < len(oldMeds) && paired[next] {
+			next++
+		}
+		if next < len(oldMeds) {
+			pairs[j], paired[next] = next, true
+		}
+	}
+
+	for j, n := range newMeds {
+		var o interface{}
+		if i, ok := pairs[j]; ok {
+			o = oldMeds[i]
+		}
+		for _, field := range correctableMedicineFields {
+			if ov, nv := medicineField(o, field), medicineField(n, field); ov != nv {
+				diffs = append(diffs, FieldDiff{Path: fmt.Sprintf("medicines.%d.%s", j, field), Old: ov, New: nv})
+			}
+		}
+	}
+	for i, o := range oldMeds {
+		if paired[i] {
+			continue
+		}
+		for _, field := range correctableMedicineFields {
+			if ov := medicineField(o, field); ov != "" {
+				diffs = append(diffs, FieldDiff{Path: fmt.Sprintf("medicines.%d.%s", i, field), Old: ov})
+			}
+		}
+	}
+	return diffs
+}
+
+func medicineField(med interface{}, field string) string {
+	m, _ := med.(map[string]interface{})
+	return fieldText(m[field])
+}
+
+func fieldText(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(v))
+}
+
+// revisionHistory lists every version of the prescription's analysis and the
+// differences between versions from and to (0 for the first and the current).
+func revisionHistory(prescription Prescription, from, to int) (RevisionHistory, error) {
+	current := prescription.currentVersion()
+	history := RevisionHistory{
+		CurrentVersion: current,
+		Revisions: []AnalysisRevision{{
+			Version:    1,
+			Author:     prescription.Model,
+			AuthorRole: "model",
+			Analysis:   prescription.originalAnalysis(),
+			CreatedAt:  prescription.UploadDate,
+		}},
+	}
+	if prescription.Source == "fhir" {
+		history.Revisions[0].Author, history.Revisions[0].AuthorRole = "FHIR", "import"
+	}
+
+	ctx := context.Background()
+	cursor, err := analysisRevisionsColl.Find(ctx, bson.M{"prescription_id": prescription.ID},
+		options.Find().SetSort(bson.D{{Key: "version", Value: 1}}))
+	if err != nil {
+		return history, err
+	}
+	var revisions []AnalysisRevision
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return history, err
+	}
+	history.Revisions = append(history.Revisions, revisions...)
+
+	if from == 0 {
+		from = 1
+	}
+	if to == 0 {
+		to = current
+	}
+	versions := map[int]string{}
+	for _, revision := range history.Revisions {
+		versions[revision.Version] = revision.Analysis
+	}
+	versions[current] = prescription.Analysis
+	oldAnalysis, okFrom := versions[from]
+	newAnalysis, okTo := versions[to]
+	if !okFrom || !okTo {
+		return history, errInvalidCorrection
+	}
+	history.From, history.To = from, to
+	history.Diff = diffAnalyses(oldAnalysis, newAnalysis)
+	return history, nil
+}
+
+// writeCorrectionError answers a failed correction.
+func writeCorrectionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errInvalidCorrection:
+		apiError(w, r, http.StatusBadRequest, "invalid_correction")
+	case errVersionConflict:
+		apiError(w, r, http.StatusConflict, "version_conflict")
+	default:
+		log.Printf("Error correcting analysis: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+	}
+}
+
+// prescriptionCorrectionsHandler serves the dashboard's
+// POST /prescription/:id/corrections and GET /prescription/:id/revisions.
+func prescriptionCorrectionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/prescription/")
+	prescriptionID, action, _ := strings.Cut(rest, "/")
+	objID, err := primitive.ObjectIDFromHex(prescriptionID)
+	if err != nil {
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
+		return
+	}
+	prescription, err := findUserPrescription(objID, username)
+	if err != nil {
+		writePrescriptionLookupError(w, r, err)
+		return
+	}
+	if prescription.Withheld() {
+		apiError(w, r, http.StatusConflict, "under_review")
+		return
+	}
+
+	switch {
+	case action == "corrections" && r.Method == http.MethodPost:
+		var req CorrectionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		role, err := accountRole(username)
+		if err != nil {
+			writeCorrectionError(w, r, err)
+			return
+		}
+		prescription, err = correctAnalysis(r, prescription, username, role, req)
+		if err != nil {
+			writeCorrectionError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"analysis":           cleanAnalysisJSON(prescription.Analysis),
+			"version":            prescription.Version,
+			"pregnancy_warnings": userPregnancyWarnings(username, prescription.Analysis, r.URL.Query().Get("lang")),
+		})
+	case action == "revisions" && r.Method == http.MethodGet:
+		writeRevisionHistory(w, r, username, prescription)
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeRevisionHistory answers with the versions of the prescription's
+// analysis, comparing ?from= and ?to=.
+func writeRevisionHistory(w http.ResponseWriter, r *http.Request, username string, prescription Prescription) {
+	from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+	to, errTo := strconv.Atoi(r.URL.Query().Get("to"))
+	if r.URL.Query().Get("from") == "" {
+		from, errFrom = 0, nil
+	}
+	if r.URL.Query().Get("to") == "" {
+		to, errTo = 0, nil
+	}
+	if errFrom != nil || errTo != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	history, err := revisionHistory(prescription, from, to)
+	if err == errInvalidCorrection {
+		apiError(w, r, http.StatusNotFound, "version_not_found")
+		return
+	} else if err != nil {
+		log.Printf("Error loading revisions: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	recordAudit(r, username, prescription.PatientID, auditView, prescription.ID.Hex())
+	apiJSON(w, http.StatusOK, history)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// phashMaxDistance is how many of the 64 perceptual hash bits may differ
+	// for two photos to look like the same prescription. A difference hash
+	// mostly sees the page layout, so two prescriptions on the same letterhead
+	// can match too; a similar photo is only ever suggested, never reused.
+	phashMaxDistance = 6
+
+	chatCacheTTL     = 10 * time.Minute
+	chatCacheMaxSize = 1000
+)
+
+// imageHashes returns the SHA-256 of an upload and its perceptual hash, or an
+// empty perceptual hash if the image cannot be decoded.
+func imageHashes(data []byte) (string, string) {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), perceptualHash(data)
+}
+
+// perceptualHash is a difference hash: the image is shrunk to 9x8 grey
+// pixels and each bit records whether a pixel is brighter than its right
+// neighbour. Re-taken photos of the same page land within a few bits.
+func perceptualHash(data []byte) string {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	xdraw.BiLinear.Scale(small, small.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return strconv.FormatUint(hash, 16)
+}
+
+func phashDistance(a, b string) int {
+	x, errA := strconv.ParseUint(a, 16, 64)
+	y, errB := strconv.ParseUint(b, 16, 64)
+	if errA != nil || errB != nil {
+		return 64
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// profileKey fingerprints the profile an analysis was made for, so a changed
+// pregnancy flag or allergy list is analysed afresh. It is keyed like the
+// search index, so the stored value does not give the profile away.
+func profileKey(profile PromptProfile) string {
+	allergies := make([]string, len(profile.Allergies))
+	for i, allergy := range profile.Allergies {
+		allergies[i] = strings.ToLower(allergy)
+	}
+	sort.Strings(allergies)
+	return blindTerm("profile", fmt.Sprintf("%t|%t|%s", profile.Pregnant, profile.Lactating, strings.Join(allergies, "\x00")))
+}
+
+// DuplicateKey is what an earlier analysis must share with an upload to be
+// reused: the language, the prompt version and the profile key.
+type DuplicateKey struct {
+	Language      string
+	PromptVersion string
+	ProfileKey    string
+}
+
+// findDuplicateAnalysis looks for an earlier analysis by username under the
+// same key. The match is "exact" for an identical file, which may be reused,
+// "similar" for a near-identical photo (only with a perceptual hash), which
+// may only be suggested, or empty if there is none.
+func findDuplicateAnalysis(username string, key DuplicateKey, sha, phash string) (Prescription, string, error) {
+	filter := bson.M{
+		"patient_id":     username,
+		"language":       key.Language,
+		"prompt_version": key.PromptVersion,
+		"profile_key":    key.ProfileKey,
+	}
+	var prescription Prescription
+	filter["image_sha256"] = sha
+	err := prescriptionsColl.FindOne(context.Background(), filter,
+		options.FindOne().SetSort(bson.D{{Key: "upload_date", Value: -1}})).Decode(&prescription)
+	if err == nil {
+		return prescription, "exact", nil
+	} else if err != mongo.ErrNoDocuments {
+		return prescription, "", err
+	}
+	if phash == "" {
+		return prescription, "", nil
+	}
+
+	delete(filter, "image_sha256")
+	filter["image_phash"] = bson.M{"$exists": true}
+	cursor, err := prescriptionsColl.Find(context.Background(), filter,
+		options.Find().SetProjection(bson.M{"image_phash": 1}).SetSort(bson.D{{Key: "upload_date", Value: -1}}))
+	if err != nil {
+		return prescription, "", err
+	}
+	var candidates []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		PHash string             `bson:"image_phash"`
+	}
+	if err := cursor.All(context.Background(), &candidates); err != nil {
+		return prescription, "", err
+	}
+
+	best, bestDistance := primitive.NilObjectID, phashMaxDistance+1
+	for _, c := range candidates {
+		if d := phashDistance(phash, c.PHash); d < bestDistance {
+			best, bestDistance = c.ID, d
+		}
+	}
+	if best.IsZero() {
+		return prescription, "", nil
+	}
+	prescription, err = findUserPrescription(best, username)
+	if err != nil {
+		return prescription, "", err
+	}
+	return prescription, "similar", nil
+}
+
+// writeSimilarUploadError answers 409 with the earlier prescription the upload
+// looks like. The client offers to open it or to send the upload again with
+// force=true.
+func writeSimilarUploadError(w http.ResponseWriter, r *http.Request, previous Prescription) {
+	lang := requestLang(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "similar_upload",
+		"message": translate(lang, "dedup.similar", map[string]string{"date": formatLocalDate(lang, previous.UploadDate)}),
+		"similar_to": map[string]interface{}{
+			"id":          previous.ID.Hex(),
+			"upload_date": previous.UploadDate,
+		},
+	})
+}
+
+type chatCacheEntry struct {
+	response string
+	expires  time.Time
+}
+
+var (
+	chatCacheMu sync.Mutex
+	chatCache   = map[string]chatCacheEntry{}
+)
+
+// chatCacheKey ignores case and spacing so trivially retyped questions hit
+// the cache. Keys include the prompt version, so editing a prompt doesn't
+// serve answers to the old one, and the answer language. The chat prompts
+// carry nothing else about the user, so answers are shared between users.
+func chatCacheKey(promptVersion, lang, message string) string {
+	sum := sha256.Sum256([]byte(promptVersion + "\x00" + lang + "\x00" + strings.Join(strings.Fields(strings.ToLower(message)), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+func cachedChatResponse(promptVersion, lang, message string) (string, bool) {
+	chatCacheMu.Lock()
+	defer chatCacheMu.Unlock()
+	entry, ok := chatCache[chatCacheKey(promptVersion, lang, message)]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.response, true
+}
+
+func cacheChatResponse(promptVersion, lang, message, response string) {
+	chatCacheMu.Lock()
+	defer chatCacheMu.Unlock()
+
+	now := time.Now()
+	if len(chatCache) >= chatCacheMaxSize {
+		for key, entry := range chatCache {
+			if now.After(entry.expires) {
+				delete(chatCache, key)
+			}
+		}
+	}
+	if len(chatCache) >= chatCacheMaxSize {
+		return
+	}
+	chatCache[chatCacheKey(promptVersion, lang, message)] = chatCacheEntry{response: response, expires: now.Add(chatCacheTTL)}
+}
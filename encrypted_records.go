@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Prescriptions and chat messages encrypt their sensitive fields when they are
+// marshalled and decrypt them when they are decoded, so handlers only ever
+// see plaintext. Updates that $set these fields must call encryptString.
+// Prescriptions also rebuild their search terms from the plaintext analysis;
+// updates that $set it must set search_terms and search_key too.
+
+type prescriptionDoc Prescription
+
+func (p Prescription) MarshalBSON() ([]byte, error) {
+	doc := prescriptionDoc(p)
+	doc.SearchTerms, doc.SearchKey = searchTerms(doc.Analysis), searchKeyID
+	var err error
+	if doc.Analysis, err = encryptString(doc.Analysis); err != nil {
+		return nil, fmt.Errorf("encrypting analysis: %w", err)
+	}
+	if doc.OriginalAnalysis, err = encryptString(doc.OriginalAnalysis); err != nil {
+		return nil, fmt.Errorf("encrypting original analysis: %w", err)
+	}
+	if doc.Review != nil {
+		review := *doc.Review
+		if review.Comment, err = encryptString(review.Comment); err != nil {
+			return nil, fmt.Errorf("encrypting review comment: %w", err)
+		}
+		doc.Review = &review
+	}
+	return bson.Marshal(doc)
+}
+
+func (p *Prescription) UnmarshalBSON(data []byte) error {
+	var doc prescriptionDoc
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var err error
+	if doc.Analysis, err = decryptString(doc.Analysis); err != nil {
+		return fmt.Errorf("decrypting analysis of %s: %w", doc.ID.Hex(), err)
+	}
+	if doc.OriginalAnalysis, err = decryptString(doc.OriginalAnalysis); err != nil {
+		return fmt.Errorf("decrypting original analysis of %s: %w", doc.ID.Hex(), err)
+	}
+	if doc.Review != nil {
+		if doc.Review.Comment, err = decryptString(doc.Review.Comment); err != nil {
+			return fmt.Errorf("decrypting review comment of %s: %w", doc.ID.Hex(), err)
+		}
+	}
+	*p = Prescription(doc)
+	return nil
+}
+
+type analysisRevisionDoc AnalysisRevision
+
+func (a AnalysisRevision) MarshalBSON() ([]byte, error) {
+	doc := analysisRevisionDoc(a)
+	var err error
+	if doc.Analysis, err = encryptString(doc.Analysis); err != nil {
+		return nil, fmt.Errorf("encrypting revision: %w", err)
+	}
+	if doc.Comment, err = encryptString(doc.Comment); err != nil {
+		return nil, fmt.Errorf("encrypting revision comment: %w", err)
+	}
+	return bson.Marshal(doc)
+}
+
+func (a *AnalysisRevision) UnmarshalBSON(data []byte) error {
+	var doc analysisRevisionDoc
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var err error
+	if doc.Analysis, err = decryptString(doc.Analysis); err != nil {
+		return fmt.Errorf("decrypting revision %s: %w", doc.ID.Hex(), err)
+	}
+	if doc.Comment, err = decryptString(doc.Comment); err != nil {
+		return fmt.Errorf("decrypting revision comment %s: %w", doc.ID.Hex(), err)
+	}
+	*a = AnalysisRevision(doc)
+	return nil
+}
+
+type chatMessageDoc ChatMessage
+
+func (m ChatMessage) MarshalBSON() ([]byte, error) {
+	doc := chatMessageDoc(m)
+	var err error
+	if doc.Message, err = encryptString(doc.Message); err != nil {
+		return nil, fmt.Errorf("encrypting chat message: %w", err)
+	}
+	if doc.Response, err = encryptString(doc.Response); err != nil {
+		return nil, fmt.Errorf("encrypting chat response: %w", err)
+	}
+	return bson.Marshal(doc)
+}
+
+func (m *ChatMessage) UnmarshalBSON(data []byte) error {
+	var doc chatMessageDoc
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var err error
+	if doc.Message, err = decryptString(doc.Message); err != nil {
+		return fmt.Errorf("decrypting chat message %s: %w", doc.ID.Hex(), err)
+	}
+	if doc.Response, err = decryptString(doc.Response); err != nil {
+		return fmt.Errorf("decrypting chat response %s: %w", doc.ID.Hex(), err)
+	}
+	*m = ChatMessage(doc)
+	return nil
+}
+
+// reencryptFields seals every value of fields in coll that is plaintext or
+// sealed with a retired key. Fields may be dotted paths into subdocuments.
+// Each update only applies if the value has not changed since it was read.
+// A document that does not decrypt is logged and left for the next run.
+func reencryptFields(coll *mongo.Collection, fields ...string) (int, error) {
+	var or []bson.M
+	projection := bson.M{}
+	for _, field := range fields {
+		or = append(or, bson.M{field: bson.M{
+			"$type": "string",
+			"$ne":   "",
+			"$not":  primitive.Regex{Pattern: encryptedWithPrimary()},
+		}})
+		projection[field] = 1
+	}
+
+	cursor, err := coll.Find(context.Background(), bson.M{"$or": or}, options.Find().SetProjection(projection))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	count := 0
+docs:
+	for cursor.Next(context.Background()) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return count, err
+		}
+
+		filter := bson.M{"_id": doc["_id"]}
+		set := bson.M{}
+		for _, field := range fields {
+			old, ok := fieldValue(doc, field).(string)
+			if !ok || old == "" {
+				continue
+			}
+			plaintext, err := decryptString(old)
+			if err != nil {
+				log.Printf("Error re-encrypting %s of %s %v: %v", field, coll.Name(), doc["_id"], err)
+				continue docs
+			}
+			sealed, err := encryptString(plaintext)
+			if err != nil {
+				return count, err
+			}
+			filter[field] = old
+			set[field] = sealed
+		}
+
+		result, err := coll.UpdateOne(context.Background(), filter, bson.M{"$set": set})
+		if err != nil {
+			return count, err
+		}
+		count += int(result.ModifiedCount)
+	}
+	return count, cursor.Err()
+}
+
+// fieldValue looks up a dotted path in a decoded document.
+func fieldValue(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		sub, ok := value.(bson.M)
+		if !ok {
+			return nil
+		}
+		value = sub[key]
+	}
+	return value
+}
+
+// reencryptFiles re-uploads the files in bucket that are unencrypted or
+// sealed with a retired key. relink points the records at the new file
+// before the old one is deleted, so an interrupted run never loses a file.
+func reencryptFiles(bucket *gridfs.Bucket, relink func(oldID, newID primitive.ObjectID) error) (int, error) {
+	cursor, err := bucket.Find(bson.M{"metadata.key_id": bson.M{"$ne": encryptionKeys.primary}})
+	if err != nil {
+		return 0, err
+	}
+	var files []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Filename string             `bson:"filename"`
+	}
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, file := range files {
+		data, _, err := loadEncryptedFile(bucket, file.ID)
+		if err != nil {
+			return count, fmt.Errorf("file %s: %w", file.ID.Hex(), err)
+		}
+		meta, err := encryptedFileMetadata(bucket, file.ID)
+		if err != nil {
+			return count, fmt.Errorf("file %s: %w", file.ID.Hex(), err)
+		}
+
+		newID, err := uploadEncryptedFile(bucket, file.Filename, data, meta)
+		if err != nil {
+			return count, fmt.Errorf("file %s: %w", file.ID.Hex(), err)
+		}
+		if err := relink(file.ID, newID); err != nil {
+			return count, fmt.Errorf("file %s: %w", file.ID.Hex(), err)
+		}
+		if err := bucket.Delete(file.ID); err != nil {
+			log.Printf("Error deleting re-encrypted file %s: %v", file.ID.Hex(), err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func reencryptImages() (int, error) {
+	return reencryptFiles(imagesBucket, func(oldID, newID primitive.ObjectID) error {
+		_, err := prescriptionsColl.UpdateMany(context.Background(),
+			bson.M{"image_id": oldID}, bson.M{"$set": bson.M{"image_id": newID}})
+		return err
+	})
+}
+
+func reencryptAudio() (int, error) {
+	return reencryptFiles(audioBucket, func(oldID, newID primitive.ObjectID) error {
+		_, err := chatMessagesColl.UpdateMany(context.Background(),
+			bson.M{"audio_id": oldID}, bson.M{"$set": bson.M{"audio_id": newID}})
+		return err
+	})
+}
+
+func reencryptAll() {
+	for _, job := range []struct {
+		name string
+		run  func() (int, error)
+	}{
+		{"prescriptions", func() (int, error) {
+			return reencryptFields(prescriptionsColl, "analysis", "original_analysis", "review.comment")
+		}},
+		{"analysis revisions", func() (int, error) { return reencryptFields(analysisRevisionsColl, "analysis", "comment") }},
+		{"chat messages", func() (int, error) { return reencryptFields(chatMessagesColl, "message", "response") }},
+		{"images", reencryptImages},
+		{"voice recordings", reencryptAudio},
+	} {
+		count, err := job.run()
+		if err != nil {
+			log.Printf("Error re-encrypting %s: %v", job.name, err)
+		}
+		if count > 0 {
+			log.Printf("Re-encrypted %d %s with key %q", count, job.name, encryptionKeys.primary)
+		}
+	}
+}
+
+// runReencryptionWorker moves plaintext and retired-key data onto the primary
+// key, at startup and then every six hours.
+func runReencryptionWorker() {
+	for {
+		reencryptAll()
+		time.Sleep(6 * time.Hour)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Sensitive fields and uploads are sealed with envelope encryption: every
+// value gets a fresh data key (AES-256-GCM), and the data key is wrapped with
+// a key-encryption key from the keyring. The key id and the wrapped data key
+// are stored next to the ciphertext; after a rotation, values sealed with
+// older keys stay readable until the background job re-seals them.
+//
+// Keys come from ENCRYPTION_KEYS ("id:base64key,id2:base64key", 32-byte keys,
+// the first or ENCRYPTION_PRIMARY_KEY is used for new data). Without it a
+// development keyring is read from (or created at) ENCRYPTION_KEY_FILE.
+
+const (
+	encryptedPrefix   = "enc:v1:"
+	envelopeMagic     = "CENC1"
+	defaultKeyFile    = ".cura_keys.json"
+	encryptionKeySize = 32
+)
+
+type keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+type keyFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+var encryptionKeys keyring
+
+func loadEncryptionKeys() {
+	ring, err := keyringFromEnv(os.Getenv("ENCRYPTION_KEYS"), os.Getenv("ENCRYPTION_PRIMARY_KEY"))
+	if err == nil && ring.primary == "" {
+		path := os.Getenv("ENCRYPTION_KEY_FILE")
+		if path == "" {
+			path = defaultKeyFile
+		}
+		ring, err = keyringFromFile(path)
+	}
+	if err != nil {
+		log.Fatalf("Error loading encryption keys: %v", err)
+	}
+	encryptionKeys = ring
+	log.Printf("Encryption keyring loaded (%d keys, primary %q)", len(ring.keys), ring.primary)
+}
+
+func decodeKey(id, encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", id, err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("key %q must be %d bytes, got %d", id, encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+func keyringFromEnv(spec, primary string) (keyring, error) {
+	ring := keyring{keys: map[string][]byte{}}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || strings.Contains(id, ":") {
+			return ring, fmt.Errorf("ENCRYPTION_KEYS entries must look like id:base64key")
+		}
+		key, err := decodeKey(id, encoded)
+		if err != nil {
+			return ring, err
+		}
+		ring.keys[id] = key
+		if ring.primary == "" {
+			ring.primary = id
+		}
+	}
+	if primary != "" && len(ring.keys) > 0 {
+		if _, ok := ring.keys[primary]; !ok {
+			return ring, fmt.Errorf("ENCRYPTION_PRIMARY_KEY %q is not in ENCRYPTION_KEYS", primary)
+		}
+		ring.primary = primary
+	}
+	return ring, nil
+}
+
+// keyringFromFile reads the development keyring, creating it on first run.
+func keyringFromFile(path string) (keyring, error) {
+	ring := keyring{keys: map[string][]byte{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("Warning: ENCRYPTION_KEYS not set, creating development keyring %s; do not use it in production", path)
+		key := make([]byte, encryptionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return ring, err
+		}
+		file := keyFile{Primary: "dev1", Keys: map[string]string{"dev1": base64.StdEncoding.EncodeToString(key)}}
+		if data, err = json.MarshalIndent(file, "", "  "); err != nil {
+			return ring, err
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return ring, err
+		}
+	} else if err != nil {
+		return ring, err
+	}
+
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return ring, fmt.Errorf("%s: %w", path, err)
+	}
+	for id, encoded := range file.Keys {
+		key, err := decodeKey(id, encoded)
+		if err != nil {
+			return ring, fmt.Errorf("%s: %w", path, err)
+		}
+		ring.keys[id] = key
+	}
+	if _, ok := ring.keys[file.Primary]; !ok {
+		return ring, fmt.Errorf("%s: primary key %q not found", path, file.Primary)
+	}
+	ring.primary = file.Primary
+	return ring, nil
+}
+
+func gcmSeal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// sealEnvelope encrypts plaintext under a new data key wrapped with the
+// primary key. Layout: magic, key id, wrapped data key, ciphertext, with
+// 2-byte length prefixes on the id and wrapped key.
+func sealEnvelope(plaintext []byte) ([]byte, error) {
+	kek, ok := encryptionKeys.keys[encryptionKeys.primary]
+	if !ok {
+		return nil, errors.New("encryption keys not loaded")
+	}
+
+	dek := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wrapped, err := gcmSeal(kek, dek)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := gcmSeal(dek, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(envelopeMagic)
+	for _, part := range [][]byte{[]byte(encryptionKeys.primary), wrapped} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(part)))
+		buf.Write(part)
+	}
+	buf.Write(ciphertext)
+	return buf.Bytes(), nil
+}
+
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+func readEnvelopePart(r *bytes.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, errors.New("truncated envelope")
+	}
+	part := make([]byte, n)
+	if _, err := io.ReadFull(r, part); err != nil {
+		return nil, errors.New("truncated envelope")
+	}
+	return part, nil
+}
+
+func openEnvelope(envelope []byte) ([]byte, error) {
+	if !isEnvelope(envelope) {
+		return nil, errors.New("not an encrypted envelope")
+	}
+	r := bytes.NewReader(envelope[len(envelopeMagic):])
+	id, err := readEnvelopePart(r)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := readEnvelopePart(r)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := encryptionKeys.keys[string(id)]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	dek, err := gcmOpen(kek, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	ciphertext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dek, ciphertext)
+}
+
+// encryptString seals a field value as "enc:v1:<key id>:<base64 envelope>".
+// The key id is kept readable so rotation can query for old values. Text that
+// only looks sealed is sealed like any other: users can type the prefix.
+func encryptString(plaintext string) (string, error) {
+	if plaintext == "" {
+		return plaintext, nil
+	}
+	envelope, err := sealEnvelope([]byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + encryptionKeys.primary + ":" + base64.StdEncoding.EncodeToString(envelope), nil
+}
+
+// decryptString reverses encryptString. Values written before encryption was
+// enabled are returned unchanged, including text that merely starts with the
+// prefix; only an envelope that does not open is an error.
+func decryptString(value string) (string, error) {
+	envelope, ok := sealedEnvelope(value)
+	if !ok {
+		return value, nil
+	}
+	plaintext, err := openEnvelope(envelope)
+	return string(plaintext), err
+}
+
+// sealedEnvelope returns the envelope of a value written by encryptString.
+func sealedEnvelope(value string) ([]byte, bool) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return nil, false
+	}
+	_, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, false
+	}
+	envelope, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || !isEnvelope(envelope) {
+		return nil, false
+	}
+	return envelope, true
+}
+
+// encryptedWithPrimary matches field values that are already sealed with the
+// primary key; everything else is due for (re-)encryption. The start of the
+// encoded envelope is part of the match, so plaintext stored with the prefix
+// before every value was sealed is picked up too.
+func encryptedWithPrimary() string {
+	magic := base64.StdEncoding.EncodeToString([]byte(envelopeMagic))[:len(envelopeMagic)*4/3]
+	return "^" + regexp.QuoteMeta(encryptedPrefix+encryptionKeys.primary+":"+magic)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Before analysis, photos are cropped to the paper, straightened, and their
+// contrast is stretched; EXIF orientation was already applied by
+// sanitizeUpload. The quality score (0-100) is measured on the cropped photo
+// before enhancement, and photos below minImageQuality are sent back with a
+// request to retake them.
+const (
+	minImageQuality = 35
+	maxSkewDegrees  = 10.0
+	analysisSide    = 1000 // working resolution for skew and sharpness
+)
+
+type ImageQuality struct {
+	Score       int      `json:"score" bson:"score"`
+	Issues      []string `json:"issues,omitempty" bson:"issues,omitempty"`
+	SkewDegrees float64  `json:"skew_degrees" bson:"skew_degrees"`
+	Cropped     bool     `json:"cropped" bson:"cropped"`
+}
+
+// enhancePrescriptionPhoto prepares a sanitized image for the model and
+// scores it. The enhanced copy is JPEG; the stored upload is left as it was.
+func enhancePrescriptionPhoto(data []byte, grayscale bool) ([]byte, ImageQuality, error) {
+	var quality ImageQuality
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, quality, err
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+	gray := luminance(rgba)
+
+	if paper := paperBounds(gray); paper != gray.Bounds() {
+		rgba = rgba.SubImage(paper).(*image.RGBA)
+		gray = gray.SubImage(paper).(*image.Gray)
+		quality.Cropped = true
+	}
+
+	small := shrinkGray(gray, analysisSide)
+	hist := histogram(gray)
+	lo, hi := percentile(hist, 0.01), percentile(hist, 0.99)
+	quality.Score, quality.Issues = scoreQuality(small, hist, lo, hi, min(gray.Bounds().Dx(), gray.Bounds().Dy()))
+
+	quality.SkewDegrees = math.Round(detectSkew(small)*10) / 10
+	var out image.Image = rgba
+	if math.Abs(quality.SkewDegrees) >= 0.5 {
+		rgba = rotateRGBA(rgba, quality.SkewDegrees*math.Pi/180)
+		out = rgba
+	}
+
+	stretchContrast(rgba, lo, hi)
+	if grayscale {
+		out = luminance(rgba)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, quality, err
+	}
+	return buf.Bytes(), quality, nil
+}
+
+func luminance(img *image.RGBA) *image.Gray {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < b.Dx(); x++ {
+			p := row[x*4 : x*4+3]
+			gray.Pix[y*gray.Stride+x] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+		}
+	}
+	return gray
+}
+
+func shrinkGray(gray *image.Gray, side int) *image.Gray {
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+	if w <= side && h <= side {
+		return gray
+	}
+	if w >= h {
+		w, h = side, h*side/w
+	} else {
+		w, h = w*side/h, side
+	}
+	dst := image.NewGray(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), gray, gray.Bounds(), xdraw.Src, nil)
+	return dst
+}
+
+func histogram(gray *image.Gray) [256]int {
+	var hist [256]int
+	b := gray.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for _, v := range gray.Pix[gray.PixOffset(b.Min.X, y):gray.PixOffset(b.Max.X, y)] {
+			hist[v]++
+		}
+	}
+	return hist
+}
+
+// percentile returns the grey level below which fraction p of pixels lie.
+func percentile(hist [256]int, p float64) int {
+	total := 0
+	for _, n := range hist {
+		total += n
+	}
+	target, seen := int(p*float64(total)), 0
+	for v, n := range hist {
+		seen += n
+		if seen > target {
+			return v
+		}
+	}
+	return 255
+}
+
+// otsuThreshold splits the histogram into dark (ink, background) and light
+// (paper) so the variance between the two classes is largest.
+func otsuThreshold(hist [256]int) int {
+	total, sum := 0, 0
+	for v, n := range hist {
+		total += n
+		sum += v * n
+	}
+	best, threshold := -1.0, 128
+	weightDark, sumDark := 0, 0
+	for t := 0; t < 256; t++ {
+		weightDark += hist[t]
+		if weightDark == 0 {
+			continue
+		}
+		weightLight := total - weightDark
+		if weightLight == 0 {
+			break
+		}
+		sumDark += t * hist[t]
+		meanDark := float64(sumDark) / float64(weightDark)
+		meanLight := float64(sum-sumDark) / float64(weightLight)
+		between := float64(weightDark) * float64(weightLight) * (meanDark - meanLight) * (meanDark - meanLight)
+		if between > best {
+			best, threshold = between, t
+		}
+	}
+	return threshold
+}
+
+// paperBounds finds the bright sheet of paper in a photo: the rows and then
+// columns that are mostly lighter than the Otsu threshold. The whole image is
+// returned when the paper already fills it or no clear sheet is found.
+func paperBounds(gray *image.Gray) image.Rectangle {
+	b := gray.Bounds()
+	w, h := b.Dx(), b.Dy()
+	t := uint8(otsuThreshold(histogram(gray)))
+
+	mostlyLight := func(count, of int) bool { return count*2 > of }
+
+	y0, y1 := -1, -1
+	for y := 0; y < h; y++ {
+		light := 0
+		for _, v := range gray.Pix[gray.PixOffset(b.Min.X, b.Min.Y+y):gray.PixOffset(b.Max.X, b.Min.Y+y)] {
+			if v > t {
+				light++
+			}
+		}
+		if mostlyLight(light, w) {
+			if y0 < 0 {
+				y0 = y
+			}
+			y1 = y
+		}
+	}
+	if y0 < 0 {
+		return b
+	}
+
+	x0, x1 := -1, -1
+	for x := 0; x < w; x++ {
+		light := 0
+		for y := y0; y <= y1; y++ {
+			if gray.Pix[gray.PixOffset(b.Min.X+x, b.Min.Y+y)] > t {
+				light++
+			}
+		}
+		if mostlyLight(light, y1-y0+1) {
+			if x0 < 0 {
+				x0 = x
+			}
+			x1 = x
+		}
+	}
+	if x0 < 0 {
+		return b
+	}
+
+	paper := image.Rect(x0, y0, x1+1, y1+1)
+	area, full := paper.Dx()*paper.Dy(), w*h
+	if area < full*3/10 || area > full*9/10 {
+		return b
+	}
+	margin := max(w, h) / 100
+	return image.Rect(x0-margin, y0-margin, x1+1+margin, y1+1+margin).Add(b.Min).Intersect(b)
+}
+
+// detectSkew returns the angle in degrees that makes lines of text
+// horizontal: the rotation whose row profile of ink pixels is most peaked.
+func detectSkew(gray *image.Gray) float64 {
+	b := gray.Bounds()
+	t := uint8(otsuThreshold(histogram(gray)))
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+
+	var xs, ys []float64
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if gray.Pix[gray.PixOffset(b.Min.X+x, b.Min.Y+y)] <= t {
+				xs = append(xs, float64(x)-cx)
+				ys = append(ys, float64(y)-cy)
+			}
+		}
+	}
+	if len(xs) == 0 {
+		return 0
+	}
+
+	diag := int(math.Hypot(cx, cy)) + 1
+	rows := make([]int, 2*diag+1)
+	best, bestScore := 0.0, -1.0
+	for deg := -maxSkewDegrees; deg <= maxSkewDegrees+1e-9; deg += 0.25 {
+		sin, cos := math.Sincos(deg * math.Pi / 180)
+		for i := range rows {
+			rows[i] = 0
+		}
+		for i := range xs {
+			rows[int(math.Floor(xs[i]*sin+ys[i]*cos))+diag]++
+		}
+		score := 0.0
+		for _, n := range rows {
+			score += float64(n) * float64(n)
+		}
+		// Prefer no rotation unless another angle is clearly better
+		if deg == 0 {
+			score *= 1.001
+		}
+		if score > bestScore {
+			best, bestScore = deg, score
+		}
+	}
+	return best
+}
+
+// rotateRGBA rotates img by angle radians about its centre, keeping its size
+// and filling the uncovered corners with white.
+func rotateRGBA(img *image.RGBA, angle float64) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sin, cos := math.Sincos(angle)
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			sx, sy := dx*cos+dy*sin+cx, -dx*sin+dy*cos+cy
+			dst.SetRGBA(x, y, bilinearAt(img, sx, sy))
+		}
+	}
+	return dst
+}
+
+func bilinearAt(img *image.RGBA, x, y float64) color.RGBA {
+	b := img.Bounds()
+	if x < 0 || y < 0 || x > float64(b.Dx()-1) || y > float64(b.Dy()-1) {
+		return color.RGBA{255, 255, 255, 255}
+	}
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, b.Dx()-1), min(y0+1, b.Dy()-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var out [4]uint8
+	for c := 0; c < 4; c++ {
+		at := func(px, py int) float64 { return float64(img.Pix[img.PixOffset(b.Min.X+px, b.Min.Y+py)+c]) }
+		top := at(x0, y0)*(1-fx) + at(x1, y0)*fx
+		bottom := at(x0, y1)*(1-fx) + at(x1, y1)*fx
+		out[c] = uint8(top*(1-fy) + bottom*fy + 0.5)
+	}
+	return color.RGBA{out[0], out[1], out[2], out[3]}
+}
+
+// stretchContrast maps grey level lo to black and hi to white on every
+// channel, in place.
+func stretchContrast(img *image.RGBA, lo, hi int) {
+	if hi-lo < 16 {
+		return
+	}
+	var table [256]uint8
+	for v := range table {
+		table[v] = uint8(min(max((v-lo)*255/(hi-lo), 0), 255))
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2] = table[row[i]], table[row[i+1]], table[row[i+2]]
+		}
+	}
+}
+
+// scoreQuality rates sharpness (variance of the Laplacian), contrast,
+// exposure and resolution, each from 0 to 1, and names the weak ones.
+func scoreQuality(small *image.Gray, hist [256]int, lo, hi, shortSide int) (int, []string) {
+	clamp := func(v float64) float64 { return math.Min(math.Max(v, 0), 1) }
+
+	b := small.Bounds()
+	var sum, sumSq float64
+	n := 0
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		for x := b.Min.X + 1; x < b.Max.X-1; x++ {
+			lap := 4*float64(small.GrayAt(x, y).Y) -
+				float64(small.GrayAt(x-1, y).Y) - float64(small.GrayAt(x+1, y).Y) -
+				float64(small.GrayAt(x, y-1).Y) - float64(small.GrayAt(x, y+1).Y)
+			sum += lap
+			sumSq += lap * lap
+			n++
+		}
+	}
+	variance := 0.0
+	if n > 0 {
+		mean := sum / float64(n)
+		variance = sumSq/float64(n) - mean*mean
+	}
+
+	total, weighted := 0, 0
+	for v, count := range hist {
+		total += count
+		weighted += v * count
+	}
+	brightness := float64(weighted) / float64(max(total, 1))
+
+	sharpness := clamp((variance - 30) / 270)
+	contrast := clamp(float64(hi-lo-30) / 120)
+	exposure := 1.0
+	if brightness < 90 {
+		exposure = clamp((brightness - 30) / 60)
+	} else if brightness > 235 {
+		exposure = clamp((255 - brightness) / 20)
+	}
+	resolution := clamp(float64(shortSide) / 1000)
+
+	var issues []string
+	if sharpness < 0.3 {
+		issues = append(issues, "blurry")
+	}
+	if contrast < 0.3 {
+		issues = append(issues, "low_contrast")
+	}
+	if exposure < 0.5 {
+		if brightness < 90 {
+			issues = append(issues, "too_dark")
+		} else {
+			issues = append(issues, "overexposed")
+		}
+	}
+	if resolution < 0.5 {
+		issues = append(issues, "low_resolution")
+	}
+
+	// Text that is blurred or lost in the dark cannot be recovered, so those
+	// two also scale the whole score
+	score := 100 * (0.45*sharpness + 0.25*contrast + 0.15*exposure + 0.15*resolution)
+	score *= 0.5 + 0.5*math.Min(sharpness, exposure)
+	return int(math.Round(score)), issues
+}
+
+// writeRetakeError answers 422 with the retakeMessage in the user's language.
+func writeRetakeError(w http.ResponseWriter, r *http.Request, quality ImageQuality) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":         "low_quality",
+		"message":       retakeMessage(requestLang(r), quality),
+		"image_quality": quality,
+	})
+}
+
+// retakeMessage asks for a better photo, with a tip for each problem found.
+func retakeMessage(lang string, quality ImageQuality) string {
+	var tips []string
+	for _, issue := range quality.Issues {
+		tips = append(tips, translate(lang, "quality."+issue))
+	}
+	return translate(lang, "quality.retake", map[string]string{
+		"score": strconv.Itoa(quality.Score),
+		"tips":  strings.Join(tips, " "),
+	})
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A small subset of FHIR R4 (https://hl7.org/fhir/R4/) covering the resources
+// we exchange with hospital systems. Only the elements we fill are modelled.
+
+const (
+	fhirContentType = "application/fhir+json"
+
+	// Identifier systems for our own ids, so re-imports can be matched up
+	fhirPatientSystem      = "urn:cura:patient"
+	fhirPrescriptionSystem = "urn:cura:prescription"
+	fhirMedicationSystem   = "urn:cura:prescription-medicine"
+)
+
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id,omitempty"`
+	Meta         *FHIRMeta         `json:"meta,omitempty"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry,omitempty"`
+}
+
+type FHIRMeta struct {
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+type FHIRBundleEntry struct {
+	FullURL  string          `json:"fullUrl,omitempty"`
+	Resource json.RawMessage `json:"resource"`
+}
+
+type FHIRResource struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id,omitempty"`
+}
+
+type FHIRIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+type FHIRCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+// String is the concept's text, falling back to the first coding.
+func (c FHIRCodeableConcept) String() string {
+	if c.Text != "" {
+		return c.Text
+	}
+	for _, coding := range c.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+		if coding.Code != "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+type FHIRReference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type FHIRAnnotation struct {
+	Text string `json:"text"`
+}
+
+type FHIRDosage struct {
+	Text               string `json:"text,omitempty"`
+	PatientInstruction string `json:"patientInstruction,omitempty"`
+}
+
+type FHIRAttachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	Data        string `json:"data,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Creation    string `json:"creation,omitempty"`
+}
+
+type FHIRPatient struct {
+	FHIRResource
+	Identifier []FHIRIdentifier `json:"identifier"`
+	Active     bool             `json:"active"`
+}
+
+type FHIRMedicationRequest struct {
+	FHIRResource
+	Identifier                []FHIRIdentifier      `json:"identifier,omitempty"`
+	GroupIdentifier           *FHIRIdentifier       `json:"groupIdentifier,omitempty"`
+	Status                    string                `json:"status"`
+	Intent                    string                `json:"intent"`
+	MedicationCodeableConcept FHIRCodeableConcept   `json:"medicationCodeableConcept"`
+	MedicationReference       *FHIRReference        `json:"medicationReference,omitempty"`
+	Subject                   FHIRReference         `json:"subject"`
+	AuthoredOn                string                `json:"authoredOn,omitempty"`
+	Requester                 *FHIRReference        `json:"requester,omitempty"`
+	ReasonCode                []FHIRCodeableConcept `json:"reasonCode,omitempty"`
+	SupportingInformation     []FHIRReference       `json:"supportingInformation,omitempty"`
+	Note                      []FHIRAnnotation      `json:"note,omitempty"`
+	DosageInstruction         []FHIRDosage          `json:"dosageInstruction,omitempty"`
+}
+
+type FHIRAllergyIntolerance struct {
+	FHIRResource
+	ClinicalStatus     FHIRCodeableConcept `json:"clinicalStatus"`
+	VerificationStatus FHIRCodeableConcept `json:"verificationStatus"`
+	Code               FHIRCodeableConcept `json:"code"`
+	Patient            FHIRReference       `json:"patient"`
+}
+
+type FHIRDocumentReference struct {
+	FHIRResource
+	Identifier []FHIRIdentifier      `json:"identifier,omitempty"`
+	Status     string                `json:"status"`
+	Type       FHIRCodeableConcept   `json:"type"`
+	Subject    FHIRReference         `json:"subject"`
+	Date       string                `json:"date,omitempty"`
+	Content    []FHIRDocumentContent `json:"content"`
+}
+
+type FHIRDocumentContent struct {
+	Attachment FHIRAttachment `json:"attachment"`
+}
+
+func fhirInstant(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// fhirEntry serialises a resource into a bundle entry with an absolute fullUrl,
+// so relative references like "Patient/<id>" resolve inside the bundle.
+func fhirEntry(base string, resource interface{}, header FHIRResource) FHIRBundleEntry {
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		// Only our own structs are marshalled here
+		log.Printf("Error encoding FHIR %s: %v", header.ResourceType, err)
+	}
+	return FHIRBundleEntry{
+		FullURL:  base + "/fhir/" + header.ResourceType + "/" + header.ID,
+		Resource: raw,
+	}
+}
+
+// buildFHIRBundle renders everything we hold about user as a FHIR R4
+// collection Bundle. With includeImages the original uploads are embedded as
+// base64; otherwise DocumentReferences link to them.
+func buildFHIRBundle(base string, user User, prescriptions []Prescription, includeImages bool) FHIRBundle {
+	now := fhirInstant(time.Now())
+	bundle := FHIRBundle{
+		ResourceType: "Bundle",
+		ID:           primitive.NewObjectID().Hex(),
+		Meta:         &FHIRMeta{LastUpdated: now},
+		Type:         "collection",
+		Timestamp:    now,
+	}
+
+	patient := FHIRPatient{
+		FHIRResource: FHIRResource{ResourceType: "Patient", ID: user.ID.Hex()},
+		Identifier:   []FHIRIdentifier{{System: fhirPatientSystem, Value: user.Username}},
+		Active:       true,
+	}
+	bundle.Entry = append(bundle.Entry, fhirEntry(base, patient, patient.FHIRResource))
+	subject := FHIRReference{Reference: "Patient/" + patient.ID}
+
+	for i, allergy := range cleanAllergies(user.Allergies) {
+		resource := FHIRAllergyIntolerance{
+			FHIRResource: FHIRResource{ResourceType: "AllergyIntolerance", ID: fmt.Sprintf("%s-allergy-%d", user.ID.Hex(), i+1)},
+			ClinicalStatus: FHIRCodeableConcept{Coding: []FHIRCoding{{
+				System: "http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical",
+				Code:   "active",
+			}}},
+			// Patient reported through the health profile, not clinically confirmed
+			VerificationStatus: FHIRCodeableConcept{Coding: []FHIRCoding{{
+				System: "http://terminology.hl7.org/CodeSystem/allergyintolerance-verification",
+				Code:   "unconfirmed",
+			}}},
+			Code:    FHIRCodeableConcept{Text: allergy},
+			Patient: subject,
+		}
+		bundle.Entry = append(bundle.Entry, fhirEntry(base, resource, resource.FHIRResource))
+	}
+
+	var imageIDs []primitive.ObjectID
+	for _, prescription := range prescriptions {
+		if !prescription.ImageID.IsZero() {
+			imageIDs = append(imageIDs, prescription.ImageID)
+		}
+	}
+	images := prescriptionImageFiles(imageIDs)
+
+	for _, prescription := range prescriptions {
+		id := prescription.ID.Hex()
+		authored := fhirInstant(prescription.UploadDate)
+
+		var supporting []FHIRReference
+		if info, ok := images[prescription.ImageID]; ok {
+			attachment := FHIRAttachment{
+				ContentType: info.ContentType,
+				URL:         base + "/prescription/" + id + "/image",
+				Size:        info.Size,
+				Title:       info.Name,
+				Creation:    authored,
+			}
+			if includeImages {
+				if data, contentType, err := loadPrescriptionImage(prescription.ImageID); err == nil {
+					attachment.ContentType = contentType
+					attachment.Data = base64.StdEncoding.EncodeToString(data)
+				} else {
+					log.Printf("Error loading prescription image for FHIR export: %v", err)
+				}
+			}
+
+			document := FHIRDocumentReference{
+				FHIRResource: FHIRResource{ResourceType: "DocumentReference", ID: id},
+				Identifier:   []FHIRIdentifier{{System: fhirPrescriptionSystem, Value: id}},
+				Status:       "current",
+				Type: FHIRCodeableConcept{
+					Coding: []FHIRCoding{{System: "http://loinc.org", Code: "57833-6", Display: "Prescription for medication"}},
+					Text:   "Prescription",
+				},
+				Subject: subject,
+				Date:    authored,
+				Content: []FHIRDocumentContent{{Attachment: attachment}},
+			}
+			bundle.Entry = append(bundle.Entry, fhirEntry(base, document, document.FHIRResource))
+			supporting = []FHIRReference{{Reference: "DocumentReference/" + id}}
+		}
+
+		var analysis map[string]interface{}
+		if err := json.Unmarshal([]byte(cleanAnalysisJSON(prescription.Analysis)), &analysis); err != nil {
+			log.Printf("Skipping unparseable analysis %s in FHIR export: %v", id, err)
+			continue
+		}
+
+		var requester *FHIRReference
+		if prescriber, ok := analysis["prescriber"].(string); ok && prescriber != "" {
+			requester = &FHIRReference{Display: prescriber}
+		}
+
+		medicines, _ := analysis["medicines"].([]interface{})
+		for i, med := range medicines {
+			medicine, ok := med.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := medicine["name"].(string)
+			if name == "" {
+				continue
+			}
+
+			medicineID := fmt.Sprintf("%s-%d", id, i+1)
+			request := FHIRMedicationRequest{
+				FHIRResource:              FHIRResource{ResourceType: "MedicationRequest", ID: medicineID},
+				Identifier:                []FHIRIdentifier{{System: fhirMedicationSystem, Value: medicineID}},
+				GroupIdentifier:           &FHIRIdentifier{System: fhirPrescriptionSystem, Value: id},
+				Status:                    "unknown", // read from a photo; we do not know if it is still active
+				Intent:                    "order",
+				MedicationCodeableConcept: FHIRCodeableConcept{Text: name},
+				Subject:                   subject,
+				AuthoredOn:                authored,
+				Requester:                 requester,
+				SupportingInformation:     supporting,
+			}
+			if dosage := fhirDosageText(medicine); dosage != "" {
+				request.DosageInstruction = []FHIRDosage{{Text: dosage}}
+			}
+			if purpose, ok := medicine["purpose"].(string); ok && purpose != "" {
+				request.ReasonCode = []FHIRCodeableConcept{{Text: purpose}}
+			}
+			if warnings, ok := medicine["warnings"].(string); ok && warnings != "" {
+				request.Note = []FHIRAnnotation{{Text: warnings}}
+			}
+			bundle.Entry = append(bundle.Entry, fhirEntry(base, request, request.FHIRResource))
+		}
+	}
+
+	return bundle
+}
+
+// fhirDosageText joins the dosage and usage instructions the way a pharmacist
+// would write them on a label.
+func fhirDosageText(medicine map[string]interface{}) string {
+	var parts []string
+	for _, field := range []string{"dosage", "instructions"} {
+		if text, ok := medicine[field].(string); ok && strings.TrimSpace(text) != "" {
+			parts = append(parts, strings.TrimSpace(text))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// fhirExportHandler returns the logged-in user's records as a FHIR R4 Bundle:
+// GET /fhir/export[?images=true][&download=true]
+func fhirExportHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		log.Printf("Error fetching user for FHIR export: %v", err)
+		httpError(w, r, "fetch_user_failed", http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "upload_date", Value: 1}})
+	// Held and rejected readings are not passed on to other systems
+	cursor, err := prescriptionsColl.Find(context.Background(), bson.M{
+		"patient_id":    username,
+		"review.status": bson.M{"$nin": bson.A{reviewPending, reviewRejected}},
+	}, opts)
+	if err != nil {
+		log.Printf("Error fetching prescriptions for FHIR export: %v", err)
+		httpError(w, r, "fetch_prescriptions_failed", http.StatusInternalServerError)
+		return
+	}
+	var prescriptions []Prescription
+	if err := cursor.All(context.Background(), &prescriptions); err != nil {
+		log.Printf("Error decoding prescriptions for FHIR export: %v", err)
+		httpError(w, r, "fetch_prescriptions_failed", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, username, username, auditExport, "fhir")
+
+	q := r.URL.Query()
+	bundle := buildFHIRBundle(publicBaseURL(), user, prescriptions, q.Get("images") == "true")
+
+	w.Header().Set("Content-Type", fhirContentType)
+	if q.Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"cura-fhir-%s.json\"", time.Now().Format("2006-01-02")))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(bundle)
+}
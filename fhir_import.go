@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxFHIRImportSize = 10 << 20
+
+// importedMedicine mirrors one entry of "medicines" in the analysis JSON, so
+// imported records display and print like analysed ones.
+type importedMedicine struct {
+	Name                string        `json:"name"`
+	Dosage              string        `json:"dosage"`
+	Purpose             string        `json:"purpose"`
+	Instructions        string        `json:"instructions"`
+	Warnings            string        `json:"warnings"`
+	DosageAppropriate   string        `json:"dosage_appropriate"`
+	GenericAlternatives []interface{} `json:"generic_alternatives"`
+}
+
+type importedAnalysis struct {
+	PatientName            string              `json:"patient_name"`
+	Date                   string              `json:"date"`
+	Prescriber             string              `json:"prescriber"`
+	Medicines              []importedMedicine  `json:"medicines"`
+	DietaryRecommendations map[string][]string `json:"dietary_recommendations"`
+	Manufacturer           string              `json:"manufacturer"`
+	LotNumber              string              `json:"lot_number"`
+	ExpirationDate         string              `json:"expiration_date"`
+}
+
+type FHIRImportSkip struct {
+	Resource string `json:"resource"`
+	Reason   string `json:"reason"`
+}
+
+type FHIRImportResult struct {
+	PrescriptionID string   `json:"prescription_id"`
+	Medicines      int      `json:"medicines"`
+	Resources      []string `json:"resources"`
+}
+
+// fhirImportGroup collects the MedicationRequests that make up one
+// prescription.
+type fhirImportGroup struct {
+	key        string
+	authoredOn time.Time
+	prescriber string
+	medicines  []importedMedicine
+	resources  []string
+	importKeys []string
+}
+
+func fhirResourceLabel(header FHIRResource, index int) string {
+	if header.ResourceType == "" {
+		return fmt.Sprintf("entry[%d]", index)
+	}
+	if header.ID == "" {
+		return fmt.Sprintf("%s (entry[%d])", header.ResourceType, index)
+	}
+	return header.ResourceType + "/" + header.ID
+}
+
+// parseFHIRDate accepts the FHIR date and dateTime forms.
+func parseFHIRDate(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// medicationRequestKeys identify a MedicationRequest across imports: its
+// business identifiers, plus what was prescribed and when for resources
+// without any.
+func medicationRequestKeys(req FHIRMedicationRequest, name, dosage string) []string {
+	var keys []string
+	for _, id := range req.Identifier {
+		if id.Value != "" {
+			keys = append(keys, "id:"+id.System+"|"+id.Value)
+		}
+	}
+	day := req.AuthoredOn
+	if t, ok := parseFHIRDate(req.AuthoredOn); ok {
+		day = t.UTC().Format("2006-01-02")
+	}
+	keys = append(keys, prescribedImportKey(day, name, dosage))
+
+	for i, key := range keys {
+		keys[i] = importKey(key)
+	}
+	return keys
+}
+
+func prescribedImportKey(day, name, dosage string) string {
+	return "med:" + day + "|" + strings.ToLower(name) + "|" + strings.ToLower(dosage)
+}
+
+// importKey is the stored form of one import key. It sits next to the
+// encrypted analysis, so it is keyed like the search terms; the plain digest
+// inside it is what earlier imports stored, which lets rekeyImportKeys
+// convert those without knowing the identifiers.
+func importKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return blindTerm("import", hex.EncodeToString(sum[:]))
+}
+
+// legacyImportKeys matches the plain SHA-256 digests stored before import
+// keys were keyed.
+const legacyImportKeys = "^[0-9a-f]{64}$"
+
+// rekeyImportKeys returns the import keys of p under the current search index
+// key. Plain digests convert directly. Keys made with a retired index key
+// cannot, so the what-and-when keys are rebuilt from the analysis instead and
+// only matching on business identifiers is lost.
+func rekeyImportKeys(p Prescription) []string {
+	legacy := regexp.MustCompile(legacyImportKeys)
+	var keys []string
+	stale := false
+	for _, key := range p.ImportKeys {
+		if legacy.MatchString(key) {
+			keys = append(keys, blindTerm("import", key))
+		} else if p.SearchKey == searchKeyID {
+			keys = append(keys, key)
+		} else {
+			stale = true
+		}
+	}
+	if stale {
+		var analysis importedAnalysis
+		json.Unmarshal([]byte(p.Analysis), &analysis)
+		day := p.UploadDate.UTC().Format("2006-01-02")
+		for _, medicine := range analysis.Medicines {
+			keys = append(keys, importKey(prescribedImportKey(day, medicine.Name, medicine.Dosage)))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// importGroupKey decides which prescription a MedicationRequest belongs to:
+// the shared prescription number if present, else the prescriber and day.
+func importGroupKey(req FHIRMedicationRequest) string {
+	if req.GroupIdentifier != nil && req.GroupIdentifier.Value != "" {
+		return "group:" + req.GroupIdentifier.System + "|" + req.GroupIdentifier.Value
+	}
+	for _, info := range req.SupportingInformation {
+		if strings.HasPrefix(info.Reference, "DocumentReference/") {
+			return "document:" + info.Reference
+		}
+	}
+	day := req.AuthoredOn
+	if len(day) > 10 {
+		day = day[:10]
+	}
+	requester := ""
+	if req.Requester != nil {
+		requester = req.Requester.Reference + req.Requester.Display
+	}
+	return "authored:" + day + "|" + requester
+}
+
+// existingImportDuplicate reports the prescription already holding one of keys.
+// Resources we exported ourselves carry the original prescription's id.
+func existingImportDuplicate(username string, req FHIRMedicationRequest, keys []string) (string, error) {
+	for _, id := range req.Identifier {
+		if id.System != fhirMedicationSystem {
+			continue
+		}
+		prescriptionID, _, _ := strings.Cut(id.Value, "-")
+		objID, err := primitive.ObjectIDFromHex(prescriptionID)
+		if err != nil {
+			continue
+		}
+		if _, err := findUserPrescription(objID, username); err == nil {
+			return prescriptionID, nil
+		} else if err != mongo.ErrNoDocuments {
+			return "", err
+		}
+	}
+
+	var existing Prescription
+	err := prescriptionsColl.FindOne(context.Background(), bson.M{
+		"patient_id":  username,
+		"import_keys": bson.M{"$in": keys},
+	}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return existing.ID.Hex(), nil
+}
+
+// groupFHIRImport reads the MedicationRequests of bundle into the
+// prescriptions they make up, skipping duplicates within the bundle and those
+// existingDuplicate finds already imported.
+func groupFHIRImport(bundle FHIRBundle, existingDuplicate func(FHIRMedicationRequest, []string) (string, error)) ([]*fhirImportGroup, []FHIRImportSkip, error) {
+	// Medication resources referenced by MedicationRequest.medicationReference
+	medications := map[string]FHIRCodeableConcept{}
+	for _, entry := range bundle.Entry {
+		var medication struct {
+			FHIRResource
+			Code FHIRCodeableConcept `json:"code"`
+		}
+		if json.Unmarshal(entry.Resource, &medication) == nil && medication.ResourceType == "Medication" {
+			medications["Medication/"+medication.ID] = medication.Code
+			if entry.FullURL != "" {
+				medications[entry.FullURL] = medication.Code
+			}
+		}
+	}
+
+	skipped := []FHIRImportSkip{}
+	var groups []*fhirImportGroup
+	groupsByKey := map[string]*fhirImportGroup{}
+	seen := map[string]string{}
+
+	for i, entry := range bundle.Entry {
+		var header FHIRResource
+		if err := json.Unmarshal(entry.Resource, &header); err != nil {
+			skipped = append(skipped, FHIRImportSkip{fhirResourceLabel(header, i), "not a valid resource"})
+			continue
+		}
+		label := fhirResourceLabel(header, i)
+		if header.ResourceType != "MedicationRequest" {
+			if header.ResourceType != "Medication" {
+				skipped = append(skipped, FHIRImportSkip{label, "only MedicationRequest resources are imported"})
+			}
+			continue
+		}
+
+		var req FHIRMedicationRequest
+		if err := json.Unmarshal(entry.Resource, &req); err != nil {
+			skipped = append(skipped, FHIRImportSkip{label, "invalid MedicationRequest: " + err.Error()})
+			continue
+		}
+		if req.Status == "entered-in-error" || req.Status == "draft" {
+			skipped = append(skipped, FHIRImportSkip{label, "status is " + req.Status})
+			continue
+		}
+
+		name := req.MedicationCodeableConcept.String()
+		if name == "" && req.MedicationReference != nil {
+			name = medications[req.MedicationReference.Reference].String()
+			if name == "" {
+				name = req.MedicationReference.Display
+			}
+		}
+		if name == "" {
+			skipped = append(skipped, FHIRImportSkip{label, "medication has no name"})
+			continue
+		}
+
+		medicine := importedMedicine{Name: name, GenericAlternatives: []interface{}{}}
+		var dosages, instructions, reasons, notes []string
+		for _, dosage := range req.DosageInstruction {
+			if dosage.Text != "" {
+				dosages = append(dosages, dosage.Text)
+			}
+			if dosage.PatientInstruction != "" {
+				instructions = append(instructions, dosage.PatientInstruction)
+			}
+		}
+		for _, reason := range req.ReasonCode {
+			if text := reason.String(); text != "" {
+				reasons = append(reasons, text)
+			}
+		}
+		for _, note := range req.Note {
+			if note.Text != "" {
+				notes = append(notes, note.Text)
+			}
+		}
+		medicine.Dosage = strings.Join(dosages, "; ")
+		medicine.Instructions = strings.Join(instructions, "; ")
+		medicine.Purpose = strings.Join(reasons, ", ")
+		medicine.Warnings = strings.Join(notes, " ")
+
+		keys := medicationRequestKeys(req, name, medicine.Dosage)
+		duplicate := false
+		for _, key := range keys {
+			if other, ok := seen[key]; ok {
+				skipped = append(skipped, FHIRImportSkip{label, "duplicate of " + other + " in this bundle"})
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		existing, err := existingDuplicate(req, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		if existing != "" {
+			skipped = append(skipped, FHIRImportSkip{label, "already in your history as prescription " + existing})
+			continue
+		}
+		for _, key := range keys {
+			seen[key] = label
+		}
+
+		groupKey := importGroupKey(req)
+		group, ok := groupsByKey[groupKey]
+		if !ok {
+			group = &fhirImportGroup{key: groupKey}
+			groupsByKey[groupKey] = group
+			groups = append(groups, group)
+		}
+		if t, ok := parseFHIRDate(req.AuthoredOn); ok && (group.authoredOn.IsZero() || t.Before(group.authoredOn)) {
+			group.authoredOn = t
+		}
+		if group.prescriber == "" && req.Requester != nil {
+			group.prescriber = req.Requester.Display
+		}
+		group.medicines = append(group.medicines, medicine)
+		group.resources = append(group.resources, label)
+		group.importKeys = append(group.importKeys, keys...)
+	}
+	return groups, skipped, nil
+}
+
+// prescription is the history entry for an imported group, dated when the
+// earliest of its requests was authored.
+func (g *fhirImportGroup) prescription(username string) (Prescription, error) {
+	uploadDate := g.authoredOn
+	if uploadDate.IsZero() {
+		uploadDate = time.Now()
+	}
+	analysis, err := json.Marshal(importedAnalysis{
+		Date:                   uploadDate.Format("2006-01-02"),
+		Prescriber:             g.prescriber,
+		Medicines:              g.medicines,
+		DietaryRecommendations: map[string][]string{"foods_to_eat": {}, "foods_to_avoid": {}},
+	})
+	if err != nil {
+		return Prescription{}, err
+	}
+
+	sort.Strings(g.importKeys)
+	return Prescription{
+		PatientID:  username,
+		Analysis:   string(analysis),
+		Language:   "en",
+		UploadDate: uploadDate,
+		Source:     "fhir",
+		ImportKeys: g.importKeys,
+	}, nil
+}
+
+// fhirImportHandler adds the MedicationRequests in a FHIR R4 Bundle to the
+// user's prescription history: POST /fhir/import
+func fhirImportHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var bundle FHIRBundle
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFHIRImportSize)).Decode(&bundle); err != nil {
+		httpError(w, r, "invalid_fhir_json", http.StatusBadRequest)
+		return
+	}
+	if bundle.ResourceType != "Bundle" {
+		httpError(w, r, "not_fhir_bundle", http.StatusBadRequest)
+		return
+	}
+
+	groups, skipped, err := groupFHIRImport(bundle, func(req FHIRMedicationRequest, keys []string) (string, error) {
+		return existingImportDuplicate(username, req, keys)
+	})
+	if err != nil {
+		log.Printf("Error checking for duplicate FHIR import: %v", err)
+		httpError(w, r, "import_check_failed", http.StatusInternalServerError)
+		return
+	}
+
+	imported := []FHIRImportResult{}
+	for _, group := range groups {
+		prescription, err := group.prescription(username)
+		if err != nil {
+			log.Printf("Error encoding imported analysis: %v", err)
+			httpError(w, r, "import_failed", http.StatusInternalServerError)
+			return
+		}
+		result, err := prescriptionsColl.InsertOne(context.Background(), prescription)
+		if err != nil {
+			log.Printf("Error saving imported prescription: %v", err)
+			httpError(w, r, "import_failed", http.StatusInternalServerError)
+			return
+		}
+		prescriptionID := result.InsertedID.(primitive.ObjectID).Hex()
+		recordAudit(r, username, username, auditImport, prescriptionID)
+		imported = append(imported, FHIRImportResult{
+			PrescriptionID: prescriptionID,
+			Medicines:      len(group.medicines),
+			Resources:      group.resources,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(imported) > 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testdata/fhir-r4.schema.json is the part of the FHIR R4 JSON schema
+// covering the resources we export and import.
+const fhirSchemaPath = "testdata/fhir-r4.schema.json"
+
+const fhirFixtureAnalysis = `{
+	"patient_name": "Asha Verma",
+	"date": "2024-03-05",
+	"prescriber": "Dr. R. Mehta",
+	"medicines": [
+		{"name": "Amoxicillin 500mg", "dosage": "500 mg three times a day", "instructions": "After food for 5 days", "purpose": "Chest infection", "warnings": "Stop and call the doctor if a rash appears"},
+		{"name": "Paracetamol 650mg", "dosage": "650 mg when needed", "instructions": ""},
+		{"name": "पैन्टोप्राज़ोल", "dosage": "40 mg", "instructions": "खाली पेट"}
+	]
+}`
+
+func fhirFixture() (User, Prescription) {
+	user := User{ID: primitive.NewObjectID(), Username: "asha", Allergies: []string{"Penicillin", "penicillin ", "Sulfa drugs"}}
+	prescription := Prescription{
+		ID:         primitive.NewObjectID(),
+		PatientID:  user.Username,
+		Analysis:   fhirFixtureAnalysis,
+		Language:   "en",
+		UploadDate: time.Date(2024, 3, 5, 9, 30, 0, 0, time.UTC),
+	}
+	return user, prescription
+}
+
+func validateFHIR(t *testing.T, data []byte) error {
+	t.Helper()
+	schema, err := jsonschema.Compile(fhirSchemaPath)
+	if err != nil {
+		t.Fatalf("compiling %s: %v", fhirSchemaPath, err)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("bundle is not JSON: %v", err)
+	}
+	return schema.Validate(doc)
+}
+
+func TestFHIRBundleRoundTrip(t *testing.T) {
+	user, prescription := fhirFixture()
+	exported := buildFHIRBundle("https://cura.example", user, []Prescription{prescription}, false)
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateFHIR(t, data); err != nil {
+		t.Fatalf("exported bundle is not valid FHIR R4: %v", err)
+	}
+
+	var bundle FHIRBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	groups, skipped, err := groupFHIRImport(bundle, func(FHIRMedicationRequest, []string) (string, error) {
+		return "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Patient and the two distinct allergies are not imported
+	if len(skipped) != 3 {
+		t.Errorf("skipped %d resources, want 3: %+v", len(skipped), skipped)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("imported %d prescriptions, want 1", len(groups))
+	}
+
+	imported, err := groups[0].prescription(user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imported.UploadDate.Equal(prescription.UploadDate) {
+		t.Errorf("upload date %v, want %v", imported.UploadDate, prescription.UploadDate)
+	}
+	if imported.PatientID != user.Username || imported.Source != "fhir" {
+		t.Errorf("imported for %q from %q, want %q from fhir", imported.PatientID, imported.Source, user.Username)
+	}
+	if len(imported.ImportKeys) == 0 {
+		t.Error("imported prescription has no import keys")
+	}
+
+	var original, got struct {
+		Date       string `json:"date"`
+		Prescriber string `json:"prescriber"`
+		Medicines  []map[string]interface{}
+	}
+	json.Unmarshal([]byte(prescription.Analysis), &original)
+	if err := json.Unmarshal([]byte(imported.Analysis), &got); err != nil {
+		t.Fatalf("imported analysis is not JSON: %v", err)
+	}
+	if got.Date != original.Date {
+		t.Errorf("date %q, want %q", got.Date, original.Date)
+	}
+	if got.Prescriber != original.Prescriber {
+		t.Errorf("prescriber %q, want %q", got.Prescriber, original.Prescriber)
+	}
+	if len(got.Medicines) != len(original.Medicines) {
+		t.Fatalf("%d medicines, want %d", len(got.Medicines), len(original.Medicines))
+	}
+	for i, want := range original.Medicines {
+		med := got.Medicines[i]
+		if med["name"] != want["name"] {
+			t.Errorf("medicine %d name %q, want %q", i, med["name"], want["name"])
+		}
+		// Dosage and instructions travel together as Dosage.text
+		if dosage := fhirDosageText(want); med["dosage"] != dosage {
+			t.Errorf("medicine %d dosage %q, want %q", i, med["dosage"], dosage)
+		}
+		if want["purpose"] != nil && med["purpose"] != want["purpose"] {
+			t.Errorf("medicine %d purpose %q, want %q", i, med["purpose"], want["purpose"])
+		}
+	}
+
+	// Importing the same bundle twice adds nothing the second time
+	keys := map[string]bool{}
+	for _, key := range imported.ImportKeys {
+		keys[key] = true
+	}
+	again, skipped, err := groupFHIRImport(bundle, func(_ FHIRMedicationRequest, candidates []string) (string, error) {
+		for _, key := range candidates {
+			if keys[key] {
+				return prescription.ID.Hex(), nil
+			}
+		}
+		return "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 0 || len(skipped) != 3+len(original.Medicines) {
+		t.Errorf("re-import made %d prescriptions and skipped %d resources", len(again), len(skipped))
+	}
+}
+
+func TestFHIRSchemaRejectsInvalidResources(t *testing.T) {
+	for name, bundle := range map[string]string{
+		"unknown bundle type":      `{"resourceType": "Bundle", "type": "archive"}`,
+		"request without status":   `{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": {"resourceType": "MedicationRequest", "intent": "order", "medicationCodeableConcept": {"text": "Amoxicillin"}, "subject": {"reference": "Patient/1"}}}]}`,
+		"request without subject":  `{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": {"resourceType": "MedicationRequest", "status": "unknown", "intent": "order", "medicationCodeableConcept": {"text": "Amoxicillin"}}}]}`,
+		"unknown element":          `{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": {"resourceType": "Patient", "nickname": "A"}}]}`,
+		"document without content": `{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": {"resourceType": "DocumentReference", "status": "current", "content": []}}]}`,
+	} {
+		if err := validateFHIR(t, []byte(bundle)); err == nil {
+			t.Errorf("%s: schema accepted %s", name, bundle)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Calls to Gemini get a timeout per attempt, are retried with exponential
+// backoff on 429 and 5xx, and go through a circuit breaker that fails fast
+// once the service has failed repeatedly. Failures come back as *AIError so
+// handlers can answer with a meaningful status.
+const (
+	geminiAttemptTimeout = 60 * time.Second
+	geminiMaxAttempts    = 3
+	geminiBaseBackoff    = 500 * time.Millisecond
+	geminiMaxRetryWait   = 10 * time.Second
+
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+type GeminiResponse struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+}
+
+type geminiErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// AI error kinds
+const (
+	aiQuota       = "quota"       // the model's rate limit or quota is exhausted
+	aiSafety      = "safety"      // the prompt or answer was blocked
+	aiBadRequest  = "bad_request" // the model rejected the request
+	aiUnavailable = "unavailable" // timeouts, outages, empty answers, open circuit
+	aiBadAnswer   = "bad_answer"  // the answer is not in the format the prompt asks for
+)
+
+type AIError struct {
+	Kind       string
+	Status     int // HTTP status from the model, 0 if none
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *AIError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("gemini %s (%d): %s", e.Kind, e.Status, e.Message)
+	}
+	return fmt.Sprintf("gemini %s: %s", e.Kind, e.Message)
+}
+
+func (e *AIError) retryable() bool {
+	return e.Kind == aiQuota || e.Kind == aiUnavailable
+}
+
+// circuitBreaker opens after breakerThreshold consecutive failures and then
+// lets a single trial request through every breakerCooldown. Cancelled
+// requests and quota errors are not counted either way.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var geminiBreaker circuitBreaker
+
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerThreshold {
+		return true, 0
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return false, wait
+	}
+	// Half-open: this request is the trial, others wait another cooldown
+	b.openUntil = time.Now().Add(breakerCooldown)
+	return true, 0
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.failures >= breakerThreshold {
+			log.Printf("Gemini is responding again, closing circuit breaker")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures == breakerThreshold {
+		log.Printf("Gemini failed %d times in a row, failing fast for %s", b.failures, breakerCooldown)
+	}
+	if b.failures >= breakerThreshold {
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// askGemini sends prompt to the model, with an optional already validated
+// upload (see sanitizeUpload).
+func askGemini(ctx context.Context, prompt string, file ...[]byte) (string, error) {
+	parts := []interface{}{map[string]interface{}{"text": prompt}}
+	if len(file) > 0 && file[0] != nil {
+		parts = append(parts, inlineData(file[0], http.DetectContentType(file[0])))
+	}
+	return generateContent(ctx, parts)
+}
+
+// askGeminiAudio sends prompt with a recording whose type http.DetectContentType
+// cannot tell apart (see audioMimeType).
+func askGeminiAudio(ctx context.Context, prompt string, audio []byte, mimeType string) (string, error) {
+	return generateContent(ctx, []interface{}{
+		map[string]interface{}{"text": prompt},
+		inlineData(audio, mimeType),
+	})
+}
+
+func inlineData(data []byte, mimeType string) map[string]interface{} {
+	return map[string]interface{}{
+		"inline_data": map[string]interface{}{
+			"mime_type": mimeType,
+			"data":      base64.StdEncoding.EncodeToString(data),
+		},
+	}
+}
+
+// generateContent makes the request, retrying overloads with backoff.
+func generateContent(ctx context.Context, parts []interface{}) (string, error) {
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"contents": []interface{}{map[string]interface{}{"parts": parts}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error marshaling request body: %w", err)
+	}
+
+	var lastErr *AIError
+	for attempt := 0; attempt < geminiMaxAttempts; attempt++ {
+		if attempt > 0 {
+			wait := geminiBaseBackoff << (attempt - 1)
+			wait += time.Duration(rand.Int63n(int64(wait) / 2))
+			if lastErr.RetryAfter > wait {
+				wait = lastErr.RetryAfter
+			}
+			if wait > geminiMaxRetryWait {
+				break
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return "", &AIError{Kind: aiUnavailable, Message: ctx.Err().Error()}
+			}
+		}
+
+		ok, wait := geminiBreaker.allow()
+		if !ok {
+			return "", &AIError{Kind: aiUnavailable, Message: "circuit breaker open", RetryAfter: wait}
+		}
+
+		text, aiErr := callGemini(ctx, jsonBody)
+		switch {
+		case aiErr != nil && (ctx.Err() != nil || aiErr.Kind == aiQuota):
+			// The caller gave up, or the model answered that our quota is
+			// used up; neither says the service is down
+		default:
+			geminiBreaker.record(aiErr != nil && aiErr.retryable())
+		}
+		if aiErr == nil {
+			return text, nil
+		}
+		lastErr = aiErr
+		if !aiErr.retryable() || ctx.Err() != nil {
+			break
+		}
+		log.Printf("Gemini attempt %d failed: %v", attempt+1, aiErr)
+	}
+	return "", lastErr
+}
+
+// geminiModel is the model named in GEMINI_API_URL
+// (".../models/<model>:generateContent"), recorded with each analysis.
+func geminiModel() string {
+	u, err := url.Parse(os.Getenv("GEMINI_API_URL"))
+	if err != nil {
+		return ""
+	}
+	_, model, ok := strings.Cut(u.Path, "/models/")
+	if !ok {
+		return ""
+	}
+	model, _, _ = strings.Cut(model, ":")
+	return model
+}
+
+// callGemini makes a single request and classifies the outcome.
+func callGemini(ctx context.Context, jsonBody []byte) (string, *AIError) {
+	ctx, cancel := context.WithTimeout(ctx, geminiAttemptTimeout)
+	defer cancel()
+
+	endpoint := os.Getenv("GEMINI_API_URL") + "?key=" + os.Getenv("GEMINI_API_KEY")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		return "", &AIError{Kind: aiBadRequest, Message: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Never log the URL, it carries the API key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", &AIError{Kind: aiUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", &AIError{Kind: aiUnavailable, Status: resp.StatusCode, Message: "error reading response body: " + err.Error()}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		aiErr := &AIError{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		var errResp geminiErrorResponse
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+			aiErr.Message = errResp.Error.Message
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			aiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			aiErr.Kind = aiQuota
+		case resp.StatusCode >= 500:
+			aiErr.Kind = aiUnavailable
+		default:
+			aiErr.Kind = aiBadRequest
+		}
+		return "", aiErr
+	}
+
+	var geminiResp GeminiResponse
+	if err := json.Unmarshal(body, &geminiResp); err != nil {
+		return "", &AIError{Kind: aiUnavailable, Message: "error unmarshaling response body: " + err.Error()}
+	}
+	if reason := geminiResp.PromptFeedback.BlockReason; reason != "" {
+		return "", &AIError{Kind: aiSafety, Message: "prompt blocked: " + reason}
+	}
+	if len(geminiResp.Candidates) == 0 {
+		return "", &AIError{Kind: aiUnavailable, Message: "no candidates in response"}
+	}
+
+	candidate := geminiResp.Candidates[0]
+	var text strings.Builder
+	for _, part := range candidate.Content.Parts {
+		text.WriteString(part.Text)
+	}
+	switch candidate.FinishReason {
+	case "SAFETY", "PROHIBITED_CONTENT", "BLOCKLIST", "SPII":
+		return "", &AIError{Kind: aiSafety, Message: "answer blocked: " + candidate.FinishReason}
+	}
+	if text.Len() == 0 {
+		return "", &AIError{Kind: aiUnavailable, Message: "empty answer, finish reason " + candidate.FinishReason}
+	}
+	return text.String(), nil
+}
+
+// writeAIError answers a failed model call with a status and a message in
+// the user's language.
+func writeAIError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Error calling Gemini: %v", err)
+
+	kind, status := aiUnavailable, http.StatusServiceUnavailable
+	var retryAfter time.Duration
+	var aiErr *AIError
+	if errors.As(err, &aiErr) {
+		kind, retryAfter = aiErr.Kind, aiErr.RetryAfter
+		switch aiErr.Kind {
+		case aiSafety:
+			status = http.StatusUnprocessableEntity
+		case aiBadRequest, aiBadAnswer:
+			status = http.StatusBadGateway
+		}
+	}
+	if status == http.StatusServiceUnavailable {
+		if retryAfter <= 0 {
+			retryAfter = breakerCooldown
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.5)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "ai_" + kind,
+		"message": translate(requestLang(r), "ai."+kind),
+	})
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Prescription history is searched and filtered in MongoDB even though the
+// analyses are encrypted. When a prescription is saved, the words of its
+// analysis are stored in search_terms as keyed hashes (a blind index): the
+// database can match a hashed query word without learning the words. Words
+// are scoped, so "medicine:" and "prescriber:" terms serve the filters and
+// "text:" terms the free-text search; medicine and prescriber words are also
+// indexed by prefix, so "amox" finds amoxicillin.
+//
+// The hash key is SEARCH_INDEX_KEY (base64, 32 bytes), or is derived from the
+// primary encryption key. search_key records which key built a document's
+// terms; documents built with another key, or before search existed, are
+// re-indexed in the background at startup. The import keys of FHIR imports
+// are hashed with the same key and are converted along with the terms.
+
+const (
+	defaultHistoryPageSize = 20
+	maxHistoryPageSize     = 100
+	minSearchPrefix        = 3  // shortest indexed prefix, in letters
+	maxSearchWord          = 30 // longer words are indexed by their start
+	historyDateLayout      = "2006-01-02"
+)
+
+var (
+	searchIndexKey []byte
+	searchKeyID    string
+
+	errInvalidHistoryQuery = errors.New("invalid history query")
+)
+
+// loadSearchIndexKey must run after loadEncryptionKeys.
+func loadSearchIndexKey() {
+	if encoded := os.Getenv("SEARCH_INDEX_KEY"); encoded != "" {
+		key, err := decodeKey("SEARCH_INDEX_KEY", encoded)
+		if err != nil {
+			log.Fatalf("Error loading search index key: %v", err)
+		}
+		searchIndexKey = key
+	} else {
+		mac := hmac.New(sha256.New, encryptionKeys.keys[encryptionKeys.primary])
+		mac.Write([]byte("cura prescription search"))
+		searchIndexKey = mac.Sum(nil)
+	}
+	sum := sha256.Sum256(searchIndexKey)
+	searchKeyID = hex.EncodeToString(sum[:4])
+}
+
+// HistoryQuery is a page of a user's prescription history, read from the
+// dashboard's and the API's query string.
+type HistoryQuery struct {
+	Query      string // words anywhere in the analysis
+	Medicine   string
+	Prescriber string
+	Language   string
+	From       string // "YYYY-MM-DD", inclusive
+	To         string // "YYYY-MM-DD", inclusive
+	Sort       string // "newest" or "oldest"
+	Page       int
+	PerPage    int
+}
+
+// HistoryPage is one page of results.
+type HistoryPage struct {
+	Query         HistoryQuery
+	Prescriptions []Prescription
+	Total         int64
+}
+
+func parseHistoryQuery(values url.Values) (HistoryQuery, error) {
+	q := HistoryQuery{
+		Query:      strings.TrimSpace(values.Get("q")),
+		Medicine:   strings.TrimSpace(values.Get("medicine")),
+		Prescriber: strings.TrimSpace(values.Get("prescriber")),
+		Language:   values.Get("language"),
+		From:       values.Get("from"),
+		To:         values.Get("to"),
+		Sort:       values.Get("sort"),
+		Page:       1,
+		PerPage:    defaultHistoryPageSize,
+	}
+	if q.Language != "" {
+		if _, ok := lookupLanguage(q.Language); !ok {
+			return q, errInvalidHistoryQuery
+		}
+	}
+	for _, date := range []string{q.From, q.To} {
+		if _, err := time.Parse(historyDateLayout, date); date != "" && err != nil {
+			return q, errInvalidHistoryQuery
+		}
+	}
+	switch q.Sort {
+	case "":
+		q.Sort = "newest"
+	case "newest", "oldest":
+	default:
+		return q, errInvalidHistoryQuery
+	}
+	if s := values.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, errInvalidHistoryQuery
+		}
+		q.Page = n
+	}
+	if s := values.Get("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, errInvalidHistoryQuery
+		}
+		q.PerPage = min(n, maxHistoryPageSize)
+	}
+	return q, nil
+}
+
+// Filtered reports whether anything narrows the history down.
+func (q HistoryQuery) Filtered() bool {
+	return q.Query != "" || q.Medicine != "" || q.Prescriber != "" || q.Language != "" || q.From != "" || q.To != ""
+}
+
+// Values encodes q for a link, leaving out defaults.
+func (q HistoryQuery) Values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"q": q.Query, "medicine": q.Medicine, "prescriber": q.Prescriber,
+		"language": q.Language, "from": q.From, "to": q.To,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if q.Sort != "newest" {
+		values.Set("sort", q.Sort)
+	}
+	if q.PerPage != defaultHistoryPageSize {
+		values.Set("per_page", strconv.Itoa(q.PerPage))
+	}
+	if q.Page > 1 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	return values
+}
+
+// filter turns q into a MongoDB filter on username's prescriptions.
+func (q HistoryQuery) filter(username string) bson.M {
+	filter := bson.M{"patient_id": username}
+	if q.Language != "" {
+		filter["language"] = q.Language
+	}
+
+	date := bson.M{}
+	if t, err := time.Parse(historyDateLayout, q.From); err == nil {
+		date["$gte"] = t
+	}
+	if t, err := time.Parse(historyDateLayout, q.To); err == nil {
+		date["$lt"] = t.AddDate(0, 0, 1)
+	}
+	if len(date) > 0 {
+		filter["upload_date"] = date
+	}
+
+	// Every word has to match; a search word may be any word of the text or
+	// the start of a medicine name
+	var terms []bson.M
+	for _, word := range searchWords(q.Query) {
+		terms = append(terms, bson.M{"search_terms": bson.M{"$in": []string{
+			blindTerm("text", word), blindTerm("medicine", word),
+		}}})
+	}
+	for _, word := range searchWords(q.Medicine) {
+		terms = append(terms, bson.M{"search_terms": blindTerm("medicine", word)})
+	}
+	for _, word := range searchWords(q.Prescriber) {
+		terms = append(terms, bson.M{"search_terms": blindTerm("prescriber", word)})
+	}
+	if len(terms) > 0 {
+		filter["$and"] = terms
+		// A held or rejected reading must not give its medicines away by
+		// matching, so a search leaves it out as the FHIR export does
+		filter["review.status"] = bson.M{"$nin": bson.A{reviewPending, reviewRejected}}
+	}
+	return filter
+}
+
+// searchPrescriptions returns one page of username's prescriptions matching q.
+func searchPrescriptions(ctx context.Context, username string, q HistoryQuery) (HistoryPage, error) {
+	page := HistoryPage{Query: q, Prescriptions: []Prescription{}}
+	filter := q.filter(username)
+
+	total, err := prescriptionsColl.CountDocuments(ctx, filter)
+	if err != nil {
+		return page, err
+	}
+	page.Total = total
+
+	order := -1
+	if q.Sort == "oldest" {
+		order = 1
+	}
+	cursor, err := prescriptionsColl.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "upload_date", Value: order}, {Key: "_id", Value: order}}).
+		SetSkip(int64((q.Page-1)*q.PerPage)).
+		SetLimit(int64(q.PerPage)))
+	if err != nil {
+		return page, err
+	}
+	err = cursor.All(ctx, &page.Prescriptions)
+	return page, err
+}
+
+// Pages is the number of pages, at least one.
+func (p HistoryPage) Pages() int {
+	return max(1, int((p.Total+int64(p.Query.PerPage)-1)/int64(p.Query.PerPage)))
+}
+
+func (p HistoryPage) HasPrev() bool { return p.Query.Page > 1 }
+
+func (p HistoryPage) HasNext() bool { return p.Query.Page < p.Pages() }
+
+// PageURL links to page n of the same search on the dashboard.
+func (p HistoryPage) PageURL(n int) string {
+	q := p.Query
+	q.Page = n
+	values := q.Values()
+	if len(values) == 0 {
+		return "/dashboard#history"
+	}
+	return "/dashboard?" + values.Encode() + "#history"
+}
+
+func (p HistoryPage) PrevURL() string { return p.PageURL(p.Query.Page - 1) }
+
+func (p HistoryPage) NextURL() string { return p.PageURL(p.Query.Page + 1) }
+
+// Range describes the shown results, e.g. "21–40 of 53".
+func (p HistoryPage) Range() map[string]string {
+	first := int64((p.Query.Page-1)*p.Query.PerPage) + 1
+	last := first + int64(len(p.Prescriptions)) - 1
+	return map[string]string{
+		"from":  strconv.FormatInt(first, 10),
+		"to":    strconv.FormatInt(last, 10),
+		"total": strconv.FormatInt(p.Total, 10),
+	}
+}
+
+// MedicineNames lists the medicines in the analysis.
+func (p Prescription) MedicineNames() []string {
+	var parsed struct {
+		Medicines []struct {
+			Name string `json:"name"`
+		} `json:"medicines"`
+	}
+	json.Unmarshal([]byte(cleanAnalysisJSON(p.Analysis)), &parsed)
+	var names []string
+	for _, med := range parsed.Medicines {
+		if med.Name != "" {
+			names = append(names, med.Name)
+		}
+	}
+	return names
+}
+
+// blindTerm is the stored form of one word in a scope.
+func blindTerm(scope, word string) string {
+	mac := hmac.New(sha256.New, searchIndexKey)
+	mac.Write([]byte(scope + ":" + word))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:9])
+}
+
+// searchWords splits text into lower-case words of letters and digits in any
+// script, keeping the vowel signs of Indic scripts.
+func searchWords(text string) []string {
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	}) {
+		if runes := []rune(word); len(runes) > maxSearchWord {
+			word = string(runes[:maxSearchWord])
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// searchTerms returns the blind index of an analysis.
+func searchTerms(analysis string) []string {
+	var parsed struct {
+		Prescriber interface{} `json:"prescriber"`
+		Medicines  []struct {
+			Name string `json:"name"`
+		} `json:"medicines"`
+	}
+	var all interface{}
+	cleaned := cleanAnalysisJSON(analysis)
+	if err := json.Unmarshal([]byte(cleaned), &all); err != nil {
+		// Unparseable model output is still searchable as text
+		all = cleaned
+	}
+	json.Unmarshal([]byte(cleaned), &parsed)
+
+	seen := map[string]bool{}
+	var terms []string
+	add := func(scope, word string) {
+		term := blindTerm(scope, word)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	addPrefixes := func(scope, text string) {
+		for _, word := range searchWords(text) {
+			runes := []rune(word)
+			for n := min(minSearchPrefix, len(runes)); n <= len(runes); n++ {
+				add(scope, string(runes[:n]))
+			}
+		}
+	}
+
+	for _, med := range parsed.Medicines {
+		addPrefixes("medicine", med.Name)
+	}
+	addPrefixes("prescriber", analysisText(parsed.Prescriber))
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			for _, word := range searchWords(v) {
+				add("text", word)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(all)
+	return terms
+}
+
+func ensureHistoryIndexes() error {
+	_, err := prescriptionsColl.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "upload_date", Value: -1}}},
+		{Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "language", Value: 1}, {Key: "upload_date", Value: -1}}},
+		{Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "search_terms", Value: 1}}},
+		{Keys: bson.D{{Key: "search_key", Value: 1}}},
+	})
+	return err
+}
+
+// reindexPrescriptionSearch rebuilds the search terms of prescriptions saved
+// before search existed or indexed with another key, and converts their
+// import keys.
+func reindexPrescriptionSearch() {
+	ctx := context.Background()
+	cursor, err := prescriptionsColl.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"search_key": bson.M{"$ne": searchKeyID}},
+		bson.M{"import_keys": bson.M{"$regex": legacyImportKeys}},
+	}})
+	if err != nil {
+		log.Printf("Error finding prescriptions to index: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		var prescription Prescription
+		if err := cursor.Decode(&prescription); err != nil {
+			log.Printf("Error indexing prescription: %v", err)
+			continue
+		}
+		set := bson.M{
+			"search_terms": searchTerms(prescription.Analysis),
+			"search_key":   searchKeyID,
+		}
+		if len(prescription.ImportKeys) > 0 {
+			set["import_keys"] = rekeyImportKeys(prescription)
+		}
+		_, err := prescriptionsColl.UpdateOne(ctx, bson.M{"_id": prescription.ID}, bson.M{"$set": set})
+		if err != nil {
+			log.Printf("Error indexing prescription %s: %v", prescription.ID.Hex(), err)
+			continue
+		}
+		count++
+	}
+	if count > 0 {
+		log.Printf("Indexed %d prescriptions for search", count)
+	}
+}
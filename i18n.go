@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// locales holds the static/locales/*.json dictionaries keyed by language code
+// so the server can produce the same strings the browser shows.
+var locales = map[string]map[string]interface{}{}
+
+func loadLocales(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Printf("Error listing locale files: %v", err)
+		return
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			log.Printf("Error reading locale %s: %v", f, err)
+			continue
+		}
+
+		var dict map[string]interface{}
+		if err := json.Unmarshal(data, &dict); err != nil {
+			log.Printf("Error parsing locale %s: %v", f, err)
+			continue
+		}
+
+		lang := strings.TrimSuffix(filepath.Base(f), ".json")
+		if _, ok := lookupLanguage(lang); !ok {
+			log.Printf("Warning: ignoring locale %s, %s is not in supportedLanguages", f, lang)
+			continue
+		}
+		locales[lang] = dict
+	}
+
+	for _, l := range supportedLanguages {
+		if _, ok := locales[l.Code]; !ok {
+			log.Printf("Warning: no locale file for %s, using English", l.Name)
+		}
+	}
+}
+
+// translate looks up a dotted key (e.g. "safety.pregnancy_title") in the given
+// language, falling back to English and finally to the key itself.
+// Placeholders of the form {name} are replaced from args.
+func translate(lang, key string, args ...map[string]string) string {
+	text, ok := lookupLocale(lang, key)
+	if !ok {
+		text, ok = lookupLocale("en", key)
+	}
+	if !ok {
+		text = key
+	}
+
+	for _, m := range args {
+		for k, v := range m {
+			text = strings.ReplaceAll(text, "{"+k+"}", v)
+		}
+	}
+	return text
+}
+
+func lookupLocale(lang, key string) (string, bool) {
+	var node interface{} = locales[lang]
+	for _, part := range strings.Split(key, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		node = m[part]
+	}
+	s, ok := node.(string)
+	return s, ok
+}
+
+// requestLang picks the language for server-rendered pages and messages: the
+// cura_lang cookie set by the language selector, then the best supported
+// match in Accept-Language by q-value, then English.
+func requestLang(r *http.Request) string {
+	if cookie, err := r.Cookie("cura_lang"); err == nil {
+		if _, ok := lookupLanguage(cookie.Value); ok {
+			return cookie.Value
+		}
+	}
+	if lang := negotiateLanguage(r.Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// negotiateLanguage returns the supported language the Accept-Language
+// header rates highest, or "" if it accepts none of them. Regional tags
+// match their base language (hi-IN is hi) and ties keep header order.
+func negotiateLanguage(header string) string {
+	type accepted struct {
+		lang string
+		q    float64
+	}
+	var candidates []accepted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := lookupLanguage(lang); ok && q > 0 {
+			candidates = append(candidates, accepted{lang, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].lang
+}
+
+// templateFuncs are the functions pages use to render in lang: {{t "key"}}
+// translates a locale key (extra arguments are placeholder name/value
+// pairs) and {{lang}} is the language code for <html lang>.
+func templateFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(key string, pairs ...string) string {
+			args := map[string]string{}
+			for i := 0; i+1 < len(pairs); i += 2 {
+				args[pairs[i]] = pairs[i+1]
+			}
+			return translate(lang, key, args)
+		},
+		"lang": func() string { return lang },
+	}
+}
+
+// localizedTemplates holds a copy of the page templates per supported
+// language so pages arrive translated instead of being swapped by i18n.js
+// after load.
+var localizedTemplates = map[string]*template.Template{}
+
+// localizeTemplates must run before any page is rendered, since html/template
+// cannot be cloned once it has executed.
+func localizeTemplates() {
+	for _, l := range supportedLanguages {
+		clone, err := templates.Clone()
+		if err != nil {
+			log.Fatalf("Error cloning templates for %s: %v", l.Code, err)
+		}
+		localizedTemplates[l.Code] = clone.Funcs(templateFuncs(l.Code))
+	}
+}
+
+// renderTemplate executes a page template in lang, falling back to English
+// for unknown languages and for keys the locale has not translated.
+func renderTemplate(w http.ResponseWriter, lang, name string, data interface{}) {
+	tmpl, ok := localizedTemplates[lang]
+	if !ok {
+		lang = defaultLanguage
+		tmpl = localizedTemplates[lang]
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language, Cookie")
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Error rendering %s in %s: %v", name, lang, err)
+	}
+}
+
+// httpError is http.Error with the message looked up under "errors." in the
+// request's language, with placeholders filled from args.
+func httpError(w http.ResponseWriter, r *http.Request, key string, code int, args ...map[string]string) {
+	lang := requestLang(r)
+	w.Header().Set("Content-Language", lang)
+	http.Error(w, translate(lang, "errors."+key, args...), code)
+}
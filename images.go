@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Original prescription uploads live in the "prescription_images" GridFS
+// bucket; Prescription.ImageID points at the file.
+var imagesBucket *gridfs.Bucket
+
+// Files are stored encrypted (see encryption.go); the metadata records which
+// key sealed them and the size of the original upload.
+type imageMetadata struct {
+	PatientID   string `bson:"patient_id"`
+	ContentType string `bson:"content_type"`
+	KeyID       string `bson:"key_id,omitempty"`
+	Size        int64  `bson:"size,omitempty"`
+}
+
+func storePrescriptionImage(username, filename string, data []byte) (primitive.ObjectID, error) {
+	return uploadPrescriptionImage(filename, data, imageMetadata{
+		PatientID:   username,
+		ContentType: http.DetectContentType(data),
+	})
+}
+
+// uploadPrescriptionImage encrypts data with the primary key and stores it.
+func uploadPrescriptionImage(filename string, data []byte, meta imageMetadata) (primitive.ObjectID, error) {
+	return uploadEncryptedFile(imagesBucket, filename, data, meta)
+}
+
+// prescriptionImageMetadata reads a stored file's metadata.
+func prescriptionImageMetadata(id primitive.ObjectID) (imageMetadata, error) {
+	return encryptedFileMetadata(imagesBucket, id)
+}
+
+// loadPrescriptionImage returns the decrypted bytes and their content type.
+func loadPrescriptionImage(id primitive.ObjectID) ([]byte, string, error) {
+	return loadEncryptedFile(imagesBucket, id)
+}
+
+// uploadEncryptedFile seals data with the primary key and stores it in
+// bucket. Every bucket of user uploads tags files with their owner so
+// purgeUser can find them.
+func uploadEncryptedFile(bucket *gridfs.Bucket, filename string, data []byte, meta imageMetadata) (primitive.ObjectID, error) {
+	sealed, err := sealEnvelope(data)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	meta.KeyID = encryptionKeys.primary
+	meta.Size = int64(len(data))
+	opts := options.GridFSUpload().SetMetadata(meta)
+	return bucket.UploadFromStream(filename, bytes.NewReader(sealed), opts)
+}
+
+func encryptedFileMetadata(bucket *gridfs.Bucket, id primitive.ObjectID) (imageMetadata, error) {
+	var file gridfs.File
+	var meta imageMetadata
+	if err := bucket.GetFilesCollection().FindOne(context.Background(), bson.M{"_id": id}).Decode(&file); err != nil {
+		return meta, err
+	}
+	if file.Metadata != nil {
+		if err := bson.Unmarshal(file.Metadata, &meta); err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
+}
+
+func loadEncryptedFile(bucket *gridfs.Bucket, id primitive.ObjectID) ([]byte, string, error) {
+	stream, err := bucket.OpenDownloadStream(id)
+	if err != nil {
+		return nil, "", err
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var meta imageMetadata
+	if raw := stream.GetFile().Metadata; raw != nil {
+		if err := bson.Unmarshal(raw, &meta); err != nil {
+			log.Printf("Error decoding file metadata: %v", err)
+		}
+	}
+
+	// Uploads from before encryption was enabled are still plaintext
+	if isEnvelope(data) {
+		if data, err = openEnvelope(data); err != nil {
+			return nil, "", fmt.Errorf("decrypting file %s: %w", id.Hex(), err)
+		}
+	}
+
+	if meta.ContentType == "" {
+		meta.ContentType = http.DetectContentType(data)
+	}
+	return data, meta.ContentType, nil
+}
+
+// thumbnailJPEG downscales an image so its longer side is at most maxSide
+// pixels and re-encodes it as JPEG. It returns the size of the result.
+func thumbnailJPEG(data []byte, maxSide int) ([]byte, int, int, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			w, h = maxSide, h*maxSide/w
+		} else {
+			w, h = w*maxSide/h, maxSide
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+	return buf.Bytes(), w, h, nil
+}
+
+// prescriptionImageHandler serves the original upload to its owner:
+// GET /prescription/{id}/image
+func prescriptionImageHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prescriptionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/prescription/"), "/image")
+	objID, err := primitive.ObjectIDFromHex(prescriptionID)
+	if err != nil {
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
+		return
+	}
+
+	prescription, err := findUserPrescription(objID, username)
+	if err != nil {
+		writePrescriptionLookupError(w, r, err)
+		return
+	}
+	if prescription.ImageID.IsZero() {
+		httpError(w, r, "no_image", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, username, username, auditViewImage, prescriptionID)
+
+	data, contentType, err := loadPrescriptionImage(prescription.ImageID)
+	if err != nil {
+		log.Printf("Error loading prescription image: %v", err)
+		httpError(w, r, "load_image_failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write(data)
+}
+
+// imageFileInfo describes a stored upload without reading its contents.
+type imageFileInfo struct {
+	Name        string
+	Size        int64
+	ContentType string
+}
+
+// prescriptionImageFiles looks up the GridFS file documents for ids.
+func prescriptionImageFiles(ids []primitive.ObjectID) map[primitive.ObjectID]imageFileInfo {
+	infos := map[primitive.ObjectID]imageFileInfo{}
+	if len(ids) == 0 {
+		return infos
+	}
+
+	cursor, err := imagesBucket.Find(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Printf("Error finding prescription images: %v", err)
+		return infos
+	}
+	var files []gridfs.File
+	if err := cursor.All(context.Background(), &files); err != nil {
+		log.Printf("Error decoding prescription images: %v", err)
+		return infos
+	}
+
+	for _, file := range files {
+		id, ok := file.ID.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		var meta imageMetadata
+		if file.Metadata != nil {
+			bson.Unmarshal(file.Metadata, &meta)
+		}
+		size := meta.Size
+		if size == 0 {
+			size = file.Length
+		}
+		infos[id] = imageFileInfo{Name: file.Name, Size: size, ContentType: meta.ContentType}
+	}
+	return infos
+}
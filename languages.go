@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-text/typesetting/language"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Language is an interface and output language. Each one needs a
+// static/locales/<code>.json file; Name is what prompts ask the model to
+// answer in, and Script picks the PDF font.
+type Language struct {
+	Code       string          `json:"code"`
+	Name       string          `json:"name"`
+	NativeName string          `json:"native_name"`
+	Script     language.Script `json:"-"`
+}
+
+// supportedLanguages is the single list of languages the app offers, in the
+// order the language selectors show them.
+var supportedLanguages = []Language{
+	{"en", "English", "English", language.Latin},
+	{"hi", "Hindi", "हिन्दी", language.Devanagari},
+	{"bn", "Bengali", "বাংলা", language.Bengali},
+	{"mr", "Marathi", "मराठी", language.Devanagari},
+	{"te", "Telugu", "తెలుగు", language.Telugu},
+	{"ta", "Tamil", "தமிழ்", language.Tamil},
+	{"gu", "Gujarati", "ગુજરાતી", language.Gujarati},
+	{"kn", "Kannada", "ಕನ್ನಡ", language.Kannada},
+	{"or", "Odia", "ଓଡ଼ିଆ", language.Oriya},
+	{"pa", "Punjabi", "ਪੰਜਾਬੀ", language.Gurmukhi},
+}
+
+const defaultLanguage = "en"
+
+func lookupLanguage(code string) (Language, bool) {
+	for _, l := range supportedLanguages {
+		if l.Code == code {
+			return l, true
+		}
+	}
+	return Language{}, false
+}
+
+// languageOrDefault returns the language for code, or English if code is
+// empty or not supported.
+func languageOrDefault(code string) Language {
+	if l, ok := lookupLanguage(code); ok {
+		return l
+	}
+	l, _ := lookupLanguage(defaultLanguage)
+	return l
+}
+
+// preferredLanguage is the language a signed-in user asked for in their
+// profile, falling back to the one their browser uses.
+func preferredLanguage(r *http.Request, username string) string {
+	var user User
+	err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		log.Printf("Error loading preferred language: %v", err)
+	} else if _, ok := lookupLanguage(user.Language); ok {
+		return user.Language
+	}
+	return requestLang(r)
+}
+
+func setLanguageCookie(w http.ResponseWriter, code string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "cura_lang",
+		Value:    code,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// languagesHandler lists the supported languages (GET) and sets the
+// preferred one (POST {"language": "ta"}), which is saved on the account
+// when signed in.
+func languagesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		current := requestLang(r)
+		if username, _, loggedIn := getLoggedInUser(r); loggedIn {
+			current = preferredLanguage(r, username)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"languages": supportedLanguages,
+			"current":   current,
+		})
+	case http.MethodPost:
+		var req struct {
+			Language string `json:"language"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		if _, ok := lookupLanguage(req.Language); !ok {
+			httpError(w, r, "unsupported_language", http.StatusBadRequest)
+			return
+		}
+
+		if username, _, loggedIn := getLoggedInUser(r); loggedIn {
+			_, err := usersColl.UpdateOne(context.Background(), bson.M{"username": username},
+				bson.M{"$set": bson.M{"language": req.Language}})
+			if err != nil {
+				log.Printf("Error saving preferred language: %v", err)
+				httpError(w, r, "save_language_failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		setLanguageCookie(w, req.Language)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"current": req.Language})
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -7,39 +7,64 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 	"os"
-	"bytes"
 	"encoding/json"
-	"mime/multipart"
-	"encoding/base64"
+	"errors"
 	"io"
 	"fmt"
 	"github.com/joho/godotenv"
 	"strings"
-	"github.com/jung-kurt/gofpdf"
-	"net/url"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type User struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"`
-	Username string             `bson:"username"`
-	Password string             `bson:"password"` // Stored as SHA256 hash
-	Role     string             `bson:"role"`     // Only "patient" now
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Username  string             `bson:"username"`
+	Password  string             `bson:"password"` // Stored as SHA256 hash
+	Role      string             `bson:"role"`     // "patient", or "pharmacist" for accounts that review held analyses
+	Pregnant  bool               `bson:"pregnant"`
+	Lactating bool               `bson:"lactating"`
+	Allergies []string           `bson:"allergies"`
+	Language  string             `bson:"language,omitempty"` // preferred language code, see supportedLanguages
+	Phone     string             `bson:"phone,omitempty"`    // E.164 number linked for the SMS channel
+	PhoneLink *PhoneLink         `bson:"phone_link,omitempty"`
+
+	// Members of an organization listed in data/limits.json share its AI quota
+	Organization string `bson:"organization,omitempty"`
+
+	// Set while a requested account deletion is in its grace period
+	DeletionScheduledFor *time.Time `bson:"deletion_scheduled_for,omitempty"`
 }
 
 type Prescription struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty"`
 	PatientID   string            `bson:"patient_id"`
 	ImagePath   string            `bson:"image_path"`
+	ImageID     primitive.ObjectID `bson:"image_id,omitempty"` // GridFS file in prescription_images
 	Analysis    string            `bson:"analysis"`
+	Language    string            `bson:"language"`
 	UploadDate  time.Time         `bson:"upload_date"`
+	Source      string            `bson:"source,omitempty"`      // "fhir" for imported records
+	ImportKeys  []string          `bson:"import_keys,omitempty"` // de-duplicates repeated imports
+	ImageSHA256 string            `bson:"image_sha256,omitempty"` // exact hash of the upload
+	ImagePHash  string            `bson:"image_phash,omitempty"`  // perceptual hash, matches re-taken photos
+	ImageQuality *ImageQuality    `bson:"image_quality,omitempty"`
+	PromptVersion string          `bson:"prompt_version,omitempty"` // e.g. "prescription_analysis.v1"
+	ProfileKey  string            `bson:"profile_key,omitempty"`    // the profile it was analysed for, see dedup.go
+	Model       string            `bson:"model,omitempty"`          // Gemini model that produced the analysis
+	SearchTerms []string          `bson:"search_terms,omitempty"`   // blind index of the analysis, see history.go
+	SearchKey   string            `bson:"search_key,omitempty"`     // which key built SearchTerms
+	Version     int               `bson:"version,omitempty"`        // of the analysis, see corrections.go; 0 or 1 for the model's
+	OriginalAnalysis string       `bson:"original_analysis,omitempty"` // the model's analysis, once corrected
+	Review      *Review           `bson:"review,omitempty"`         // set when the analysis was held for a pharmacist, see review.go
 }
 
 type Medicine struct {
@@ -54,16 +79,9 @@ type PageData struct {
 	Role         string
 	Results      []Medicine
 	Prescriptions []Prescription
-}
-
-type GeminiResponse struct {
-	Candidates []struct {
-		Content struct {
-			Parts []struct {
-				Text string `json:"text"`
-			} `json:"parts"`
-		} `json:"content"`
-	} `json:"candidates"`
+	History      HistoryPage
+	Languages    []Language
+	ReviewNotices []Prescription // reviews resolved since the patient last looked
 }
 
 type ChatRequest struct {
@@ -84,7 +102,7 @@ var (
 	prescriptionsColl *mongo.Collection
 )
 
-var templates = template.Must(template.ParseGlob("templates/*.html"))
+var templates = template.Must(template.New("").Funcs(templateFuncs(defaultLanguage)).ParseGlob("templates/*.html"))
 
 func getMongoURI() string {
 	err := godotenv.Load()
@@ -101,168 +119,258 @@ func getMongoURI() string {
 	return mongoURI
 }
 
-func askGemini(prompt string, file ...multipart.File) (string, error) {
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	url := os.Getenv("GEMINI_API_URL") + "?key=" + apiKey
-
-	var requestBody map[string]interface{}
-
-	if len(file) > 0 && file[0] != nil {
-		uploadedFile := file[0]
-		defer uploadedFile.Close()
-
-		fileData, err := io.ReadAll(uploadedFile)
-		if err != nil {
-			return "", fmt.Errorf("error reading uploaded file: %w", err)
-		}
+func analyzePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getLoggedInUser(r)
+	if username == "" {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		contentType := http.DetectContentType(fileData)
-
-		requestBody = map[string]interface{}{
-			"contents": []interface{}{
-				map[string]interface{}{
-					"parts": []interface{}{
-						map[string]interface{}{
-							"text": prompt,
-						},
-						map[string]interface{}{
-							"inline_data": map[string]interface{}{
-								"mime_type": contentType,
-								"data":      base64.StdEncoding.EncodeToString(fileData),
-							},
-						},
-					},
-				},
-			},
-		}
-	} else {
-		requestBody = map[string]interface{}{
-			"contents": []interface{}{
-				map[string]interface{}{
-					"parts": []interface{}{
-						map[string]string{"text": prompt},
-					},
-				},
-			},
+	// Cap the request size before the form is parsed
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, translate(requestLang(r), "upload.file_too_big"), http.StatusRequestEntityTooLarge)
+			return
 		}
+		httpError(w, r, "upload_failed", http.StatusBadRequest)
+		return
 	}
 
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("error marshaling request body: %w", err)
+	// Use the requested output language, else the user's preferred one
+	langCode := r.FormValue("lang")
+	if _, ok := lookupLanguage(langCode); !ok {
+		langCode = preferredLanguage(r, username)
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonBody))
+	file, header, err := r.FormFile("prescription")
 	if err != nil {
-		return "", err
+		httpError(w, r, "upload_failed", http.StatusBadRequest)
+		return
 	}
-	defer resp.Body.Close()
+	defer file.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	rawData, err := io.ReadAll(file)
 	if err != nil {
-		return "", fmt.Errorf("error reading response body: %w", err)
+		httpError(w, r, "upload_failed", http.StatusBadRequest)
+		return
 	}
 
-	var geminiResp GeminiResponse
-	err = json.Unmarshal(body, &geminiResp)
-	if err != nil {
-		return "", fmt.Errorf("error unmarshaling response body: %w", err)
+	result, err := analyzePrescription(r, username, AnalysisUpload{
+		Filename:  header.Filename,
+		Data:      rawData,
+		Language:  langCode,
+		Grayscale: r.FormValue("grayscale") == "true",
+		Force:     r.FormValue("force") == "true",
+		SuggestSimilar: true,
+	})
+	var retake *RetakeError
+	var similar *SimilarUploadError
+	var aiErr *AIError
+	switch {
+	case errors.As(err, &retake):
+		writeRetakeError(w, r, retake.Quality)
+		return
+	case errors.As(err, &similar):
+		writeSimilarUploadError(w, r, similar.Previous)
+		return
+	case errors.As(err, &aiErr):
+		writeAIError(w, r, err)
+		return
+	case err != nil && result.Rejected:
+		message, code := uploadErrorMessage(requestLang(r), err)
+		if code == http.StatusInternalServerError {
+			log.Printf("Error processing upload: %v", err)
+		}
+		http.Error(w, message, code)
+		return
+	case err != nil:
+		log.Printf("Error analyzing prescription: %v", err)
+		httpError(w, r, "analysis_failed", http.StatusInternalServerError)
+		return
 	}
 
-	if len(geminiResp.Candidates) == 0 {
-		return "No response from AI", nil
+	prescription := result.Prescription
+	response := map[string]interface{}{
+		"analysis":           prescription.Analysis,
+		"pregnancy_warnings": userPregnancyWarnings(username, prescription.Analysis, langCode),
+		"reminders":          reminderSchedule(prescription.Analysis),
+		"confidence":         analysisConfidence(prescription),
+	}
+	// Held analyses reach the patient only after a pharmacist's review
+	if prescription.Withheld() {
+		response = map[string]interface{}{
+			"id":     prescription.ID.Hex(),
+			"review": prescription.Review,
+		}
+	}
+	if result.Duplicate != "" {
+		skipAIQuota(w)
+		response["duplicate_of"] = map[string]interface{}{
+			"id":          prescription.ID.Hex(),
+			"upload_date": prescription.UploadDate,
+			"match":       result.Duplicate,
+		}
+	} else {
+		response["image_quality"] = result.Quality
 	}
+	json.NewEncoder(w).Encode(response)
+}
 
-	return geminiResp.Candidates[0].Content.Parts[0].Text, nil
+// AnalysisUpload is a prescription file to analyse and how.
+type AnalysisUpload struct {
+	Filename  string
+	Data      []byte
+	Language  string
+	Grayscale bool // send the model a black-and-white copy
+	Force     bool // analyse again even if the image was seen before
+	WhatsApp  string // phone number ID of a WhatsApp upload, to send the review outcome on
+	SuggestSimilar bool // stop with a SimilarUploadError when a near-identical photo was analysed before
 }
 
-func analyzePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
-	username, _, _ := getLoggedInUser(r)
-	if username == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+// AnalysisResult is the stored analysis of an upload: a new one, or an
+// earlier one of the identical file when Duplicate is "exact".
+type AnalysisResult struct {
+	Prescription Prescription
+	Duplicate    string
+	Quality      *ImageQuality
+	Rejected     bool // the failure was the file itself, see uploadErrorMessage
+}
 
-	// Read and validate requested language (defaults to English)
-	langCode := r.FormValue("lang")
-	var language string
-	switch langCode {
-	case "hi":
-		language = "Hindi"
-	case "pa":
-		language = "Punjabi"
-	default:
-		language = "English"
+// RetakeError means the photo is too poor to analyse.
+type RetakeError struct {
+	Quality ImageQuality
+}
+
+func (e *RetakeError) Error() string {
+	return fmt.Sprintf("image quality %d is too low", e.Quality.Score)
+}
+
+// SimilarUploadError means the photo looks like an earlier prescription. It
+// may still be a different one, so the user is asked before either is used.
+type SimilarUploadError struct {
+	Previous Prescription
+}
+
+func (e *SimilarUploadError) Error() string {
+	return "looks like prescription " + e.Previous.ID.Hex()
+}
+
+// analyzePrescription validates the upload, reuses an earlier analysis of
+// the identical file unless Force is set, otherwise asks the model and
+// saves the image and analysis for username. It serves both the dashboard
+// upload and the messaging bots.
+func analyzePrescription(r *http.Request, username string, upload AnalysisUpload) (AnalysisResult, error) {
+	language := languageOrDefault(upload.Language)
+	langCode := language.Code
+
+	// Validate the upload and strip its metadata; the cleaned copy is what
+	// gets stored and sent to the model
+	imageData, contentType, err := sanitizeUpload(upload.Data)
+	if err != nil {
+		return AnalysisResult{Rejected: true}, err
 	}
 
-	file, _, err := r.FormFile("prescription")
+	profile := promptProfile(username)
+	prompt, promptVersion, err := renderPrompt(promptPrescriptionAnalysis, AnalysisPromptData{
+		Language:     language.Name,
+		LanguageCode: langCode,
+		Profile:      profile,
+	})
 	if err != nil {
-		http.Error(w, "Error uploading file", http.StatusBadRequest)
-		return
-	}
-
-	prompt := `Analyze this prescription image and provide the following information in JSON format:
-	1. List of medicines with their:
-	   - Name and dosage
-	   - Purpose/disease
-	   - Usage instructions
-	   - Warnings or contraindications
-	   - Dosage appropriateness (flag if suspicious)
-	   - Generic alternatives (include name and approximate cost savings percentage)
-	2. Dietary recommendations:
-	   - List of foods to eat that can help with the condition
-	   - List of foods to avoid that might interfere with the medication or condition
-	3. Patient information (if available)
-	4. Prescriber information
-	5. Additional details like manufacturer, lot number, etc.
-
-	Format the response as a proper JSON object with the following structure:
-	{
-		"patient_name": "...",
-		"date": "...",
-		"prescriber": "...",
-		"medicines": [{
-			"name": "...",
-			"dosage": "...",
-			"purpose": "...",
-			"instructions": "...",
-			"warnings": "...",
-			"dosage_appropriate": "...",
-			"generic_alternatives": [{
-				"name": "...",
-				"cost_saving": number
-			}]
-		}],
-		"dietary_recommendations": {
-			"foods_to_eat": ["..."],
-			"foods_to_avoid": ["..."]
-		},
-		"manufacturer": "...",
-		"lot_number": "...",
-		"expiration_date": "..."
-	}
-
-	Important language instruction: Respond in ` + language + `. Keep all JSON keys in English, but translate all values and free-text fields into ` + language + `. Do NOT include markdown code fences; return only raw JSON.`
-
-	analysis, err := askGemini(prompt, file)
+		return AnalysisResult{}, fmt.Errorf("rendering prompt: %w", err)
+	}
+	key := DuplicateKey{Language: langCode, PromptVersion: promptVersion, ProfileKey: profileKey(profile)}
+
+	// Reuse the earlier analysis when the identical file is uploaded again
+	// for the same prompt and profile, unless the user asked for a fresh one.
+	// A merely similar photo may be another prescription, so the user is
+	// asked instead.
+	imageSHA256, imagePHash := imageHashes(imageData)
+	if !upload.Force {
+		similarHash := ""
+		if upload.SuggestSimilar {
+			similarHash = imagePHash
+		}
+		previous, match, err := findDuplicateAnalysis(username, key, imageSHA256, similarHash)
+		switch {
+		case err != nil:
+			log.Printf("Error looking for duplicate analysis: %v", err)
+		case match == "exact":
+			recordAudit(r, username, username, auditView, previous.ID.Hex())
+			return AnalysisResult{Prescription: previous, Duplicate: match}, nil
+		case match == "similar":
+			return AnalysisResult{}, &SimilarUploadError{Previous: previous}
+		}
+	}
+
+	// Straighten and clean up photos for the model, and ask for a retake
+	// instead of analysing one that is too poor to read
+	analysisImage := imageData
+	var quality *ImageQuality
+	if contentType != "application/pdf" {
+		enhanced, q, err := enhancePrescriptionPhoto(imageData, upload.Grayscale)
+		if err != nil {
+			log.Printf("Error enhancing prescription photo: %v", err)
+		} else if q.Score < minImageQuality {
+			return AnalysisResult{}, &RetakeError{Quality: q}
+		} else {
+			analysisImage, quality = enhanced, &q
+		}
+	}
+
+	analysis, err := askGemini(r.Context(), prompt, analysisImage)
 	if err != nil {
-		http.Error(w, "AI service error", http.StatusInternalServerError)
-		return
+		return AnalysisResult{}, err
 	}
 
 	// Save prescription to database
 	prescription := Prescription{
 		PatientID:   username,
 		Analysis:    analysis,
+		Language:    langCode,
 		UploadDate:  time.Now(),
+		ImageSHA256: imageSHA256,
+		ImagePHash:  imagePHash,
+		ImageQuality: quality,
+		PromptVersion: promptVersion,
+		ProfileKey:  key.ProfileKey,
+		Model:       geminiModel(),
+	}
+	if reasons := reviewReasons(analysis, quality); len(reasons) > 0 {
+		prescription.Review = &Review{
+			Status:      reviewPending,
+			Reasons:     reasons,
+			RequestedAt: prescription.UploadDate,
+			WhatsApp:    upload.WhatsApp,
+		}
+	}
+
+	imageID, err := storePrescriptionImage(username, upload.Filename, imageData)
+	if err != nil {
+		log.Printf("Error storing prescription image: %v", err)
+	} else {
+		prescription.ImageID = imageID
 	}
 
-	_, err = prescriptionsColl.InsertOne(context.Background(), prescription)
+	result, err := prescriptionsColl.InsertOne(context.Background(), prescription)
 	if err != nil {
 		log.Printf("Error saving prescription: %v", err)
+	} else {
+		prescription.ID = result.InsertedID.(primitive.ObjectID)
+		recordAudit(r, username, username, auditCreate, prescription.ID.Hex())
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"analysis": analysis})
+	return AnalysisResult{Prescription: prescription, Quality: quality}, nil
+}
+
+// cleanAnalysisJSON strips the markdown code fence the model sometimes wraps
+// around its JSON answer.
+func cleanAnalysisJSON(analysis string) string {
+	analysis = strings.TrimPrefix(analysis, "```json\n")
+	analysis = strings.TrimSuffix(analysis, "\n```")
+	return analysis
 }
 
 func hashPassword(password string) string {
@@ -273,12 +381,12 @@ func hashPassword(password string) string {
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	username, role, _ := getLoggedInUser(r)
 	data := PageData{User: username, Role: role}
-	templates.ExecuteTemplate(w, "home.html", data)
+	renderTemplate(w, requestLang(r), "home.html", data)
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		templates.ExecuteTemplate(w, "register.html", nil)
+		renderTemplate(w, requestLang(r), "register.html", nil)
 		return
 	}
 
@@ -289,8 +397,17 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	// Check if username already exists
 	var existingUser User
 	err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&existingUser)
-	if err == nil {
-		http.Error(w, "Username already exists", http.StatusBadRequest)
+	if err == nil || strings.HasPrefix(username, smsUsernamePrefix) {
+		httpError(w, r, "username_taken", http.StatusBadRequest)
+		return
+	}
+	retired, err := usernameRetired(username)
+	if err != nil {
+		httpError(w, r, "create_user_failed", http.StatusInternalServerError)
+		return
+	}
+	if retired {
+		httpError(w, r, "username_taken", http.StatusBadRequest)
 		return
 	}
 
@@ -299,11 +416,12 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		Username: username,
 		Password: hashPassword(password),
 		Role:     role,
+		Language: requestLang(r),
 	}
 
 	_, err = usersColl.InsertOne(context.Background(), user)
 	if err != nil {
-		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		httpError(w, r, "create_user_failed", http.StatusInternalServerError)
 		return
 	}
 
@@ -312,7 +430,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		templates.ExecuteTemplate(w, "login.html", nil)
+		renderTemplate(w, requestLang(r), "login.html", nil)
 		return
 	}
 
@@ -326,46 +444,49 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}).Decode(&user)
 
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		httpError(w, r, "invalid_credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Set session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "username",
-		Value:   user.Username,
-		Expires: time.Now().Add(24 * time.Hour),
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:    "role",
-		Value:   user.Role,
-		Expires: time.Now().Add(24 * time.Hour),
-	})
+	setSessionCookie(w, r, user)
+	// The interface follows the account's language on every device
+	if _, ok := lookupLanguage(user.Language); ok {
+		setLanguageCookie(w, user.Language)
+	}
 
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:    "username",
-		Value:   "",
-		Expires: time.Now(),
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:    "role",
-		Value:   "",
-		Expires: time.Now(),
-	})
+	clearSessionCookie(w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func getLoggedInUser(r *http.Request) (string, string, bool) {
-	usernameCookie, err1 := r.Cookie("username")
-	roleCookie, err2 := r.Cookie("role")
-	if err1 != nil || err2 != nil {
-		return "", "", false
+	// API requests carry who their token belongs to
+	if principal, ok := apiPrincipalFrom(r); ok {
+		return principal.Username, principal.Role, true
+	}
+	return sessionUser(r)
+}
+
+// findUserPrescription loads a prescription, ensuring it belongs to username.
+func findUserPrescription(objID primitive.ObjectID, username string) (Prescription, error) {
+	var prescription Prescription
+	err := prescriptionsColl.FindOne(context.Background(), bson.M{
+		"_id": objID,
+		"patient_id": username, // Ensure user can only access their own prescriptions
+	}).Decode(&prescription)
+	return prescription, err
+}
+
+func writePrescriptionLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == mongo.ErrNoDocuments {
+		httpError(w, r, "prescription_not_found", http.StatusNotFound)
+	} else {
+		log.Printf("Error fetching prescription: %v", err)
+		httpError(w, r, "internal", http.StatusInternalServerError)
 	}
-	return usernameCookie.Value, roleCookie.Value, true
 }
 
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
@@ -375,372 +496,287 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user's prescriptions
-	cursor, err := prescriptionsColl.Find(context.Background(), bson.M{"patient_id": username})
+	// One page of the user's prescriptions; a malformed filter shows the
+	// unfiltered history
+	query, err := parseHistoryQuery(r.URL.Query())
 	if err != nil {
-		log.Printf("Error fetching prescriptions: %v", err)
+		query, _ = parseHistoryQuery(url.Values{})
 	}
-
-	var prescriptions []Prescription
-	if err = cursor.All(context.Background(), &prescriptions); err != nil {
-		log.Printf("Error decoding prescriptions: %v", err)
+	history, err := searchPrescriptions(r.Context(), username, query)
+	if err != nil {
+		log.Printf("Error fetching prescriptions: %v", err)
 	}
+	recordListAudit(r, username, history.Prescriptions)
 
 	data := PageData{
 		User:         username,
 		Role:         role,
-		Prescriptions: prescriptions,
+		Prescriptions: history.Prescriptions,
+		History:      history,
+		Languages:    supportedLanguages,
+		ReviewNotices: reviewNotices(r.Context(), username),
 	}
 
-	templates.ExecuteTemplate(w, "dashboard.html", data)
+	renderTemplate(w, requestLang(r), "dashboard.html", data)
 }
 
 func chatHandler(w http.ResponseWriter, r *http.Request) {
-	_, _, loggedIn := getLoggedInUser(r)
+	username, _, loggedIn := getLoggedInUser(r)
 	if !loggedIn {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	language := languageOrDefault(preferredLanguage(r, username))
+	if isVoiceRequest(r) {
+		question, ok := readVoiceQuestion(w, r)
+		if !ok {
+			return
+		}
+		answerVoiceQuestion(w, r, username, "general", promptVoiceChat, question, VoicePromptData{
+			Language:     language.Name,
+			LanguageCode: language.Code,
+		})
 		return
 	}
 
 	var req ChatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		httpError(w, r, "invalid_request", http.StatusBadRequest)
 		return
 	}
 
-	prompt := "Act as a medical expert and answer in 200 characters. Answer this health query in a professional but understandable way: " + req.Message
-	response, err := askGemini(prompt)
+	response, cached, err := askChat(r.Context(), username, language, req.Message)
 	if err != nil {
-		http.Error(w, "AI service error", http.StatusInternalServerError)
+		writeAnswerError(w, r, err)
 		return
 	}
+	if cached {
+		skipAIQuota(w)
+	}
 
 	json.NewEncoder(w).Encode(map[string]string{"response": response})
 }
 
+// askChat answers a general health question in language, from the cache
+// when the same question was asked recently, and saves it to the history.
+func askChat(ctx context.Context, username string, language Language, message string) (string, bool, error) {
+	prompt, promptVersion, err := renderPrompt(promptChat, ChatPromptData{
+		Message:      message,
+		Language:     language.Name,
+		LanguageCode: language.Code,
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("rendering prompt: %w", err)
+	}
+
+	response, cached := cachedChatResponse(promptVersion, language.Code, message)
+	if !cached {
+		response, err = askGemini(ctx, prompt)
+		if err != nil {
+			return "", false, err
+		}
+		cacheChatResponse(promptVersion, language.Code, message, response)
+	}
+
+	saveChatMessage(username, "general", message, response)
+	return response, cached, nil
+}
+
+// writeAnswerError reports a failed askChat or askDiseasePrediction.
+func writeAnswerError(w http.ResponseWriter, r *http.Request, err error) {
+	var aiErr *AIError
+	if errors.As(err, &aiErr) {
+		writeAIError(w, r, err)
+		return
+	}
+	log.Printf("Error answering question: %v", err)
+	httpError(w, r, "request_failed", http.StatusInternalServerError)
+}
+
 func predictDiseaseHandler(w http.ResponseWriter, r *http.Request) {
-	_, _, loggedIn := getLoggedInUser(r)
+	username, _, loggedIn := getLoggedInUser(r)
 	if !loggedIn {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	language := languageOrDefault(preferredLanguage(r, username))
+	if isVoiceRequest(r) {
+		// The symptoms are spoken; the rest comes from the form
+		question, ok := readVoiceQuestion(w, r)
+		if !ok {
+			return
+		}
+		answerVoiceQuestion(w, r, username, "disease", promptVoiceDisease, question, VoicePromptData{
+			Language:       language.Name,
+			LanguageCode:   language.Code,
+			Age:            r.FormValue("age"),
+			Gender:         r.FormValue("gender"),
+			MedicalHistory: r.FormValue("medical_history"),
+		})
 		return
 	}
 
 	var req DiseasePredictionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		httpError(w, r, "invalid_request", http.StatusBadRequest)
 		return
 	}
 
-	prompt := fmt.Sprintf(`Act as a medical expert. Predict possible diseases based on these details:
-	- Age: %s
-	- Gender: %s
-	- Symptoms: %s
-	- Medical History: %s
-	
-	Provide potential diagnoses in order of likelihood, possible next steps, and when to seek urgent care.
-	Use clear language without medical jargon. Answer in 450 characters. `, req.Age, req.Gender, req.Symptoms, req.MedicalHistory)
-
-	response, err := askGemini(prompt)
+	response, cached, err := askDiseasePrediction(r.Context(), username, language, req)
 	if err != nil {
-		http.Error(w, "AI service error", http.StatusInternalServerError)
+		writeAnswerError(w, r, err)
 		return
 	}
+	if cached {
+		skipAIQuota(w)
+	}
 
 	json.NewEncoder(w).Encode(map[string]string{"response": response})
 }
 
+// askDiseasePrediction predicts likely conditions from the details in req,
+// like askChat.
+func askDiseasePrediction(ctx context.Context, username string, language Language, req DiseasePredictionRequest) (string, bool, error) {
+	details := fmt.Sprintf("Age: %s, Gender: %s, Symptoms: %s, Medical History: %s",
+		req.Age, req.Gender, req.Symptoms, req.MedicalHistory)
+	prompt, promptVersion, err := renderPrompt(promptDiseasePrediction, DiseasePromptData{
+		DiseasePredictionRequest: req,
+		Language:                 language.Name,
+		LanguageCode:             language.Code,
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("rendering prompt: %w", err)
+	}
+
+	response, cached := cachedChatResponse(promptVersion, language.Code, details)
+	if !cached {
+		response, err = askGemini(ctx, prompt)
+		if err != nil {
+			return "", false, err
+		}
+		cacheChatResponse(promptVersion, language.Code, details, response)
+	}
+
+	saveChatMessage(username, "disease", details, response)
+	return response, cached, nil
+}
+
 func getPrescriptionHandler(w http.ResponseWriter, r *http.Request) {
 	username, _, loggedIn := getLoggedInUser(r)
 	if !loggedIn {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Extract prescription ID from URL
 	prescriptionID := r.URL.Path[len("/prescription/"):]
 	if prescriptionID == "" {
-		http.Error(w, "Invalid prescription ID", http.StatusBadRequest)
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
 		return
 	}
 
 	// Convert string ID to ObjectID
 	objID, err := primitive.ObjectIDFromHex(prescriptionID)
 	if err != nil {
-		http.Error(w, "Invalid prescription ID format", http.StatusBadRequest)
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
 		return
 	}
 
 	// Find prescription in database
-	var prescription Prescription
-	err = prescriptionsColl.FindOne(context.Background(), bson.M{
-		"_id": objID,
-		"patient_id": username, // Ensure user can only access their own prescriptions
-	}).Decode(&prescription)
-
+	prescription, err := findUserPrescription(objID, username)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Prescription not found", http.StatusNotFound)
-		} else {
-			log.Printf("Error fetching prescription: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+		writePrescriptionLookupError(w, r, err)
 		return
 	}
 
-	// Clean the analysis string by removing markdown code block
-	cleanAnalysis := prescription.Analysis
-	cleanAnalysis = strings.TrimPrefix(cleanAnalysis, "```json\n")
-	cleanAnalysis = strings.TrimSuffix(cleanAnalysis, "\n```")
+	recordAudit(r, username, username, auditView, prescriptionID)
+	markReviewSeen(prescription)
 
 	// Return prescription data as JSON
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"analysis": cleanAnalysis})
+	if prescription.Withheld() {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version": prescription.currentVersion(),
+			"review":  prescription.Review,
+		})
+		return
+	}
+
+	// Clean the analysis string by removing markdown code block
+	cleanAnalysis := cleanAnalysisJSON(prescription.Analysis)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"analysis":           cleanAnalysis,
+		"version":            prescription.currentVersion(),
+		"review":             prescription.Review,
+		"confidence":         analysisConfidence(prescription),
+		"pregnancy_warnings": userPregnancyWarnings(username, prescription.Analysis, r.URL.Query().Get("lang")),
+	})
 }
 
 func downloadPrescriptionHandler(w http.ResponseWriter, r *http.Request) {
 	username, _, loggedIn := getLoggedInUser(r)
 	if !loggedIn {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Extract prescription ID from URL
 	prescriptionID := r.URL.Path[len("/prescription/"):len(r.URL.Path)-len("/download")]
 	if prescriptionID == "" {
-		http.Error(w, "Invalid prescription ID", http.StatusBadRequest)
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
 		return
 	}
 
 	// Convert string ID to ObjectID
 	objID, err := primitive.ObjectIDFromHex(prescriptionID)
 	if err != nil {
-		http.Error(w, "Invalid prescription ID format", http.StatusBadRequest)
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
 		return
 	}
 
 	// Find prescription in database
-	var prescription Prescription
-	err = prescriptionsColl.FindOne(context.Background(), bson.M{
-		"_id": objID,
-		"patient_id": username, // Ensure user can only access their own prescriptions
-	}).Decode(&prescription)
-
+	prescription, err := findUserPrescription(objID, username)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Prescription not found", http.StatusNotFound)
-		} else {
-			log.Printf("Error fetching prescription: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+		writePrescriptionLookupError(w, r, err)
 		return
 	}
 
-	// Clean the analysis string by removing markdown code block
-	cleanAnalysis := prescription.Analysis
-	cleanAnalysis = strings.TrimPrefix(cleanAnalysis, "```json\n")
-	cleanAnalysis = strings.TrimSuffix(cleanAnalysis, "\n```")
-
-	// Parse the analysis JSON
-	var analysis map[string]interface{}
-	err = json.Unmarshal([]byte(cleanAnalysis), &analysis)
-	if err != nil {
-		log.Printf("Error parsing analysis data: %v", err)
-		http.Error(w, "Error parsing analysis data", http.StatusInternalServerError)
+	if prescription.Withheld() {
+		httpError(w, r, "under_review", http.StatusConflict)
 		return
 	}
 
-	// Create PDF
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	pdf.AddPage()
-
-	// Set font
-	pdf.SetFont("Arial", "B", 16)
-	
-	// Header
-	pdf.Cell(190, 10, "Cura Prescription Analysis Report")
-	pdf.Ln(15)
-
-	// Patient Information Section
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(190, 10, "Patient Information")
-	pdf.Ln(8)
-	
-	pdf.SetFont("Arial", "", 11)
-	pdf.Cell(40, 8, "Date:")
-	pdf.Cell(150, 8, prescription.UploadDate.Format("January 2, 2006 15:04:05"))
-	pdf.Ln(8)
-	
-	pdf.Cell(40, 8, "Patient ID:")
-	pdf.Cell(150, 8, prescription.PatientID)
-	pdf.Ln(8)
-	
-	pdf.Cell(40, 8, "Patient Name:")
-	pdf.Cell(150, 8, fmt.Sprintf("%v", analysis["patient_name"]))
-	pdf.Ln(8)
-	
-	pdf.Cell(40, 8, "Prescriber:")
-	pdf.Cell(150, 8, fmt.Sprintf("%v", analysis["prescriber"]))
-	pdf.Ln(15)
-
-	// Medicines Section
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(190, 10, "Prescribed Medicines")
-	pdf.Ln(10)
-
-	if medicines, ok := analysis["medicines"].([]interface{}); ok {
-		for i, med := range medicines {
-			if medicine, ok := med.(map[string]interface{}); ok {
-				pdf.SetFont("Arial", "B", 11)
-				pdf.Cell(190, 8, fmt.Sprintf("%d. %v", i+1, medicine["name"]))
-				pdf.Ln(8)
-				
-				pdf.SetFont("Arial", "", 11)
-				pdf.Cell(40, 8, "Dosage:")
-				pdf.Cell(150, 8, fmt.Sprintf("%v", medicine["dosage"]))
-				pdf.Ln(6)
-				
-				pdf.Cell(40, 8, "Purpose:")
-				pdf.Cell(150, 8, fmt.Sprintf("%v", medicine["purpose"]))
-				pdf.Ln(6)
-				
-				pdf.Cell(40, 8, "Instructions:")
-				pdf.Cell(150, 8, fmt.Sprintf("%v", medicine["instructions"]))
-				pdf.Ln(6)
-
-				if warnings, exists := medicine["warnings"]; exists {
-					pdf.Cell(40, 8, "Warnings:")
-					// Use MultiCell for potentially long warning text
-					currentX, currentY := pdf.GetXY()
-					pdf.MultiCell(150, 8, fmt.Sprintf("%v", warnings), "", "", false)
-					pdf.SetXY(currentX, currentY)
-					pdf.Ln(8)
-				}
-
-				if appropriate, exists := medicine["dosage_appropriate"]; exists {
-					pdf.Cell(40, 8, "Dosage Status:")
-					pdf.Cell(150, 8, fmt.Sprintf("%v", appropriate))
-					pdf.Ln(8)
-				}
-
-				// Add PharmEasy link
-				if name, ok := medicine["name"].(string); ok && name != "" {
-					pdf.Cell(40, 8, "Purchase Link:")
-					pharmEasyLink := fmt.Sprintf("https://pharmeasy.in/search/all?name=%s", url.QueryEscape(name))
-					pdf.SetTextColor(0, 0, 255) // Blue color for link
-					pdf.Cell(150, 8, pharmEasyLink)
-					pdf.SetTextColor(0, 0, 0) // Reset to black
-					pdf.Ln(8)
-				}
-
-				// Add generic alternatives if available
-				if generics, ok := medicine["generic_alternatives"].([]interface{}); ok && len(generics) > 0 {
-					pdf.Cell(40, 8, "Generic Alternatives:")
-					pdf.Ln(6)
-					for _, gen := range generics {
-						if generic, ok := gen.(map[string]interface{}); ok {
-							pdf.Cell(20, 8, "•")
-							pdf.Cell(130, 8, fmt.Sprintf("%v (%v%% cheaper)", generic["name"], generic["cost_saving"]))
-							pdf.Ln(6)
-						}
-					}
-					pdf.Ln(2)
-				}
-
-				pdf.Ln(4) // Space between medicines
-			}
-		}
+	// Use the requested language, else the user's preferred one
+	lang := r.URL.Query().Get("lang")
+	if _, ok := lookupLanguage(lang); !ok {
+		lang = preferredLanguage(r, username)
 	}
 
-	// Add dietary recommendations if available
-	if dietary, ok := analysis["dietary_recommendations"].(map[string]interface{}); ok {
-		pdf.SetFont("Arial", "B", 12)
-		pdf.Cell(190, 10, "Dietary Recommendations")
-		pdf.Ln(10)
-
-		// Foods to Eat
-		if foods, ok := dietary["foods_to_eat"].([]interface{}); ok && len(foods) > 0 {
-			pdf.SetFont("Arial", "B", 11)
-			pdf.Cell(190, 8, "Foods to Eat:")
-			pdf.Ln(8)
-			pdf.SetFont("Arial", "", 11)
-			for _, food := range foods {
-				pdf.Cell(10, 8, "•")
-				pdf.Cell(180, 8, fmt.Sprintf("%v", food))
-				pdf.Ln(6)
-			}
-			pdf.Ln(4)
-		}
+	recordAudit(r, username, username, auditDownload, prescriptionID)
 
-		// Foods to Avoid
-		if foods, ok := dietary["foods_to_avoid"].([]interface{}); ok && len(foods) > 0 {
-			pdf.SetFont("Arial", "B", 11)
-			pdf.Cell(190, 8, "Foods to Avoid:")
-			pdf.Ln(8)
-			pdf.SetFont("Arial", "", 11)
-			for _, food := range foods {
-				pdf.Cell(10, 8, "•")
-				pdf.Cell(180, 8, fmt.Sprintf("%v", food))
-				pdf.Ln(6)
-			}
-			pdf.Ln(4)
-		}
-	}
-
-	// Additional Information Section
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(190, 10, "Additional Information")
-	pdf.Ln(8)
-	
-	pdf.SetFont("Arial", "", 11)
-	pdf.Cell(40, 8, "Manufacturer:")
-	pdf.Cell(150, 8, fmt.Sprintf("%v", analysis["manufacturer"]))
-	pdf.Ln(8)
-	
-	pdf.Cell(40, 8, "Lot Number:")
-	pdf.Cell(150, 8, fmt.Sprintf("%v", analysis["lot_number"]))
-	pdf.Ln(8)
-	
-	pdf.Cell(40, 8, "Expiration Date:")
-	pdf.Cell(150, 8, fmt.Sprintf("%v", analysis["expiration_date"]))
-	pdf.Ln(8)
-
-	// Footer
-	pdf.SetY(-15)
-	pdf.SetFont("Arial", "I", 8)
-	pdf.Cell(0, 10, fmt.Sprintf("Generated by Cura on %s", time.Now().Format("January 2, 2006 15:04:05")))
-
-	// Set response headers
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"prescription-analysis-%s.pdf\"", prescriptionID))
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Content-Description", "File Transfer")
-
-	// Write PDF to response
-	err = pdf.Output(w)
-	if err != nil {
-		log.Printf("Error writing PDF: %v", err)
-		http.Error(w, "Error generating PDF", http.StatusInternalServerError)
-		return
-	}
+	writePrescriptionReport(w, r, prescription, lang, fmt.Sprintf("prescription-analysis-%s.pdf", prescriptionID))
 }
 
 func deletePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Get logged in user
 	username, _, _ := getLoggedInUser(r)
 	if username == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Get prescription ID from URL
 	prescriptionID := r.URL.Query().Get("id")
 	if prescriptionID == "" {
-		http.Error(w, "Prescription ID is required", http.StatusBadRequest)
+		httpError(w, r, "prescription_id_required", http.StatusBadRequest)
 		return
 	}
 
@@ -748,7 +784,7 @@ func deletePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
 	objID, err := primitive.ObjectIDFromHex(prescriptionID)
 	if err != nil {
 		log.Printf("Invalid prescription ID format: %v", err)
-		http.Error(w, "Invalid prescription ID", http.StatusBadRequest)
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
 		return
 	}
 
@@ -761,35 +797,32 @@ func deletePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Printf("Prescription not found: %s", prescriptionID)
-			http.Error(w, "Prescription not found", http.StatusNotFound)
+			httpError(w, r, "prescription_not_found", http.StatusNotFound)
 			return
 		}
 		log.Printf("Error finding prescription: %v", err)
-		http.Error(w, "Error finding prescription", http.StatusInternalServerError)
+		httpError(w, r, "prescription_lookup_failed", http.StatusInternalServerError)
 		return
 	}
 
 	// Verify ownership
 	if prescription.PatientID != username {
 		log.Printf("Unauthorized deletion attempt: user %s trying to delete prescription of user %s", username, prescription.PatientID)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Delete prescription
-	result, err := prescriptionsColl.DeleteOne(context.Background(), bson.M{
-		"_id": objID,
-	})
-
+	deleted, err := removePrescription(r, username, objID)
 	if err != nil {
 		log.Printf("Error deleting prescription: %v", err)
-		http.Error(w, "Error deleting prescription", http.StatusInternalServerError)
+		httpError(w, r, "delete_failed", http.StatusInternalServerError)
 		return
 	}
 
-	if result.DeletedCount == 0 {
+	if !deleted {
 		log.Printf("No prescription deleted for ID: %s", prescriptionID)
-		http.Error(w, "Prescription not found", http.StatusNotFound)
+		httpError(w, r, "prescription_not_found", http.StatusNotFound)
 		return
 	}
 
@@ -802,6 +835,24 @@ func deletePrescriptionHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// removePrescription deletes one of username's prescriptions, reporting
+// whether it existed, and revokes its shared links.
+func removePrescription(r *http.Request, username string, objID primitive.ObjectID) (bool, error) {
+	result, err := prescriptionsColl.DeleteOne(context.Background(), bson.M{
+		"_id":        objID,
+		"patient_id": username,
+	})
+	if err != nil || result.DeletedCount == 0 {
+		return false, err
+	}
+
+	recordAudit(r, username, username, auditDelete, objID.Hex())
+
+	// Shared links to a deleted prescription stop working
+	revokePrescriptionShares(objID)
+	return true, nil
+}
+
 func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -815,6 +866,38 @@ func main() {
 	db := client.Database("Cura")
 	usersColl = db.Collection("users")
 	prescriptionsColl = db.Collection("prescriptions")
+	shareLinksColl = db.Collection("share_links")
+	shareAccessesColl = db.Collection("share_accesses")
+	chatMessagesColl = db.Collection("chat_messages")
+	auditColl = db.Collection("audit_log")
+	aiUsageColl = db.Collection("ai_usage")
+	apiTokensColl = db.Collection("api_tokens")
+	analysisRevisionsColl = db.Collection("analysis_revisions")
+	retiredUsernamesColl = db.Collection("retired_usernames")
+	imagesBucket, err = gridfs.NewBucket(db, options.GridFSBucket().SetName("prescription_images"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	audioBucket, err = gridfs.NewBucket(db, options.GridFSBucket().SetName("chat_audio"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loadLocales("static/locales")
+	localizeTemplates()
+	loadPregnancySafety("data/pregnancy_safety.json")
+	loadReviewRules("data/review_rules.json")
+	loadMedicineCatalog("data/medicine_catalog.json")
+	loadPDFFonts()
+	loadReportSigningKey()
+	loadPublicBaseURL()
+	loadSessionKey()
+	loadEncryptionKeys()
+	loadSearchIndexKey()
+	loadLimits()
+	loadTrustedProxies()
+	loadPrompts()
+	go watchPrompts()
 
 	// Create indexes
 	_, err = usersColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
@@ -824,6 +907,48 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = ensureAuditIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureQuotaIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureSMSIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureAPITokenIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureHistoryIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureRevisionIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureReviewIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ensureAccountIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	_, err = prescriptionsColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "import_keys", Value: 1}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = prescriptionsColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "patient_id", Value: 1}, {Key: "image_sha256", Value: 1}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = shareAccessesColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "share_id", Value: 1}, {Key: "time", Value: -1}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Routes
 	http.HandleFunc("/", homeHandler)
@@ -831,17 +956,43 @@ func main() {
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/dashboard", dashboardHandler)
-	http.HandleFunc("/analyze-prescription", analyzePrescriptionHandler)
-	http.HandleFunc("/chat", chatHandler)
-	http.HandleFunc("/predict-disease", predictDiseaseHandler)
+	http.HandleFunc("/analyze-prescription", limitAI("analyze-prescription", analyzePrescriptionHandler))
+	http.HandleFunc("/chat", limitAI("chat", chatHandler))
+	http.HandleFunc("/predict-disease", limitAI("predict-disease", predictDiseaseHandler))
 	http.HandleFunc("/prescription/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/download") {
 			downloadPrescriptionHandler(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/image") {
+			prescriptionImageHandler(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/corrections") || strings.HasSuffix(r.URL.Path, "/revisions") {
+			prescriptionCorrectionsHandler(w, r)
 		} else {
 			getPrescriptionHandler(w, r)
 		}
 	})
 	http.HandleFunc("/delete-prescription", deletePrescriptionHandler)
+	http.HandleFunc("/review", reviewHandler)
+	http.HandleFunc("/review/", reviewHandler)
+	http.HandleFunc("/profile", profileHandler)
+	http.HandleFunc("/pregnancy-safety", pregnancySafetyHandler)
+	http.HandleFunc("/verify-report", verifyReportHandler)
+	http.HandleFunc("/shares", sharesHandler)
+	http.HandleFunc("/s/", sharedPrescriptionHandler)
+	http.HandleFunc("/fhir/export", fhirExportHandler)
+	http.HandleFunc("/fhir/import", fhirImportHandler)
+	http.HandleFunc("/account/export", accountExportHandler)
+	http.HandleFunc("/account/delete", accountDeleteHandler)
+	http.HandleFunc("/audit", auditHandler)
+	http.HandleFunc("/quota", quotaHandler)
+	http.HandleFunc("/languages", languagesHandler)
+	http.HandleFunc("/sms/inbound", smsInboundHandler)
+	http.HandleFunc("/whatsapp/webhook", whatsappWebhookHandler)
+	http.Handle(apiPrefix+"/", apiHandler())
+
+	go runAccountDeletionWorker()
+	go checkAuditChain()
+	go runReencryptionWorker()
+	go reindexPrescriptionSearch()
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("static"))
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The OpenAPI 3.0 document for /api/v1 is generated from apiRoutes, with
+// request and response schemas taken from the Go types by reflection, so it
+// cannot drift from what the handlers do. Fields tagged omitempty are
+// optional; everything else is required.
+
+var (
+	openAPIPathParamRe = regexp.MustCompile(`\{([a-z_]+)\}`)
+	timeType           = reflect.TypeOf(time.Time{})
+	objectIDType       = reflect.TypeOf(primitive.ObjectID{})
+	rawMessageType     = reflect.TypeOf(json.RawMessage{})
+)
+
+// openAPISchemas collects the named schemas referenced from the document.
+type openAPISchemas map[string]interface{}
+
+func openAPIDocument(r *http.Request, routes []apiRoute) map[string]interface{} {
+	schemas := openAPISchemas{}
+	errorRef := schemas.ref(reflect.TypeOf(APIError{}))
+	paths := map[string]map[string]interface{}{}
+
+	for _, route := range routes {
+		op := map[string]interface{}{
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+			"operationId": openAPIOperationID(route),
+		}
+		if route.Public {
+			op["security"] = []interface{}{}
+		}
+
+		var params []interface{}
+		for _, m := range openAPIPathParamRe.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		for _, p := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": "query", "required": p.Required, "description": p.Description,
+				"schema": map[string]string{"type": p.Type},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		switch {
+		case route.Body != nil:
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.ref(reflect.TypeOf(route.Body))},
+				},
+			}
+		case len(route.Form) > 0:
+			properties := map[string]interface{}{}
+			var required []string
+			for _, p := range route.Form {
+				schema := map[string]string{"type": p.Type, "description": p.Description}
+				if p.Type == "file" {
+					schema["type"], schema["format"] = "string", "binary"
+				}
+				properties[p.Name] = schema
+				if p.Required {
+					required = append(required, p.Name)
+				}
+			}
+			schema := map[string]interface{}{"type": "object", "properties": properties}
+			if len(required) > 0 {
+				schema["required"] = required
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{"schema": schema},
+				},
+			}
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case route.Produces != "":
+			success["content"] = map[string]interface{}{
+				route.Produces: map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}},
+			}
+		case route.Response != nil:
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.ref(reflect.TypeOf(route.Response))},
+			}
+		}
+		responses := map[string]interface{}{strconv.Itoa(status): success}
+
+		errorStatuses := append([]int{}, route.Errors...)
+		if !route.Public {
+			errorStatuses = append(errorStatuses, http.StatusUnauthorized)
+		}
+		if strings.Contains(route.Path, "{") {
+			errorStatuses = append(errorStatuses, http.StatusNotFound)
+		}
+		for _, code := range errorStatuses {
+			responses[strconv.Itoa(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": errorRef},
+				},
+			}
+		}
+		op["responses"] = responses
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = map[string]interface{}{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Cura API",
+			"version":     strings.TrimPrefix(apiPrefix, "/api/"),
+			"description": "Prescriptions, chat and symptom checks for mobile clients. Authenticate with a session token from POST /auth/token or a personal access token, sent as \"Authorization: Bearer <token>\".",
+		},
+		"servers":  []interface{}{map[string]string{"url": publicBaseURL() + apiPrefix}},
+		"security": []interface{}{map[string][]string{"bearerAuth": {}}},
+		"paths":    paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": schemas,
+		},
+	}
+}
+
+// openAPIOperationID names an operation after its method and path, e.g.
+// "deletePrescriptionsId" for DELETE /prescriptions/{id}.
+func openAPIOperationID(route apiRoute) string {
+	id := strings.ToLower(route.Method)
+	for _, part := range strings.FieldsFunc(route.Path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '.' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// ref returns the schema for t, registering named structs in components.
+func (s openAPISchemas) ref(t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return map[string]string{"type": "string", "format": "date-time"}
+	case objectIDType:
+		return map[string]string{"type": "string"}
+	case rawMessageType:
+		return map[string]string{"type": "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]string{"type": "string"}
+	case reflect.Bool:
+		return map[string]string{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]string{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]string{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.ref(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.ref(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // placeholder, for types that refer to themselves
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]string{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object describes a struct's JSON fields.
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				collect(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = s.ref(field.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	collect(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/math/fixed"
+)
+
+// PDF text has two paths. Latin text goes through gofpdf's own UTF-8 font
+// support so it stays selectable. Anything containing an Indic script is
+// shaped with HarfBuzz (conjuncts, reordered matras) and drawn as glyph
+// outlines, since gofpdf maps runes to glyphs one-to-one and cannot shape.
+
+const (
+	pdfFontFamily = "DejaVu"
+	ptToMM        = 25.4 / 72
+)
+
+type pdfFontFile struct {
+	style string // gofpdf style: "", "B" or "I"
+	file  string
+}
+
+var (
+	latinFontFiles = []pdfFontFile{
+		{"", "DejaVuSansCondensed.ttf"},
+		{"B", "DejaVuSansCondensed-Bold.ttf"},
+		{"I", "DejaVuSansCondensed-Oblique.ttf"},
+	}
+	// scriptFontFiles are the shaping fonts for the scripts of
+	// supportedLanguages other than Latin.
+	scriptFontFiles = map[language.Script][]pdfFontFile{
+		language.Devanagari: {{"", "NotoSansDevanagari-Regular.ttf"}, {"B", "NotoSansDevanagari-Bold.ttf"}},
+		language.Gurmukhi:   {{"", "NotoSansGurmukhi-Regular.ttf"}, {"B", "NotoSansGurmukhi-Bold.ttf"}},
+		language.Bengali:    {{"", "NotoSansBengali-Regular.ttf"}, {"B", "NotoSansBengali-Bold.ttf"}},
+		language.Tamil:      {{"", "NotoSansTamil-Regular.ttf"}, {"B", "NotoSansTamil-Bold.ttf"}},
+		language.Telugu:     {{"", "NotoSansTelugu-Regular.ttf"}, {"B", "NotoSansTelugu-Bold.ttf"}},
+		language.Gujarati:   {{"", "NotoSansGujarati-Regular.ttf"}, {"B", "NotoSansGujarati-Bold.ttf"}},
+		language.Kannada:    {{"", "NotoSansKannada-Regular.ttf"}, {"B", "NotoSansKannada-Bold.ttf"}},
+		language.Oriya:      {{"", "NotoSansOriya-Regular.ttf"}, {"B", "NotoSansOriya-Bold.ttf"}},
+	}
+
+	// bundledFonts are the fonts checked in to fonts/, used when PDF_FONT_DIR
+	// does not have the file.
+	//go:embed fonts/*.ttf
+	bundledFonts embed.FS
+
+	// pdfLatinFonts holds the raw TTF bytes handed to gofpdf per style.
+	pdfLatinFonts = map[string][]byte{}
+	// pdfFaces holds parsed faces for shaping, keyed by script then style.
+	pdfFaces = map[language.Script]map[string]*font.Face{}
+
+	pdfShaper shaping.HarfbuzzShaper
+)
+
+func loadPDFFonts() {
+	dir := os.Getenv("PDF_FONT_DIR")
+	if dir == "" {
+		dir = "fonts"
+	}
+
+	load := func(script language.Script, files []pdfFontFile, keepBytes bool) {
+		for _, f := range files {
+			data, err := os.ReadFile(filepath.Join(dir, f.file))
+			if errors.Is(err, fs.ErrNotExist) {
+				data, err = bundledFonts.ReadFile("fonts/" + f.file)
+			}
+			if err != nil {
+				log.Printf("Warning: PDF font %s not loaded: %v", f.file, err)
+				continue
+			}
+			face, err := font.ParseTTF(bytes.NewReader(data))
+			if err != nil {
+				log.Printf("Warning: error parsing PDF font %s: %v", f.file, err)
+				continue
+			}
+			if keepBytes {
+				pdfLatinFonts[f.style] = data
+			}
+			if pdfFaces[script] == nil {
+				pdfFaces[script] = map[string]*font.Face{}
+			}
+			pdfFaces[script][f.style] = face
+		}
+	}
+
+	load(language.Latin, latinFontFiles, true)
+	for _, script := range pdfScripts()[1:] {
+		load(script, scriptFontFiles[script], false)
+	}
+
+	// Every language offered gets its PDF, so every script needs a regular
+	// face; the fonts are bundled, so a missing one is a broken build
+	for _, script := range pdfScripts() {
+		if pdfFaces[script][""] == nil {
+			log.Fatalf("Error loading PDF fonts: no regular font for script %s", script)
+		}
+	}
+}
+
+// pdfScripts lists Latin followed by the scripts of supportedLanguages, in
+// the order fonts are tried for runes outside a script's own font.
+func pdfScripts() []language.Script {
+	scripts := []language.Script{language.Latin}
+	seen := map[language.Script]bool{language.Latin: true}
+	for _, l := range supportedLanguages {
+		if !seen[l.Script] {
+			seen[l.Script] = true
+			scripts = append(scripts, l.Script)
+		}
+	}
+	return scripts
+}
+
+// pdfFontmap picks a face per rune: the script's own font first, then
+// whichever loaded font covers the rune.
+type pdfFontmap struct {
+	style string
+}
+
+func (m pdfFontmap) face(script language.Script) *font.Face {
+	faces := pdfFaces[script]
+	if faces == nil {
+		return nil
+	}
+	if f := faces[m.style]; f != nil {
+		return f
+	}
+	return faces[""]
+}
+
+func (m pdfFontmap) ResolveFace(r rune) *font.Face {
+	if f := m.face(language.LookupScript(r)); f != nil {
+		if _, ok := f.NominalGlyph(r); ok {
+			return f
+		}
+	}
+	for _, script := range pdfScripts() {
+		if f := m.face(script); f != nil {
+			if _, ok := f.NominalGlyph(r); ok {
+				return f
+			}
+		}
+	}
+	return m.face(language.Latin)
+}
+
+// needsShaping reports whether text contains a script gofpdf cannot lay out.
+func needsShaping(text string) bool {
+	for _, r := range text {
+		if unicode.In(r, unicode.Devanagari, unicode.Gurmukhi, unicode.Bengali, unicode.Tamil,
+			unicode.Telugu, unicode.Gujarati, unicode.Kannada, unicode.Oriya, unicode.Malayalam) {
+			return true
+		}
+	}
+	return false
+}
+
+// pdfDoc wraps gofpdf with the current style and the page-break and wrapping
+// logic shared by both text paths.
+type pdfDoc struct {
+	*gofpdf.Fpdf
+	lang    string
+	style   string
+	size    float64 // points
+	r, g, b int
+}
+
+func newPDFDoc(lang string) *pdfDoc {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	for style, data := range pdfLatinFonts {
+		pdf.AddUTF8FontFromBytes(pdfFontFamily, style, data)
+	}
+	doc := &pdfDoc{Fpdf: pdf, lang: lang}
+	doc.setFont("", 11)
+	return doc
+}
+
+func (d *pdfDoc) setFont(style string, size float64) {
+	d.style, d.size = style, size
+	if _, ok := pdfLatinFonts[style]; ok {
+		d.SetFont(pdfFontFamily, style, size)
+	} else {
+		d.SetFont(pdfFontFamily, "", size)
+	}
+}
+
+func (d *pdfDoc) setTextColor(r, g, b int) {
+	d.r, d.g, d.b = r, g, b
+	d.SetTextColor(r, g, b)
+}
+
+func (d *pdfDoc) shape(text string) []shaping.Output {
+	runes := []rune(text)
+	input := shaping.Input{
+		Text:      runes,
+		RunStart:  0,
+		RunEnd:    len(runes),
+		Direction: di.DirectionLTR,
+		Size:      fixed.Int26_6(d.size * 64),
+	}
+	var seg shaping.Segmenter
+	var outs []shaping.Output
+	for _, in := range seg.Split(input, pdfFontmap{style: d.style}) {
+		if in.Face == nil {
+			continue
+		}
+		outs = append(outs, pdfShaper.Shape(in))
+	}
+	return outs
+}
+
+// textWidth returns the width of a single line of text in mm.
+func (d *pdfDoc) textWidth(text string) float64 {
+	if !needsShaping(text) {
+		return d.GetStringWidth(text)
+	}
+	var adv fixed.Int26_6
+	for _, out := range d.shape(text) {
+		adv += out.Advance
+	}
+	return float64(adv) / 64 * ptToMM
+}
+
+// drawText draws one line of text with its baseline at y.
+func (d *pdfDoc) drawText(x, y float64, text string) {
+	if !needsShaping(text) {
+		d.Text(x, y, text)
+		return
+	}
+
+	d.SetFillColor(d.r, d.g, d.b)
+	pen := x
+	for _, out := range d.shape(text) {
+		scale := d.size / float64(out.Face.Upem()) * ptToMM
+		for _, g := range out.Glyphs {
+			gx := pen + float64(g.XOffset)/64*ptToMM
+			gy := y - float64(g.YOffset)/64*ptToMM
+			if outline, ok := out.Face.GlyphData(g.GlyphID).(font.GlyphOutline); ok && len(outline.Segments) > 0 {
+				d.drawOutline(outline, gx, gy, scale)
+			}
+			pen += float64(g.XAdvance) / 64 * ptToMM
+		}
+	}
+}
+
+func (d *pdfDoc) drawOutline(outline font.GlyphOutline, x, y, scale float64) {
+	px := func(p ot.SegmentPoint) (float64, float64) {
+		return x + float64(p.X)*scale, y - float64(p.Y)*scale
+	}
+	started := false
+	for _, seg := range outline.Segments {
+		switch seg.Op {
+		case ot.SegmentOpMoveTo:
+			if started {
+				d.ClosePath()
+			}
+			d.MoveTo(px(seg.Args[0]))
+			started = true
+		case ot.SegmentOpLineTo:
+			d.LineTo(px(seg.Args[0]))
+		case ot.SegmentOpQuadTo:
+			cx, cy := px(seg.Args[0])
+			ex, ey := px(seg.Args[1])
+			d.CurveTo(cx, cy, ex, ey)
+		case ot.SegmentOpCubeTo:
+			c0x, c0y := px(seg.Args[0])
+			c1x, c1y := px(seg.Args[1])
+			ex, ey := px(seg.Args[2])
+			d.CurveBezierCubicTo(c0x, c0y, c1x, c1y, ex, ey)
+		}
+	}
+	if started {
+		d.ClosePath()
+		d.DrawPath("f")
+	}
+}
+
+// wrap splits text into lines no wider than width mm, breaking at spaces and
+// splitting over-long words (URLs) only when they are not shaped text.
+func (d *pdfDoc) wrap(text string, width float64) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if d.textWidth(candidate) <= width {
+				line = candidate
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			for !needsShaping(word) && d.textWidth(word) > width {
+				runes := []rune(word)
+				n := len(runes) - 1
+				for n > 1 && d.textWidth(string(runes[:n])) > width {
+					n--
+				}
+				lines = append(lines, string(runes[:n]))
+				word = string(runes[n:])
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// ensureSpace starts a new page when h mm would run past the bottom margin.
+func (d *pdfDoc) ensureSpace(h float64) {
+	_, pageH := d.GetPageSize()
+	_, _, _, bottom := d.GetMargins()
+	if d.GetY()+h > pageH-bottom {
+		d.AddPage()
+	}
+}
+
+// paragraph writes wrapped text at x within width, moving the cursor down.
+func (d *pdfDoc) paragraph(x, width, lineH float64, text string) {
+	for _, line := range d.wrap(text, width) {
+		d.ensureSpace(lineH)
+		y := d.GetY()
+		d.drawText(x, y+lineH*0.7, line)
+		d.SetY(y + lineH)
+	}
+}
+
+// heading writes a single bold line.
+func (d *pdfDoc) heading(size, lineH float64, text string) {
+	d.setFont("B", size)
+	left, _, right, _ := d.GetMargins()
+	pageW, _ := d.GetPageSize()
+	d.paragraph(left, pageW-left-right, lineH, text)
+	d.setFont("", 11)
+}
+
+// labelValue writes a label column and a wrapped value column side by side.
+func (d *pdfDoc) labelValue(label, value string, labelW, lineH float64) {
+	left, _, right, _ := d.GetMargins()
+	pageW, _ := d.GetPageSize()
+	valueW := pageW - left - right - labelW
+
+	labelLines := d.wrap(label, labelW-2)
+	valueLines := d.wrap(value, valueW)
+	rows := len(valueLines)
+	if len(labelLines) > rows {
+		rows = len(labelLines)
+	}
+
+	for i := 0; i < rows; i++ {
+		d.ensureSpace(lineH)
+		y := d.GetY()
+		if i < len(labelLines) {
+			d.drawText(left, y+lineH*0.7, labelLines[i])
+		}
+		if i < len(valueLines) {
+			d.drawText(left+labelW, y+lineH*0.7, valueLines[i])
+		}
+		d.SetY(y + lineH)
+	}
+}
+
+// withState runs fn and restores the style and colour tracked by pdfDoc, for
+// header and footer callbacks that run in the middle of other output.
+func (d *pdfDoc) withState(fn func()) {
+	style, size := d.style, d.size
+	r, g, b := d.r, d.g, d.b
+	fn()
+	d.setFont(style, size)
+	d.setTextColor(r, g, b)
+}
+
+// table draws a bordered table with wrapped cells. The header row is repeated
+// at the top of every page the table continues onto.
+func (d *pdfDoc) table(headers []string, widths []float64, rows [][]string, lineH float64) {
+	left, _, _, _ := d.GetMargins()
+
+	drawRow := func(cells []string, header bool) {
+		wrapped := make([][]string, len(cells))
+		lines := 1
+		for i, cell := range cells {
+			wrapped[i] = d.wrap(cell, widths[i]-2)
+			if len(wrapped[i]) > lines {
+				lines = len(wrapped[i])
+			}
+		}
+		h := float64(lines)*lineH + 2
+
+		y := d.GetY()
+		x := left
+		for i := range cells {
+			if header {
+				d.SetFillColor(230, 236, 250)
+				d.Rect(x, y, widths[i], h, "FD")
+			} else {
+				d.Rect(x, y, widths[i], h, "D")
+			}
+			for j, line := range wrapped[i] {
+				d.drawText(x+1, y+1+float64(j)*lineH+lineH*0.7, line)
+			}
+			x += widths[i]
+		}
+		d.SetY(y + h)
+	}
+
+	d.setFont("B", d.size)
+	d.ensureSpace(2*lineH + 2)
+	drawRow(headers, true)
+	d.setFont("", d.size)
+
+	for _, row := range rows {
+		page := d.PageNo()
+		wrappedLines := 1
+		for i, cell := range row {
+			if n := len(d.wrap(cell, widths[i]-2)); n > wrappedLines {
+				wrappedLines = n
+			}
+		}
+		d.ensureSpace(float64(wrappedLines)*lineH + 2)
+		if d.PageNo() != page {
+			d.setFont("B", d.size)
+			drawRow(headers, true)
+			d.setFont("", d.size)
+		}
+		drawRow(row, false)
+	}
+}
+
+// image places a registered JPEG or PNG at the left margin, scaled to fit
+// within maxW x maxH mm while keeping its aspect ratio.
+func (d *pdfDoc) image(name, imageType string, data []byte, pxW, pxH int, maxW, maxH float64) {
+	if pxW == 0 || pxH == 0 {
+		return
+	}
+	w := maxW
+	h := w * float64(pxH) / float64(pxW)
+	if h > maxH {
+		h = maxH
+		w = h * float64(pxW) / float64(pxH)
+	}
+
+	opts := gofpdf.ImageOptions{ImageType: imageType}
+	d.RegisterImageOptionsReader(name, opts, bytes.NewReader(data))
+	d.ensureSpace(h)
+	left, _, _, _ := d.GetMargins()
+	y := d.GetY()
+	d.ImageOptions(name, left, y, w, h, false, opts, 0, "")
+	d.SetY(y + h)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PregnancySafety is one entry of data/pregnancy_safety.json. Category uses the
+// A/B/C/D/X letters still printed on most Indian drug inserts; Lactation is one
+// of "compatible", "caution" or "avoid".
+type PregnancySafety struct {
+	Name      string            `json:"name"`
+	Aliases   []string          `json:"aliases"`
+	Category  string            `json:"category"`
+	Lactation string            `json:"lactation"`
+	Notes     map[string]string `json:"notes"`
+}
+
+type SafetyWarning struct {
+	Medicine string `json:"medicine"`
+	Matched  string `json:"matched,omitempty"`
+	Status   string `json:"status"`   // "pregnant" or "lactating"
+	Category string `json:"category"` // pregnancy letter or lactation level, empty if unknown
+	Level    string `json:"level"`    // "danger", "caution" or "info"
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+}
+
+var (
+	pregnancySafetyList []PregnancySafety
+	nonWordChars        = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+func loadPregnancySafety(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: pregnancy safety data not loaded: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, &pregnancySafetyList); err != nil {
+		log.Printf("Warning: error parsing pregnancy safety data: %v", err)
+	}
+}
+
+// normalizeMedicineName lowercases a name and collapses punctuation so that
+// "Dolo-650 mg" and "dolo 650mg" compare as whole words.
+func normalizeMedicineName(name string) string {
+	return " " + strings.TrimSpace(nonWordChars.ReplaceAllString(strings.ToLower(name), " ")) + " "
+}
+
+// findPregnancySafety looks up the first of names that is in the dataset.
+// Analyses in other languages may write the medicine's name in their own
+// script, so callers pass the untranslated generic name first.
+func findPregnancySafety(names ...string) (PregnancySafety, bool) {
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		norm := normalizeMedicineName(name)
+		for _, entry := range pregnancySafetyList {
+			for _, candidate := range append([]string{entry.Name}, entry.Aliases...) {
+				if strings.Contains(norm, normalizeMedicineName(candidate)) {
+					return entry, true
+				}
+			}
+		}
+	}
+	return PregnancySafety{}, false
+}
+
+// checkPregnancySafety returns the safety verdict for one medicine for a
+// pregnant or lactating person, translated into lang. generic is the
+// medicine's generic name in English when the analysis gives one.
+func checkPregnancySafety(medicine, generic, status, lang string) SafetyWarning {
+	warning := SafetyWarning{Medicine: medicine, Status: status}
+	entry, found := findPregnancySafety(generic, medicine)
+
+	if status == "lactating" {
+		warning.Title = translate(lang, "safety.lactation_title")
+	} else {
+		warning.Title = translate(lang, "safety.pregnancy_title")
+	}
+
+	if !found {
+		warning.Level = "caution"
+		warning.Message = translate(lang, "safety.unknown_message", map[string]string{"medicine": medicine})
+		return warning
+	}
+
+	notes := entry.Notes[lang]
+	if notes == "" {
+		notes = entry.Notes["en"]
+	}
+	warning.Matched = entry.Name
+
+	if status == "lactating" {
+		warning.Category = entry.Lactation
+		switch entry.Lactation {
+		case "avoid":
+			warning.Level = "danger"
+		case "caution":
+			warning.Level = "caution"
+		default:
+			warning.Level = "info"
+		}
+		warning.Message = translate(lang, "safety.lactation_message", map[string]string{
+			"medicine":    medicine,
+			"description": translate(lang, "safety.lactation."+entry.Lactation),
+			"notes":       notes,
+		})
+		return warning
+	}
+
+	warning.Category = entry.Category
+	switch entry.Category {
+	case "X", "D":
+		warning.Level = "danger"
+	case "C":
+		warning.Level = "caution"
+	default:
+		warning.Level = "info"
+	}
+	warning.Message = translate(lang, "safety.pregnancy_message", map[string]string{
+		"medicine":    medicine,
+		"category":    entry.Category,
+		"description": translate(lang, "safety.category."+entry.Category),
+		"notes":       notes,
+	})
+	return warning
+}
+
+// pregnancyStatuses lists which checks apply to the user's profile.
+func pregnancyStatuses(user User) []string {
+	var statuses []string
+	if user.Pregnant {
+		statuses = append(statuses, "pregnant")
+	}
+	if user.Lactating {
+		statuses = append(statuses, "lactating")
+	}
+	return statuses
+}
+
+// pregnancyWarnings checks every medicine in a stored analysis against the
+// user's pregnancy/lactation status and returns the non-informational results.
+func pregnancyWarnings(user User, analysis, lang string) []SafetyWarning {
+	statuses := pregnancyStatuses(user)
+	if len(statuses) == 0 {
+		return nil
+	}
+
+	var parsed struct {
+		Medicines []struct {
+			Name        string `json:"name"`
+			GenericName string `json:"generic_name"`
+		} `json:"medicines"`
+	}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(analysis)), &parsed); err != nil {
+		log.Printf("Error parsing analysis for pregnancy check: %v", err)
+		return nil
+	}
+
+	var warnings []SafetyWarning
+	for _, med := range parsed.Medicines {
+		if med.Name == "" {
+			continue
+		}
+		for _, status := range statuses {
+			if w := checkPregnancySafety(med.Name, med.GenericName, status, lang); w.Level != "info" {
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	return warnings
+}
+
+// userPregnancyWarnings loads the user's profile and runs pregnancyWarnings.
+func userPregnancyWarnings(username, analysis, lang string) []SafetyWarning {
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		log.Printf("Error loading user profile for pregnancy check: %v", err)
+		return nil
+	}
+	return pregnancyWarnings(user, analysis, lang)
+}
+
+// pregnancySafetyHandler is the standalone lookup used during counselling:
+// GET /pregnancy-safety?medicine=...&status=pregnant|lactating&lang=hi
+func pregnancySafetyHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	medicine := strings.TrimSpace(r.URL.Query().Get("medicine"))
+	if medicine == "" {
+		httpError(w, r, "medicine_required", http.StatusBadRequest)
+		return
+	}
+
+	statuses := []string{"pregnant", "lactating"}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case "pregnant", "lactating":
+		statuses = []string{status}
+	default:
+		httpError(w, r, "invalid_pregnancy_status", http.StatusBadRequest)
+		return
+	}
+
+	lang := r.URL.Query().Get("lang")
+	results := make([]SafetyWarning, 0, len(statuses))
+	for _, status := range statuses {
+		results = append(results, checkPregnancySafety(medicine, "", status, lang))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"medicine": medicine, "results": results})
+}
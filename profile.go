@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ProfileRequest is a profile update; a field left out is not changed, so a
+// client setting only the phone cannot clear the pregnancy flag or allergies.
+type ProfileRequest struct {
+	Pregnant  *bool     `json:"pregnant"`
+	Lactating *bool     `json:"lactating"`
+	Allergies *[]string `json:"allergies"`
+	Phone     *string   `json:"phone"` // nil leaves the SMS number alone, "" unlinks it
+}
+
+// changes returns the $set for the health fields that were sent.
+func (req ProfileRequest) changes() bson.M {
+	set := bson.M{}
+	if req.Pregnant != nil {
+		set["pregnant"] = *req.Pregnant
+	}
+	if req.Lactating != nil {
+		set["lactating"] = *req.Lactating
+	}
+	if req.Allergies != nil {
+		set["allergies"] = cleanAllergies(*req.Allergies)
+	}
+	return set
+}
+
+// cleanAllergies trims entries and drops blanks and case-insensitive duplicates.
+func cleanAllergies(allergies []string) []string {
+	cleaned := []string{}
+	seen := map[string]bool{}
+	for _, allergy := range allergies {
+		allergy = strings.TrimSpace(allergy)
+		key := strings.ToLower(allergy)
+		if allergy == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		cleaned = append(cleaned, allergy)
+	}
+	return cleaned
+}
+
+// profileHandler returns (GET) or updates (POST) the health profile fields
+// that change how analyses are checked.
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req ProfileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+
+		if set := req.changes(); len(set) > 0 {
+			_, err := usersColl.UpdateOne(context.Background(), bson.M{"username": username}, bson.M{"$set": set})
+			if err != nil {
+				log.Printf("Error updating profile: %v", err)
+				httpError(w, r, "update_profile_failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		if req.Phone != nil {
+			if err := setPhone(username, *req.Phone); err == errInvalidPhone {
+				httpError(w, r, "invalid_phone", http.StatusBadRequest)
+				return
+			} else if err != nil {
+				log.Printf("Error updating phone: %v", err)
+				httpError(w, r, "update_profile_failed", http.StatusInternalServerError)
+				return
+			}
+		}
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		httpError(w, r, "fetch_profile_failed", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"username":               user.Username,
+		"pregnant":               user.Pregnant,
+		"lactating":              user.Lactating,
+		"allergies":              cleanAllergies(user.Allergies),
+		"language":               user.Language,
+		"deletion_scheduled_for": user.DeletionScheduledFor,
+	}
+	// The SMS number is only offered when the channel is set up
+	if os.Getenv("SMS_WEBHOOK_TOKEN") != "" && os.Getenv("SMS_NUMBER") != "" {
+		response["sms_number"] = os.Getenv("SMS_NUMBER")
+		response["phone"] = user.Phone
+		if user.PhoneLink != nil && time.Now().Before(user.PhoneLink.ExpiresAt) {
+			response["phone_link"] = user.PhoneLink
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
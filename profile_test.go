@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestProfileChangesOnlySentFields(t *testing.T) {
+	tests := []struct {
+		body string
+		want bson.M
+	}{
+		{`{"phone": "+919800000001"}`, bson.M{}},
+		{`{"pregnant": false}`, bson.M{"pregnant": false}},
+		{`{"lactating": true, "allergies": [" Penicillin", "penicillin", ""]}`,
+			bson.M{"lactating": true, "allergies": []string{"Penicillin"}}},
+		{`{"allergies": []}`, bson.M{"allergies": []string{}}},
+	}
+	for _, tt := range tests {
+		var req ProfileRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.changes(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: $set %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Prompts live in prompts/<name>.v<N>.tmpl (or PROMPTS_DIR) as text/template
+// files. The highest version of each prompt is used unless PROMPT_VERSIONS
+// pins one ("prescription_analysis=1,chat=2"). The directory is re-read when
+// a file changes or the server receives SIGHUP, so prompts can be edited
+// without a restart; a template that fails to parse leaves the previous set
+// in use.
+
+const promptPollInterval = 10 * time.Second
+
+// Prompt names
+const (
+	promptPrescriptionAnalysis = "prescription_analysis"
+	promptChat                 = "chat"
+	promptDiseasePrediction    = "disease_prediction"
+	promptVoiceChat            = "voice_chat"
+	promptVoiceDisease         = "voice_disease_prediction"
+)
+
+// requiredPrompts must all have a template, at startup and on every reload.
+var requiredPrompts = []string{promptPrescriptionAnalysis, promptChat, promptDiseasePrediction, promptVoiceChat, promptVoiceDisease}
+
+var promptFilePattern = regexp.MustCompile(`^([a-z0-9_]+)\.v([0-9]+)\.tmpl$`)
+
+type promptTemplate struct {
+	name     string
+	version  int
+	template *template.Template
+}
+
+// Label identifies the prompt on stored records, e.g. "chat.v2".
+func (p *promptTemplate) Label() string {
+	return fmt.Sprintf("%s.v%d", p.name, p.version)
+}
+
+// AnalysisPromptData is what prescription_analysis templates can use.
+type AnalysisPromptData struct {
+	Language     string // English name, e.g. "Hindi"
+	LanguageCode string
+	Profile      PromptProfile
+}
+
+// ChatPromptData is what chat templates can use.
+type ChatPromptData struct {
+	Message      string
+	Language     string
+	LanguageCode string
+}
+
+// DiseasePromptData is what disease_prediction templates can use: .Age,
+// .Gender, .Symptoms and .MedicalHistory from the request, and the language.
+type DiseasePromptData struct {
+	DiseasePredictionRequest
+	Language     string
+	LanguageCode string
+}
+
+// VoicePromptData is what voice_chat and voice_disease_prediction templates
+// can use. The question is the attached recording; Language is the user's
+// preferred language, for when the spoken one cannot be told. Age, Gender
+// and MedicalHistory are only set for disease prediction.
+type VoicePromptData struct {
+	Language       string
+	LanguageCode   string
+	Age            string
+	Gender         string
+	MedicalHistory string
+}
+
+type PromptProfile struct {
+	Pregnant  bool
+	Lactating bool
+	Allergies []string
+}
+
+var (
+	promptsMu   sync.RWMutex
+	prompts     map[string]*promptTemplate
+	promptsDir  string
+	promptsSeen string
+)
+
+func loadPrompts() {
+	promptsDir = os.Getenv("PROMPTS_DIR")
+	if promptsDir == "" {
+		promptsDir = "prompts"
+	}
+	if err := reloadPrompts(); err != nil {
+		log.Fatalf("Error loading prompt templates: %v", err)
+	}
+}
+
+// promptFiles lists the template files with their modification times, which
+// is also how the watcher notices changes.
+func promptFiles() ([]string, string, error) {
+	files, err := filepath.Glob(filepath.Join(promptsDir, "*.tmpl"))
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(files)
+	var stamp strings.Builder
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d;", f, info.ModTime().UnixNano(), info.Size())
+	}
+	return files, stamp.String(), nil
+}
+
+func reloadPrompts() error {
+	files, stamp, err := promptFiles()
+	if err != nil {
+		return err
+	}
+
+	pinned := map[string]int{}
+	for _, entry := range strings.Split(os.Getenv("PROMPT_VERSIONS"), ",") {
+		name, version, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(version), "v"))
+		if err != nil {
+			return fmt.Errorf("PROMPT_VERSIONS: invalid version %q for %s", version, name)
+		}
+		pinned[strings.TrimSpace(name)] = n
+	}
+
+	loaded := map[string]*promptTemplate{}
+	for _, f := range files {
+		m := promptFilePattern.FindStringSubmatch(filepath.Base(f))
+		if m == nil {
+			log.Printf("Warning: ignoring prompt file %s, expected <name>.v<N>.tmpl", f)
+			continue
+		}
+		name := m[1]
+		version, _ := strconv.Atoi(m[2])
+		if want, ok := pinned[name]; ok && version != want {
+			continue
+		}
+		if current, ok := loaded[name]; ok && current.version > version {
+			continue
+		}
+
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(filepath.Base(f)).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return err
+		}
+		loaded[name] = &promptTemplate{name: name, version: version, template: tmpl}
+	}
+	for name, version := range pinned {
+		if p, ok := loaded[name]; !ok || p.version != version {
+			return fmt.Errorf("PROMPT_VERSIONS pins %s to v%d, but %s.v%d.tmpl was not found", name, version, name, version)
+		}
+	}
+	// A reload that lost a prompt would break every request using it, so
+	// it is refused the same as a broken file
+	for _, name := range requiredPrompts {
+		if _, ok := loaded[name]; !ok {
+			return fmt.Errorf("no %s template in %s", name, promptsDir)
+		}
+	}
+
+	promptsMu.Lock()
+	prompts = loaded
+	promptsSeen = stamp
+	promptsMu.Unlock()
+
+	var labels []string
+	for _, p := range loaded {
+		labels = append(labels, p.Label())
+	}
+	sort.Strings(labels)
+	log.Printf("Prompt templates loaded: %s", strings.Join(labels, ", "))
+	return nil
+}
+
+// watchPrompts reloads the templates when a file in the directory changes
+// and on SIGHUP.
+func watchPrompts() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(promptPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			_, stamp, err := promptFiles()
+			promptsMu.RLock()
+			unchanged := stamp == promptsSeen
+			promptsMu.RUnlock()
+			if err == nil && unchanged {
+				continue
+			}
+		}
+		if err := reloadPrompts(); err != nil {
+			log.Printf("Error reloading prompt templates, keeping the previous ones: %v", err)
+			// Don't retry the same broken files every poll
+			_, stamp, _ := promptFiles()
+			promptsMu.Lock()
+			promptsSeen = stamp
+			promptsMu.Unlock()
+		}
+	}
+}
+
+// renderPrompt fills in the current version of a prompt and returns the
+// text along with the version label to store with the result.
+func renderPrompt(name string, data interface{}) (string, string, error) {
+	promptsMu.RLock()
+	p, ok := prompts[name]
+	promptsMu.RUnlock()
+	if !ok {
+		return "", "", fmt.Errorf("no prompt template %q", name)
+	}
+
+	var text strings.Builder
+	if err := p.template.Execute(&text, data); err != nil {
+		return "", "", fmt.Errorf("rendering %s: %w", p.Label(), err)
+	}
+	return strings.TrimSpace(text.String()), p.Label(), nil
+}
+
+// promptProfile loads the parts of the health profile prompts may use.
+func promptProfile(username string) PromptProfile {
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		log.Printf("Error loading profile for prompt: %v", err)
+		return PromptProfile{}
+	}
+	return PromptProfile{
+		Pregnant:  user.Pregnant,
+		Lactating: user.Lactating,
+		Allergies: cleanAllergies(user.Allergies),
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AI usage is counted in ai_usage, one document per user, organization or
+// phone number and per day or month (UTC), e.g. "user:asha:day:2026-10-18".
+// Counters expire a day after their period ends.
+
+var aiUsageColl *mongo.Collection
+
+type quotaPeriod struct {
+	Name     string
+	Limit    int64
+	Key      string
+	ResetsAt time.Time
+}
+
+// quotaUsage is the result of charging one AI call to a quota.
+type quotaUsage struct {
+	Exceeded string // "daily" or "monthly" when the call was refused
+	Limit    int64
+	ResetsAt time.Time
+	charged  []string
+}
+
+func ensureQuotaIndexes() error {
+	_, err := aiUsageColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// quotaFor returns the quota that applies to username and the counter it is
+// charged to. Members of an organization with its own quota share it.
+func quotaFor(username string) (string, string, AIQuota, error) {
+	var user User
+	err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", "", AIQuota{}, err
+	}
+	if quota, ok := limits.Quotas.Organizations[user.Organization]; ok && user.Organization != "" {
+		return "organization", "org:" + user.Organization, quota, nil
+	}
+	if quota, ok := limits.Quotas.Users[username]; ok {
+		return "user", "user:" + username, quota, nil
+	}
+	return "user", "user:" + username, limits.Quotas.Default, nil
+}
+
+func quotaPeriods(counter string, quota AIQuota, now time.Time) []quotaPeriod {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []quotaPeriod{
+		{Name: "daily", Limit: quota.Daily, Key: counter + ":day:" + day.Format("2006-01-02"), ResetsAt: day.AddDate(0, 0, 1)},
+		{Name: "monthly", Limit: quota.Monthly, Key: counter + ":month:" + month.Format("2006-01"), ResetsAt: month.AddDate(0, 1, 0)},
+	}
+}
+
+// consumeAIQuota charges one AI call to username's daily and monthly quotas.
+// A counter only goes up while it is below its limit; once it is full the
+// upsert collides with the existing document and the call is refused.
+func consumeAIQuota(username string) (quotaUsage, error) {
+	_, counter, quota, err := quotaFor(username)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+	return consumeQuota(counter, quota)
+}
+
+// consumeQuota charges one AI call to counter's daily and monthly periods.
+func consumeQuota(counter string, quota AIQuota) (quotaUsage, error) {
+	var usage quotaUsage
+	for _, period := range quotaPeriods(counter, quota, time.Now()) {
+		if period.Limit <= 0 {
+			continue
+		}
+		_, err := aiUsageColl.UpdateOne(context.Background(),
+			bson.M{"_id": period.Key, "count": bson.M{"$lt": period.Limit}},
+			bson.M{
+				"$inc":         bson.M{"count": 1},
+				"$setOnInsert": bson.M{"expires_at": period.ResetsAt.Add(24 * time.Hour)},
+			},
+			options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			usage.refund()
+			return quotaUsage{Exceeded: period.Name, Limit: period.Limit, ResetsAt: period.ResetsAt}, nil
+		}
+		if err != nil {
+			usage.refund()
+			return quotaUsage{}, err
+		}
+		usage.charged = append(usage.charged, period.Key)
+	}
+	return usage, nil
+}
+
+// refund gives back a call that did not reach the AI model.
+func (u *quotaUsage) refund() {
+	for _, key := range u.charged {
+		_, err := aiUsageColl.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{"$inc": bson.M{"count": -1}})
+		if err != nil {
+			log.Printf("Error refunding AI quota %s: %v", key, err)
+		}
+	}
+	u.charged = nil
+}
+
+// quotaHandler shows the logged-in user's remaining AI quota and the rate
+// limits of each endpoint: GET /quota
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scope, counter, quota, err := quotaFor(username)
+	if err != nil {
+		log.Printf("Error fetching quota: %v", err)
+		httpError(w, r, "fetch_quota_failed", http.StatusInternalServerError)
+		return
+	}
+
+	periods := quotaPeriods(counter, quota, time.Now())
+	var keys []string
+	for _, period := range periods {
+		keys = append(keys, period.Key)
+	}
+	cursor, err := aiUsageColl.Find(context.Background(), bson.M{"_id": bson.M{"$in": keys}})
+	var counters []struct {
+		Key   string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err == nil {
+		err = cursor.All(context.Background(), &counters)
+	}
+	if err != nil {
+		log.Printf("Error fetching AI usage: %v", err)
+		httpError(w, r, "fetch_quota_failed", http.StatusInternalServerError)
+		return
+	}
+	used := map[string]int64{}
+	for _, c := range counters {
+		used[c.Key] = c.Count
+	}
+
+	response := map[string]interface{}{"scope": scope}
+	if scope == "organization" {
+		response["organization"] = counter[len("org:"):]
+	}
+	for _, period := range periods {
+		entry := map[string]interface{}{
+			"used":      used[period.Key],
+			"resets_at": period.ResetsAt,
+		}
+		if period.Limit > 0 {
+			entry["limit"] = period.Limit
+			entry["remaining"] = max(period.Limit-used[period.Key], 0)
+		} else {
+			entry["limit"] = nil
+			entry["remaining"] = nil
+		}
+		response[period.Name] = entry
+	}
+	response["rate_limits"] = limits.RateLimits
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits are read from data/limits.json (or LIMITS_FILE). Rate limits are
+// token buckets per endpoint, keyed by user, by client IP and, for SMS and
+// WhatsApp, by phone number, written as "count/unit" with unit s, min, h or
+// day; an empty value means no limit. Quotas cap the paid AI calls a user, or
+// a whole organization, can make per day and per month, and phone numbers
+// have their own; 0 means unlimited.
+
+type EndpointRateLimit struct {
+	User  string `json:"user"`
+	IP    string `json:"ip"`
+	Phone string `json:"phone,omitempty"`
+}
+
+type AIQuota struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+type LimitsConfig struct {
+	RateLimits map[string]EndpointRateLimit `json:"rate_limits"`
+	Quotas     struct {
+		Default       AIQuota            `json:"default"`
+		Users         map[string]AIQuota `json:"users"`
+		Organizations map[string]AIQuota `json:"organizations"`
+
+		// Per phone number for the SMS and WhatsApp channels: Phones
+		// overrides SMS for one number, and SMS defaults to Default
+		SMS    *AIQuota           `json:"sms,omitempty"`
+		Phones map[string]AIQuota `json:"phones,omitempty"`
+	} `json:"quotas"`
+}
+
+type rateSpec struct {
+	count  int
+	period time.Duration
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	period   time.Duration
+	lastSeen time.Time
+}
+
+var (
+	limits    LimitsConfig
+	rateSpecs = map[string]rateSpec{}
+	bucketsMu sync.Mutex
+	buckets   = map[string]*bucket{}
+	lastSweep time.Time
+	rateUnits = map[string]time.Duration{
+		"s": time.Second, "sec": time.Second, "second": time.Second,
+		"m": time.Minute, "min": time.Minute, "minute": time.Minute,
+		"h": time.Hour, "hour": time.Hour,
+		"d": 24 * time.Hour, "day": 24 * time.Hour,
+	}
+)
+
+func parseRateSpec(spec string) (rateSpec, error) {
+	count, unit, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	period, known := rateUnits[strings.TrimSpace(unit)]
+	if !ok || err != nil || n <= 0 || !known {
+		return rateSpec{}, fmt.Errorf("invalid rate %q, expected e.g. \"10/min\"", spec)
+	}
+	return rateSpec{count: n, period: period}, nil
+}
+
+func loadLimits() {
+	path := os.Getenv("LIMITS_FILE")
+	if path == "" {
+		path = "data/limits.json"
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: rate limits and AI quotas not loaded: %v", err)
+		return
+	}
+	var config LimitsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Fatalf("Error parsing %s: %v", path, err)
+	}
+
+	specs := map[string]rateSpec{}
+	for endpoint, limit := range config.RateLimits {
+		for scope, spec := range map[string]string{"user": limit.User, "ip": limit.IP, "phone": limit.Phone} {
+			if spec == "" {
+				continue
+			}
+			parsed, err := parseRateSpec(spec)
+			if err != nil {
+				log.Fatalf("Error in %s, %s %s limit: %v", path, endpoint, scope, err)
+			}
+			specs[endpoint+"/"+scope] = parsed
+		}
+	}
+	limits = config
+	rateSpecs = specs
+}
+
+// takeToken reserves a request from the bucket for key. If the bucket is
+// empty it returns how long until the next request would be allowed.
+func takeToken(key string, spec rateSpec, now time.Time) (*rate.Reservation, time.Duration) {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{
+			limiter: rate.NewLimiter(rate.Every(spec.period/time.Duration(spec.count)), spec.count),
+			period:  spec.period,
+		}
+		buckets[key] = b
+	}
+	b.lastSeen = now
+	res := b.limiter.ReserveN(now, 1)
+	return res, res.DelayFrom(now)
+}
+
+// allowRequest applies the per-user and per-IP limits of endpoint. When the
+// request is refused nothing is taken from either bucket.
+func allowRequest(endpoint, username, ip string) (bool, time.Duration) {
+	return allowScopes(endpoint, map[string]string{"user": username, "ip": ip})
+}
+
+// allowScopes applies the limits of endpoint for each scope ("user", "ip",
+// "phone") to the given id, all or nothing.
+func allowScopes(endpoint string, ids map[string]string) (bool, time.Duration) {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+
+	now := time.Now()
+	sweepBuckets(now)
+
+	var taken []*rate.Reservation
+	var wait time.Duration
+	for scope, id := range ids {
+		spec, ok := rateSpecs[endpoint+"/"+scope]
+		if !ok || id == "" {
+			continue
+		}
+		res, delay := takeToken(endpoint+"/"+scope+"/"+id, spec, now)
+		taken = append(taken, res)
+		if delay > wait {
+			wait = delay
+		}
+	}
+	if wait > 0 {
+		for _, res := range taken {
+			res.CancelAt(now)
+		}
+		return false, wait
+	}
+	return true, 0
+}
+
+// sweepBuckets drops buckets that have been idle long enough to be full
+// again, so the map does not grow with every IP ever seen.
+func sweepBuckets(now time.Time) {
+	if now.Sub(lastSweep) < 10*time.Minute {
+		return
+	}
+	lastSweep = now
+	for key, b := range buckets {
+		if now.Sub(b.lastSeen) > b.period {
+			delete(buckets, key)
+		}
+	}
+}
+
+// aiResponseWriter remembers the status a handler answered with and whether
+// it answered without calling the AI model.
+type aiResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	uncharged bool
+}
+
+func (a *aiResponseWriter) WriteHeader(code int) {
+	a.status = code
+	a.ResponseWriter.WriteHeader(code)
+}
+
+// skipAIQuota tells limitAI not to count this request, e.g. when the answer
+// came from a cache.
+func skipAIQuota(w http.ResponseWriter) {
+	if a, ok := w.(*aiResponseWriter); ok {
+		a.uncharged = true
+	}
+}
+
+// formatWait renders a delay as "45 seconds", "12 minutes" or "3 hours".
+func formatWait(lang string, wait time.Duration) string {
+	switch {
+	case wait < time.Minute:
+		return translate(lang, "limits.seconds", map[string]string{"n": strconv.Itoa(int(math.Ceil(wait.Seconds())))})
+	case wait < 2*time.Hour:
+		return translate(lang, "limits.minutes", map[string]string{"n": strconv.Itoa(int(math.Ceil(wait.Minutes())))})
+	}
+	return translate(lang, "limits.hours", map[string]string{"n": strconv.Itoa(int(math.Ceil(wait.Hours())))})
+}
+
+// writeLimitError answers 429 with a Retry-After header and a message in the
+// user's language that the UI can show as is.
+func writeLimitError(w http.ResponseWriter, r *http.Request, code, messageKey string, wait time.Duration, args map[string]string) {
+	lang := requestLang(r)
+	if args == nil {
+		args = map[string]string{}
+	}
+	args["wait"] = formatWait(lang, wait)
+	seconds := int(math.Ceil(wait.Seconds()))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       code,
+		"message":     translate(lang, messageKey, args),
+		"retry_after": seconds,
+	})
+}
+
+// limitAI wraps an endpoint that calls the AI model with its rate limits and
+// the caller's AI quota. Requests the handler rejects (4xx/5xx) or answers
+// without the model are not counted against the quota.
+func limitAI(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := getLoggedInUser(r)
+
+		if ok, wait := allowRequest(endpoint, username, clientIP(r)); !ok {
+			writeLimitError(w, r, "rate_limited", "limits.rate_limited", wait, nil)
+			return
+		}
+		if username == "" {
+			// The handler rejects anonymous requests itself
+			next(w, r)
+			return
+		}
+
+		usage, err := consumeAIQuota(username)
+		if err != nil {
+			log.Printf("Error checking AI quota for %s: %v", username, err)
+			httpError(w, r, "quota_check_failed", http.StatusInternalServerError)
+			return
+		}
+		if usage.Exceeded != "" {
+			writeLimitError(w, r, "quota_exceeded", "limits.quota_"+usage.Exceeded, time.Until(usage.ResetsAt),
+				map[string]string{"limit": strconv.FormatInt(usage.Limit, 10)})
+			return
+		}
+
+		aw := &aiResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(aw, r)
+		if aw.uncharged || aw.status >= http.StatusBadRequest {
+			usage.refund()
+		}
+	}
+}
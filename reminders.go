@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Medicine reminders are worked out from the analysis. Analyses from
+// prescription_analysis.v2 on carry a schedule per medicine; for older ones
+// the times are guessed from the dosage and instructions: the "1-0-1"
+// morning-afternoon-night notation, or words such as "twice daily" or "BD".
+// Medicines whose timing cannot be told are left out.
+
+// Standard times of day for the guessed schedules
+const (
+	reminderMorning   = "08:00"
+	reminderAfternoon = "14:00"
+	reminderNight     = "20:00"
+	reminderBedtime   = "21:00"
+)
+
+var (
+	reminderTimeRe    = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])$`)
+	dosePatternRe     = regexp.MustCompile(`(?:^|[^\d.])((?:\d|½)(?:\.5)?)\s*-\s*((?:\d|½)(?:\.5)?)\s*-\s*((?:\d|½)(?:\.5)?)(?:\s*-\s*((?:\d|½)(?:\.5)?))?(?:[^\d.-]|$)`)
+	reminderDaysRe    = regexp.MustCompile(`(\d+)\s*days?`)
+	reminderFrequency = []struct {
+		re    *regexp.Regexp
+		times []string
+	}{
+		{regexp.MustCompile(`\b(four times|qid|qds)\b`), []string{"08:00", "12:00", "16:00", reminderNight}},
+		{regexp.MustCompile(`\b(three times|thrice|tds|tid)\b`), []string{reminderMorning, reminderAfternoon, reminderNight}},
+		{regexp.MustCompile(`\b(twice|two times|bd|bid)\b`), []string{reminderMorning, reminderNight}},
+		{regexp.MustCompile(`\b(at bedtime|before sleep|hs)\b`), []string{reminderBedtime}},
+		{regexp.MustCompile(`\b(once (a )?day|once daily|od|daily)\b`), []string{reminderMorning}},
+	}
+)
+
+// Reminder is one time of day and the medicines to take then.
+type Reminder struct {
+	Time  string         `json:"time"` // "HH:MM"
+	Doses []ReminderDose `json:"doses"`
+}
+
+// ReminderDose is one medicine in a reminder.
+type ReminderDose struct {
+	Medicine string `json:"medicine"`
+	Dosage   string `json:"dosage,omitempty"`
+	Food     string `json:"food,omitempty"` // "before", "after" or "with"
+	Days     int    `json:"days,omitempty"`
+}
+
+// reminderSchedule returns the reminders for a stored analysis, in time order.
+func reminderSchedule(analysis string) []Reminder {
+	var parsed struct {
+		Medicines []struct {
+			Name         string `json:"name"`
+			Dosage       string `json:"dosage"`
+			Instructions string `json:"instructions"`
+			Schedule     *struct {
+				Times []string    `json:"times"`
+				Food  string      `json:"food"`
+				Days  json.Number `json:"days"`
+			} `json:"schedule"`
+		} `json:"medicines"`
+	}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(analysis)), &parsed); err != nil {
+		log.Printf("Error parsing analysis for reminders: %v", err)
+		return []Reminder{}
+	}
+
+	byTime := map[string][]ReminderDose{}
+	for _, med := range parsed.Medicines {
+		if med.Name == "" {
+			continue
+		}
+		text := strings.ToLower(med.Dosage + " " + med.Instructions)
+		times, food, days := guessDoseTimes(text), guessFood(text), guessDays(text)
+		if s := med.Schedule; s != nil {
+			if valid := validReminderTimes(s.Times); len(valid) > 0 {
+				times = valid
+			}
+			switch strings.ToLower(s.Food) {
+			case "before", "after", "with":
+				food = strings.ToLower(s.Food)
+			}
+			if n, err := strconv.Atoi(s.Days.String()); err == nil && n > 0 {
+				days = n
+			}
+		}
+		for _, t := range times {
+			byTime[t] = append(byTime[t], ReminderDose{
+				Medicine: med.Name,
+				Dosage:   med.Dosage,
+				Food:     food,
+				Days:     days,
+			})
+		}
+	}
+
+	reminders := []Reminder{}
+	for t, doses := range byTime {
+		reminders = append(reminders, Reminder{Time: t, Doses: doses})
+	}
+	sort.Slice(reminders, func(i, j int) bool { return reminders[i].Time < reminders[j].Time })
+	return reminders
+}
+
+// validReminderTimes keeps the well-formed times, as zero-padded "HH:MM".
+func validReminderTimes(times []string) []string {
+	var valid []string
+	seen := map[string]bool{}
+	for _, t := range times {
+		m := reminderTimeRe.FindStringSubmatch(strings.TrimSpace(t))
+		if m == nil {
+			continue
+		}
+		hour, _ := strconv.Atoi(m[1])
+		t = strconv.Itoa(100 + hour)[1:] + ":" + m[2]
+		if !seen[t] {
+			seen[t] = true
+			valid = append(valid, t)
+		}
+	}
+	return valid
+}
+
+func guessDoseTimes(text string) []string {
+	if m := dosePatternRe.FindStringSubmatch(text); m != nil {
+		slots := []string{reminderMorning, reminderAfternoon, reminderNight}
+		parts := m[1:4]
+		if m[4] != "" {
+			slots = []string{reminderMorning, "13:00", "18:00", reminderBedtime}
+			parts = m[1:5]
+		}
+		var times []string
+		for i, part := range parts {
+			if part != "0" {
+				times = append(times, slots[i])
+			}
+		}
+		return times
+	}
+	for _, f := range reminderFrequency {
+		if f.re.MatchString(text) {
+			return f.times
+		}
+	}
+	return nil
+}
+
+func guessFood(text string) string {
+	switch {
+	case strings.Contains(text, "empty stomach"), strings.Contains(text, "before food"), strings.Contains(text, "before meal"):
+		return "before"
+	case strings.Contains(text, "after food"), strings.Contains(text, "after meal"):
+		return "after"
+	case strings.Contains(text, "with food"), strings.Contains(text, "with meal"):
+		return "with"
+	}
+	return ""
+}
+
+func guessDays(text string) int {
+	if m := reminderDaysRe.FindStringSubmatch(text); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// formatLocalDate formats t with the month names and ordering from the
+// "pdf" section of the locale files.
+func formatLocalDate(lang string, t time.Time) string {
+	return translate(lang, "pdf.date_format", map[string]string{
+		"day":   strconv.Itoa(t.Day()),
+		"month": translate(lang, fmt.Sprintf("pdf.months.%d", int(t.Month()))),
+		"year":  strconv.Itoa(t.Year()),
+		"time":  t.Format("15:04"),
+	})
+}
+
+// reportLabel returns a translated label with exactly one trailing colon, so
+// keys shared with the dashboard ("Dosage", "Date:") read the same in the PDF.
+func reportLabel(lang, key string) string {
+	return strings.TrimRight(translate(lang, key), ":： ") + ":"
+}
+
+// analysisText renders a value from the analysis JSON, hiding missing fields.
+func analysisText(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// ReportAssets are the optional extras drawn on a report: the original upload
+// and the verification link encoded in the QR code.
+type ReportAssets struct {
+	Image     []byte
+	VerifyURL string
+}
+
+// renderPrescriptionReport lays out the analysis report in the given language.
+func renderPrescriptionReport(prescription Prescription, analysis map[string]interface{}, lang string, assets ReportAssets) *pdfDoc {
+	pdf := newPDFDoc(lang)
+	pdf.SetAutoPageBreak(false, 20)
+	pdf.AliasNbPages("")
+	left, _, right, _ := pdf.GetMargins()
+	pageW, pageH := pdf.GetPageSize()
+	contentW := pageW - left - right
+	digest := analysisDigest(prescription.Analysis)
+	generated := formatLocalDate(lang, time.Now())
+
+	// Items read with low confidence carry a mark pointing to the advice
+	confidence := analysisConfidence(prescription)
+	low := confidence.lowConfidencePaths()
+	verifyMark := translate(lang, "confidence.pdf_mark")
+	marked := func(text string, paths ...string) string {
+		for _, path := range paths {
+			if low[path] {
+				return text + " " + verifyMark
+			}
+		}
+		return text
+	}
+
+	// Repeating header and footer
+	pdf.SetHeaderFunc(func() {
+		pdf.withState(func() {
+			pdf.setTextColor(0, 0, 0)
+			pdf.SetY(10)
+			pdf.heading(13, 7, translate(lang, "pdf.title"))
+			pdf.setFont("", 8)
+			pdf.setTextColor(100, 100, 100)
+			pdf.paragraph(left, contentW, 4, reportLabel(lang, "pdf.patient_id")+" "+prescription.PatientID+"   "+
+				reportLabel(lang, "dashboard.date")+" "+formatLocalDate(lang, prescription.UploadDate))
+			pdf.SetDrawColor(180, 180, 180)
+			pdf.Line(left, pdf.GetY()+1, pageW-right, pdf.GetY()+1)
+			pdf.SetDrawColor(0, 0, 0)
+		})
+		pdf.SetY(pdf.GetY() + 6)
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.withState(func() {
+			y := pageH - 15
+			pdf.SetDrawColor(180, 180, 180)
+			pdf.Line(left, y, pageW-right, y)
+			pdf.SetDrawColor(0, 0, 0)
+
+			pdf.setFont("I", 8)
+			pdf.setTextColor(100, 100, 100)
+			pdf.drawText(left, y+5, translate(lang, "pdf.generated", map[string]string{"date": generated}))
+			pdf.drawText(left, y+9, translate(lang, "pdf.verification_code", map[string]string{"code": digest[:12]}))
+
+			// The page label may need shaping; the numbers stay plain text so
+			// gofpdf can substitute the total page count alias.
+			numbers := fmt.Sprintf("%d / {nb}", pdf.PageNo())
+			label := translate(lang, "pdf.page") + " "
+			x := pageW - right - pdf.GetStringWidth(numbers) - pdf.textWidth(label)
+			pdf.drawText(x, y+5, label)
+			pdf.Text(x+pdf.textWidth(label), y+5, numbers)
+		})
+	})
+
+	pdf.AddPage()
+
+	// Patient Information Section
+	pdf.heading(12, 10, translate(lang, "dashboard.patient_info"))
+
+	pdf.setFont("", 11)
+	pdf.labelValue(reportLabel(lang, "dashboard.date"), formatLocalDate(lang, prescription.UploadDate), 40, 8)
+	pdf.labelValue(reportLabel(lang, "pdf.patient_id"), prescription.PatientID, 40, 8)
+	pdf.labelValue(reportLabel(lang, "dashboard.patient_name"), marked(analysisText(analysis["patient_name"]), "patient_name"), 40, 8)
+	pdf.labelValue(reportLabel(lang, "dashboard.prescriber"), marked(analysisText(analysis["prescriber"]), "prescriber"), 40, 8)
+	pdf.Ln(5)
+
+	if len(low) > 0 {
+		pdf.setFont("B", 10)
+		pdf.setTextColor(180, 90, 0)
+		pdf.paragraph(left, contentW, 5, translate(lang, "confidence.pdf_notice", map[string]string{"mark": verifyMark}))
+		pdf.setTextColor(0, 0, 0)
+		pdf.setFont("", 11)
+		pdf.Ln(5)
+	}
+
+	// Original prescription thumbnail (images only; PDF uploads are skipped)
+	if len(assets.Image) > 0 {
+		if thumb, w, h, err := thumbnailJPEG(assets.Image, 800); err == nil {
+			pdf.heading(12, 10, translate(lang, "pdf.original"))
+			pdf.image("prescription-thumbnail", "JPG", thumb, w, h, 90, 100)
+			pdf.Ln(5)
+		}
+	}
+
+	// Medicines Section
+	medicines, _ := analysis["medicines"].([]interface{})
+	if len(medicines) > 0 {
+		pdf.heading(12, 10, translate(lang, "dashboard.medicines"))
+
+		headers := []string{
+			"#",
+			translate(lang, "dashboard.table.medicine_name"),
+			translate(lang, "dashboard.table.dosage"),
+			translate(lang, "dashboard.table.purpose"),
+			translate(lang, "dashboard.table.instructions"),
+			translate(lang, "dashboard.table.warnings"),
+			translate(lang, "dashboard.table.status"),
+		}
+		widths := []float64{7, 32, 24, 30, 42, 35, 20}
+
+		var rows [][]string
+		for i, med := range medicines {
+			medicine, ok := med.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			path := fmt.Sprintf("medicines.%d", i)
+			name := marked(analysisText(medicine["name"]), path, path+".name")
+			if suggestion := confidence.suggestion(path + ".name"); suggestion != "" {
+				name += " " + translate(lang, "confidence.suggestion", map[string]string{"name": suggestion})
+			}
+			rows = append(rows, []string{
+				strconv.Itoa(i + 1),
+				name,
+				marked(analysisText(medicine["dosage"]), path+".dosage"),
+				analysisText(medicine["purpose"]),
+				marked(analysisText(medicine["instructions"]), path+".instructions"),
+				analysisText(medicine["warnings"]),
+				analysisText(medicine["dosage_appropriate"]),
+			})
+		}
+
+		pdf.setFont("", 9)
+		pdf.table(headers, widths, rows, 4.5)
+		pdf.setFont("", 11)
+		pdf.Ln(6)
+
+		// Generic alternatives and purchase links
+		pdf.heading(12, 10, translate(lang, "pdf.alternatives_title"))
+		for i, med := range medicines {
+			medicine, ok := med.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			pdf.setFont("B", 11)
+			pdf.paragraph(left, contentW, 7, fmt.Sprintf("%d. %v", i+1, analysisText(medicine["name"])))
+			pdf.setFont("", 10)
+
+			// Add PharmEasy link
+			if name, ok := medicine["name"].(string); ok && name != "" {
+				pharmEasyLink := fmt.Sprintf("https://pharmeasy.in/search/all?name=%s", url.QueryEscape(name))
+				pdf.ensureSpace(6)
+				y := pdf.GetY()
+				pdf.labelValue(reportLabel(lang, "pdf.purchase_link"), "", 40, 6)
+				pdf.SetY(y)
+				pdf.setTextColor(0, 0, 255) // Blue color for link
+				pdf.paragraph(left+40, contentW-40, 6, pharmEasyLink)
+				pdf.LinkString(left+40, y, contentW-40, pdf.GetY()-y, pharmEasyLink)
+				pdf.setTextColor(0, 0, 0) // Reset to black
+			}
+
+			if generics, ok := medicine["generic_alternatives"].([]interface{}); ok && len(generics) > 0 {
+				pdf.labelValue(reportLabel(lang, "pdf.generic_alternatives"), "", 60, 6)
+				for _, gen := range generics {
+					if generic, ok := gen.(map[string]interface{}); ok {
+						pdf.labelValue("•", translate(lang, "pdf.cheaper", map[string]string{
+							"name":    analysisText(generic["name"]),
+							"percent": analysisText(generic["cost_saving"]),
+						}), 10, 6)
+					}
+				}
+			}
+			pdf.Ln(3)
+		}
+		pdf.setFont("", 11)
+	}
+
+	// Add dietary recommendations if available
+	if dietary, ok := analysis["dietary_recommendations"].(map[string]interface{}); ok {
+		pdf.heading(12, 10, translate(lang, "pdf.dietary"))
+
+		for _, section := range []struct{ field, key string }{
+			{"foods_to_eat", "dashboard.foods_to_eat"},
+			{"foods_to_avoid", "dashboard.foods_to_avoid"},
+		} {
+			foods, ok := dietary[section.field].([]interface{})
+			if !ok || len(foods) == 0 {
+				continue
+			}
+			pdf.heading(11, 8, reportLabel(lang, section.key))
+			for _, food := range foods {
+				pdf.labelValue("•", analysisText(food), 10, 6)
+			}
+			pdf.Ln(4)
+		}
+	}
+
+	// Additional Information Section
+	pdf.heading(12, 10, translate(lang, "dashboard.additional_info"))
+
+	pdf.setFont("", 11)
+	pdf.labelValue(reportLabel(lang, "dashboard.manufacturer"), analysisText(analysis["manufacturer"]), 40, 8)
+	pdf.labelValue(reportLabel(lang, "dashboard.lot"), analysisText(analysis["lot_number"]), 40, 8)
+	pdf.labelValue(reportLabel(lang, "dashboard.expiry"), analysisText(analysis["expiration_date"]), 40, 8)
+	pdf.Ln(6)
+
+	// Verification QR code
+	if assets.VerifyURL != "" {
+		if png, err := qrcode.Encode(assets.VerifyURL, qrcode.Medium, 256); err == nil {
+			pdf.ensureSpace(45)
+			pdf.heading(12, 10, translate(lang, "pdf.verify_title"))
+			y := pdf.GetY()
+			pdf.image("verification-qr", "PNG", png, 256, 256, 35, 35)
+			pdf.SetY(y)
+			pdf.setFont("", 9)
+			pdf.paragraph(left+40, contentW-40, 5, translate(lang, "pdf.verify_desc"))
+			pdf.setTextColor(0, 0, 255)
+			pdf.paragraph(left+40, contentW-40, 5, assets.VerifyURL)
+			pdf.setTextColor(0, 0, 0)
+			pdf.SetY(y + 35)
+		} else {
+			log.Printf("Error generating verification QR code: %v", err)
+		}
+	}
+
+	return pdf
+}
+
+// writePrescriptionReport renders the PDF report for prescription and sends it
+// as a download named filename.
+func writePrescriptionReport(w http.ResponseWriter, r *http.Request, prescription Prescription, lang, filename string) {
+	// Parse the analysis JSON
+	var analysis map[string]interface{}
+	err := json.Unmarshal([]byte(cleanAnalysisJSON(prescription.Analysis)), &analysis)
+	if err != nil {
+		log.Printf("Error parsing analysis data: %v", err)
+		httpError(w, r, "parse_analysis_failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Attach the original upload and the signed verification link
+	assets := ReportAssets{VerifyURL: reportVerificationURL(r, prescription)}
+	if !prescription.ImageID.IsZero() {
+		if image, _, err := loadPrescriptionImage(prescription.ImageID); err == nil {
+			assets.Image = image
+		} else {
+			log.Printf("Error loading prescription image for PDF: %v", err)
+		}
+	}
+
+	pdf := renderPrescriptionReport(prescription, analysis, lang, assets)
+
+	// Set response headers
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Description", "File Transfer")
+
+	// Write PDF to response
+	if err := pdf.Output(w); err != nil {
+		log.Printf("Error writing PDF: %v", err)
+		httpError(w, r, "pdf_failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Pharmacist review. An analysis the model flags (a suspicious dose, a
+// controlled drug, or low confidence in its own reading), or that the rules
+// in data/review_rules.json catch, is held for a pharmacist before the
+// patient sees it. Pharmacists are accounts whose role is "pharmacist"; they
+// work through the queue at /review and approve, correct or reject each
+// prescription with a comment. Until then the patient only sees that it is
+// pending, and a rejected one stays hidden with the pharmacist's comment.
+// The patient is told of the outcome on the dashboard, and by WhatsApp or
+// SMS when their account has a phone number.
+
+const rolePharmacist = "pharmacist"
+
+const (
+	reviewPending   = "pending"
+	reviewApproved  = "approved"
+	reviewCorrected = "corrected"
+	reviewRejected  = "rejected"
+)
+
+// Review reasons
+const (
+	reasonSuspiciousDose = "suspicious_dose"
+	reasonControlledDrug = "controlled_drug"
+	reasonLowConfidence  = "low_confidence"
+)
+
+const maxReviewQueue = 200
+
+var errReviewResolved = errors.New("the review was already resolved")
+
+// ReviewRules is data/review_rules.json. Medicines match by name or alias as
+// whole words, as in data/pregnancy_safety.json.
+type ReviewRules struct {
+	MinConfidence   float64          `json:"min_confidence"`    // below it the model's reading is held
+	MinImageQuality int              `json:"min_image_quality"` // photo score below which the reading is held
+	Controlled      []ControlledDrug `json:"controlled"`
+	MaxDailyDoses   []MaxDailyDose   `json:"max_daily_doses"`
+}
+
+type ControlledDrug struct {
+	Name     string   `json:"name"`
+	Aliases  []string `json:"aliases"`
+	Schedule string   `json:"schedule"` // e.g. "NDPS" or "H1"
+}
+
+type MaxDailyDose struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+	MaxMg   float64  `json:"max_mg"`
+}
+
+// ReviewReason is why an analysis was held.
+type ReviewReason struct {
+	Code     string `bson:"code" json:"code"`                             // suspicious_dose, controlled_drug or low_confidence
+	Source   string `bson:"source" json:"source"`                         // "model" or "rules"
+	Medicine string `bson:"medicine,omitempty" json:"medicine,omitempty"` // empty for the whole prescription
+	Detail   string `bson:"detail,omitempty" json:"detail,omitempty"`     // e.g. "6000 mg a day, above 4000 mg"
+}
+
+// Review is the pharmacist review of a held analysis.
+type Review struct {
+	Status      string         `bson:"status" json:"status"`
+	Reasons     []ReviewReason `bson:"reasons" json:"reasons"`
+	RequestedAt time.Time      `bson:"requested_at" json:"requested_at"`
+	Reviewer    string         `bson:"reviewer,omitempty" json:"reviewer,omitempty"`
+	Comment     string         `bson:"comment,omitempty" json:"comment,omitempty"` // encrypted, see encrypted_records.go
+	ResolvedAt  *time.Time     `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+	WhatsApp    string         `bson:"whatsapp,omitempty" json:"-"` // phone number ID a WhatsApp upload came in on
+	Seen        bool           `bson:"seen,omitempty" json:"-"`     // the patient has seen the outcome
+}
+
+// ReviewDecision is a pharmacist's answer. Changes are only used with
+// "correct" and work as in CorrectionRequest.
+type ReviewDecision struct {
+	Decision    string           `json:"decision"` // "approve", "correct" or "reject"
+	Comment     string           `json:"comment,omitempty"`
+	BaseVersion int              `json:"base_version,omitempty"` // required with "correct"
+	Changes     []AnalysisChange `json:"changes,omitempty"`
+}
+
+// ReviewItem is a held prescription as the pharmacist sees it.
+type ReviewItem struct {
+	ID           string              `json:"id"`
+	Patient      string              `json:"patient"`
+	UploadDate   time.Time           `json:"upload_date"`
+	Language     string              `json:"language"`
+	Medicines    []string            `json:"medicines"`
+	HasImage     bool                `json:"has_image"`
+	ImageQuality *ImageQuality       `json:"image_quality,omitempty"`
+	Version      int                 `json:"version"`
+	Review       Review              `json:"review"`
+	Analysis     json.RawMessage     `json:"analysis,omitempty"`   // only on a single item
+	Confidence   *AnalysisConfidence `json:"confidence,omitempty"` // only on a single item
+}
+
+type ReviewQueue struct {
+	Items []ReviewItem `json:"items"`
+	Total int64        `json:"total"`
+}
+
+var (
+	reviewRules    ReviewRules
+	strengthRe     = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*(mg|mcg|µg|g)\b`)
+	doseQuantityRe = regexp.MustCompile(`^(\d+(?:\.\d+)?|½)$`)
+)
+
+func loadReviewRules(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: review rules not loaded: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, &reviewRules); err != nil {
+		log.Printf("Warning: error parsing review rules: %v", err)
+	}
+}
+
+func ensureReviewIndexes() error {
+	_, err := prescriptionsColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "review.status", Value: 1}, {Key: "review.requested_at", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{
+			"review.status": bson.M{"$exists": true},
+		}),
+	})
+	return err
+}
+
+// Withheld reports whether the patient must not see the analysis yet.
+func (p Prescription) Withheld() bool {
+	return p.Review != nil && (p.Review.Status == reviewPending || p.Review.Status == reviewRejected)
+}
+
+// matchesDrug reports whether medicine is name or one of its aliases.
+func matchesDrug(medicine, name string, aliases []string) bool {
+	norm := normalizeMedicineName(medicine)
+	for _, candidate := range append([]string{name}, aliases...) {
+		if strings.Contains(norm, normalizeMedicineName(candidate)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewReasons checks a new analysis and returns why it needs a
+// pharmacist, or nothing if it can go straight to the patient.
+func reviewReasons(analysis string, quality *ImageQuality) []ReviewReason {
+	var parsed struct {
+		Confidence interface{} `json:"confidence"`
+		Medicines  []struct {
+			Name              string      `json:"name"`
+			Dosage            string      `json:"dosage"`
+			Instructions      string      `json:"instructions"`
+			DosageSuspicious  interface{} `json:"dosage_suspicious"`
+			DosageAppropriate string      `json:"dosage_appropriate"`
+			Controlled        interface{} `json:"controlled_substance"`
+			Schedule          *struct {
+				Times []string `json:"times"`
+			} `json:"schedule"`
+		} `json:"medicines"`
+	}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(analysis)), &parsed); err != nil {
+		// An answer that cannot be read is the least trustworthy of all
+		return []ReviewReason{{Code: reasonLowConfidence, Source: "rules", Detail: "unreadable analysis"}}
+	}
+
+	var reasons []ReviewReason
+	if confidence, ok := analysisNumber(parsed.Confidence); ok && confidence < reviewRules.MinConfidence {
+		reasons = append(reasons, ReviewReason{Code: reasonLowConfidence, Source: "model",
+			Detail: fmt.Sprintf("confidence %.2f", confidence)})
+	}
+	if quality != nil && quality.Score < reviewRules.MinImageQuality {
+		reasons = append(reasons, ReviewReason{Code: reasonLowConfidence, Source: "rules",
+			Detail: fmt.Sprintf("image quality %d", quality.Score)})
+	}
+
+	for _, med := range parsed.Medicines {
+		if med.Name == "" {
+			continue
+		}
+		if analysisFlag(med.DosageSuspicious) {
+			reasons = append(reasons, ReviewReason{Code: reasonSuspiciousDose, Source: "model",
+				Medicine: med.Name, Detail: med.DosageAppropriate})
+		} else if detail := dailyDoseExcess(med.Name, med.Dosage, med.Instructions, med.Schedule); detail != "" {
+			reasons = append(reasons, ReviewReason{Code: reasonSuspiciousDose, Source: "rules",
+				Medicine: med.Name, Detail: detail})
+		}
+
+		controlled := false
+		for _, drug := range reviewRules.Controlled {
+			if matchesDrug(med.Name, drug.Name, drug.Aliases) {
+				reasons = append(reasons, ReviewReason{Code: reasonControlledDrug, Source: "rules",
+					Medicine: med.Name, Detail: drug.Name + " (" + drug.Schedule + ")"})
+				controlled = true
+				break
+			}
+		}
+		if !controlled && analysisFlag(med.Controlled) {
+			reasons = append(reasons, ReviewReason{Code: reasonControlledDrug, Source: "model", Medicine: med.Name})
+		}
+	}
+	return reasons
+}
+
+// dailyDoseExcess returns a description when the strength in the name or
+// dosage times the doses a day is above the medicine's limit, or "" when it
+// is within it or cannot be told.
+func dailyDoseExcess(name, dosage, instructions string, schedule *struct {
+	Times []string `json:"times"`
+}) string {
+	var limit MaxDailyDose
+	for _, entry := range reviewRules.MaxDailyDoses {
+		if matchesDrug(name, entry.Name, entry.Aliases) {
+			limit = entry
+			break
+		}
+	}
+	if limit.MaxMg <= 0 {
+		return ""
+	}
+
+	strength, ok := strengthMg(name + " " + dosage)
+	if !ok {
+		return ""
+	}
+
+	text := strings.ToLower(dosage + " " + instructions)
+	perDay := dosesPerDay(text)
+	if schedule != nil {
+		if valid := validReminderTimes(schedule.Times); len(valid) > 0 && perDay == 0 {
+			perDay = float64(len(valid))
+		}
+	}
+	if perDay == 0 {
+		return ""
+	}
+	if daily := strength * perDay; daily > limit.MaxMg {
+		return fmt.Sprintf("%g mg a day, above %g mg", daily, limit.MaxMg)
+	}
+	return ""
+}
+
+// strengthMg reads the first strength in text ("500 mg", "1g", "50 mcg")
+// in milligrams.
+func strengthMg(text string) (float64, bool) {
+	m := strengthRe.FindStringSubmatch(strings.ToLower(text))
+	if m == nil {
+		return 0, false
+	}
+	strength, _ := strconv.ParseFloat(m[1], 64)
+	switch m[2] {
+	case "g":
+		strength *= 1000
+	case "mcg", "µg":
+		strength /= 1000
+	}
+	return strength, true
+}
+
+// dosesPerDay counts the units taken a day from "1-0-1" (adding up each
+// slot, so "2-0-2" is 4) or frequency words, or 0 if the text does not say.
+func dosesPerDay(text string) float64 {
+	if m := dosePatternRe.FindStringSubmatch(text); m != nil {
+		total := 0.0
+		for _, part := range m[1:5] {
+			if !doseQuantityRe.MatchString(part) {
+				continue
+			}
+			if part == "½" {
+				total += 0.5
+			} else if n, err := strconv.ParseFloat(part, 64); err == nil {
+				total += n
+			}
+		}
+		return total
+	}
+	return float64(len(guessDoseTimes(text)))
+}
+
+// analysisFlag reads a model yes/no that may come back as a boolean or text.
+func analysisFlag(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "yes":
+			return true
+		}
+	}
+	return false
+}
+
+// analysisNumber reads a model number that may come back as text.
+func analysisNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// currentPharmacist returns the signed-in user when the account is a
+// pharmacist's. The role is read from the account, not the session, so a
+// role taken away applies at once.
+func currentPharmacist(r *http.Request) (User, bool) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		return User{}, false
+	}
+	var user User
+	if err := usersColl.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Error loading user for review: %v", err)
+		}
+		return user, false
+	}
+	return user, user.Role == rolePharmacist
+}
+
+func reviewItemJSON(prescription Prescription, full bool) ReviewItem {
+	item := ReviewItem{
+		ID:           prescription.ID.Hex(),
+		Patient:      prescription.PatientID,
+		UploadDate:   prescription.UploadDate,
+		Language:     prescription.Language,
+		Medicines:    []string{},
+		HasImage:     !prescription.ImageID.IsZero(),
+		ImageQuality: prescription.ImageQuality,
+		Version:      prescription.currentVersion(),
+	}
+	if prescription.Review != nil {
+		item.Review = *prescription.Review
+	}
+	item.Medicines = append(item.Medicines, prescription.MedicineNames()...)
+	if full {
+		analysis := cleanAnalysisJSON(prescription.Analysis)
+		if json.Valid([]byte(analysis)) {
+			item.Analysis = json.RawMessage(analysis)
+		} else {
+			item.Analysis, _ = json.Marshal(analysis)
+		}
+		item.Confidence = analysisConfidence(prescription)
+	}
+	return item
+}
+
+// pendingReviews is the queue, oldest first.
+func pendingReviews(ctx context.Context) (ReviewQueue, error) {
+	queue := ReviewQueue{Items: []ReviewItem{}}
+	filter := bson.M{"review.status": reviewPending}
+	total, err := prescriptionsColl.CountDocuments(ctx, filter)
+	if err != nil {
+		return queue, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "review.requested_at", Value: 1}}).SetLimit(maxReviewQueue)
+	cursor, err := prescriptionsColl.Find(ctx, filter, opts)
+	if err != nil {
+		return queue, err
+	}
+	var prescriptions []Prescription
+	if err := cursor.All(ctx, &prescriptions); err != nil {
+		return queue, err
+	}
+	for _, prescription := range prescriptions {
+		queue.Items = append(queue.Items, reviewItemJSON(prescription, false))
+	}
+	queue.Total = total
+	return queue, nil
+}
+
+// recordAudit logs that actor was shown the queue, which lists the medicines
+// of every held analysis in it.
+func (q ReviewQueue) recordAudit(r *http.Request, actor string) {
+	for _, item := range q.Items {
+		recordAudit(r, actor, item.Patient, auditList, item.ID)
+	}
+}
+
+// findReviewPrescription loads any held or reviewed prescription.
+func findReviewPrescription(objID primitive.ObjectID) (Prescription, error) {
+	var prescription Prescription
+	err := prescriptionsColl.FindOne(context.Background(), bson.M{
+		"_id":    objID,
+		"review": bson.M{"$exists": true},
+	}).Decode(&prescription)
+	return prescription, err
+}
+
+// resolveReview applies a pharmacist's decision to a pending prescription.
+func resolveReview(r *http.Request, prescription Prescription, pharmacist User, decision ReviewDecision) (Prescription, error) {
+	if prescription.Review == nil || prescription.Review.Status != reviewPending {
+		return prescription, errReviewResolved
+	}
+	comment := strings.TrimSpace(decision.Comment)
+	if len(comment) > maxCorrectionComment {
+		return prescription, errInvalidCorrection
+	}
+
+	var status string
+	switch decision.Decision {
+	case "approve":
+		status = reviewApproved
+	case "reject":
+		// The patient is told why, so a rejection needs a comment
+		if comment == "" {
+			return prescription, errInvalidCorrection
+		}
+		status = reviewRejected
+	case "correct":
+		status = reviewCorrected
+		var err error
+		prescription, err = correctAnalysis(r, prescription, pharmacist.Username, rolePharmacist, CorrectionRequest{
+			BaseVersion: decision.BaseVersion,
+			Changes:     decision.Changes,
+			Comment:     comment,
+		})
+		if err != nil {
+			return prescription, err
+		}
+	default:
+		return prescription, errInvalidCorrection
+	}
+
+	sealed, err := encryptString(comment)
+	if err != nil {
+		return prescription, err
+	}
+	now := time.Now()
+	result, err := prescriptionsColl.UpdateOne(context.Background(),
+		bson.M{"_id": prescription.ID, "review.status": reviewPending},
+		bson.M{"$set": bson.M{
+			"review.status":      status,
+			"review.reviewer":    pharmacist.Username,
+			"review.comment":     sealed,
+			"review.resolved_at": now,
+		}})
+	if err != nil {
+		return prescription, err
+	}
+	if result.MatchedCount == 0 {
+		return prescription, errReviewResolved
+	}
+
+	recordAudit(r, pharmacist.Username, prescription.PatientID, auditReview, prescription.ID.Hex())
+	review := *prescription.Review
+	review.Status, review.Reviewer, review.Comment, review.ResolvedAt = status, pharmacist.Username, comment, &now
+	prescription.Review = &review
+	go notifyReviewResolved(prescription)
+	return prescription, nil
+}
+
+// notifyReviewResolved tells the patient the outcome by WhatsApp when the
+// prescription came in that way, otherwise by SMS when a number is linked.
+// The dashboard shows it either way.
+func notifyReviewResolved(prescription Prescription) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var user User
+	if err := usersColl.FindOne(ctx, bson.M{"username": prescription.PatientID}).Decode(&user); err != nil {
+		log.Printf("Error loading user to notify of review: %v", err)
+		return
+	}
+	if user.Phone == "" {
+		return
+	}
+	lang := languageOrDefault(user.Language).Code
+	message := reviewOutcomeText(lang, prescription)
+
+	switch {
+	case prescription.Review.WhatsApp != "":
+		err := sendWhatsAppText(ctx, prescription.Review.WhatsApp, strings.TrimPrefix(user.Phone, "+"), message)
+		if err != nil {
+			log.Printf("Error sending review outcome by WhatsApp: %v", err)
+		}
+	case os.Getenv("SMS_REPLY_URL") != "":
+		for _, segment := range splitSMS(message, smsMaxSegments()) {
+			if err := postSMS(os.Getenv("SMS_REPLY_URL"), os.Getenv("SMS_NUMBER"), user.Phone, segment); err != nil {
+				log.Printf("Error sending review outcome by SMS: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// reviewOutcomeText is the message telling the patient how the review of
+// their prescription ended.
+func reviewOutcomeText(lang string, prescription Prescription) string {
+	review := prescription.Review
+	text := translate(lang, "review.outcome_"+review.Status, map[string]string{
+		"date": formatLocalDate(lang, prescription.UploadDate),
+	})
+	if review.Comment != "" {
+		text += "\n" + translate(lang, "review.pharmacist_comment", map[string]string{"comment": review.Comment})
+	}
+	return text
+}
+
+// reviewNotices are the patient's reviews resolved since they last looked.
+func reviewNotices(ctx context.Context, username string) []Prescription {
+	cursor, err := prescriptionsColl.Find(ctx, bson.M{
+		"patient_id":    username,
+		"review.status": bson.M{"$in": bson.A{reviewApproved, reviewCorrected, reviewRejected}},
+		"review.seen":   bson.M{"$ne": true},
+	}, options.Find().SetSort(bson.D{{Key: "review.resolved_at", Value: -1}}).SetLimit(10))
+	if err != nil {
+		log.Printf("Error fetching review notices: %v", err)
+		return nil
+	}
+	var prescriptions []Prescription
+	if err := cursor.All(ctx, &prescriptions); err != nil {
+		log.Printf("Error fetching review notices: %v", err)
+	}
+	return prescriptions
+}
+
+// markReviewSeen records that the patient has seen the outcome.
+func markReviewSeen(prescription Prescription) {
+	if prescription.Review == nil || prescription.Review.Status == reviewPending || prescription.Review.Seen {
+		return
+	}
+	_, err := prescriptionsColl.UpdateOne(context.Background(),
+		bson.M{"_id": prescription.ID}, bson.M{"$set": bson.M{"review.seen": true}})
+	if err != nil {
+		log.Printf("Error marking review seen: %v", err)
+	}
+}
+
+// writeReviewError answers a failed decision.
+func writeReviewError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errReviewResolved {
+		apiError(w, r, http.StatusConflict, "review_resolved")
+		return
+	}
+	writeCorrectionError(w, r, err)
+}
+
+// reviewHandler serves the pharmacist's pages:
+//
+//	GET  /review             the queue page
+//	GET  /review/queue       the pending prescriptions
+//	GET  /review/:id         one prescription with its analysis
+//	POST /review/:id         approve, correct or reject it
+//	GET  /review/:id/image   its uploaded image
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+	username, role, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		if r.URL.Path == "/review" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	pharmacist, ok := currentPharmacist(r)
+	if !ok {
+		httpError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/review"), "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		renderTemplate(w, requestLang(r), "review.html", PageData{User: username, Role: role})
+		return
+	case rest == "queue" && r.Method == http.MethodGet:
+		queue, err := pendingReviews(r.Context())
+		if err != nil {
+			log.Printf("Error fetching review queue: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "internal")
+			return
+		}
+		queue.recordAudit(r, pharmacist.Username)
+		apiJSON(w, http.StatusOK, queue)
+		return
+	}
+
+	prescriptionID, action, _ := strings.Cut(rest, "/")
+	objID, err := primitive.ObjectIDFromHex(prescriptionID)
+	if err != nil {
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
+		return
+	}
+	prescription, err := findReviewPrescription(objID)
+	if err != nil {
+		writePrescriptionLookupError(w, r, err)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		recordAudit(r, pharmacist.Username, prescription.PatientID, auditView, prescriptionID)
+		apiJSON(w, http.StatusOK, reviewItemJSON(prescription, true))
+	case action == "" && r.Method == http.MethodPost:
+		var decision ReviewDecision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		prescription, err = resolveReview(r, prescription, pharmacist, decision)
+		if err != nil {
+			writeReviewError(w, r, err)
+			return
+		}
+		apiJSON(w, http.StatusOK, reviewItemJSON(prescription, true))
+	case action == "image" && r.Method == http.MethodGet:
+		writeReviewImage(w, r, pharmacist, prescription)
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeReviewImage sends the upload of a held prescription to a pharmacist.
+func writeReviewImage(w http.ResponseWriter, r *http.Request, pharmacist User, prescription Prescription) {
+	if prescription.ImageID.IsZero() {
+		apiError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	recordAudit(r, pharmacist.Username, prescription.PatientID, auditViewImage, prescription.ID.Hex())
+	data, contentType, err := loadPrescriptionImage(prescription.ImageID)
+	if err != nil {
+		log.Printf("Error loading prescription image: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "internal")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write(data)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signing in sets one session cookie holding the username, the role and an
+// expiry, signed with SESSION_SECRET. getLoggedInUser only believes a cookie
+// whose signature checks out, so the username cannot be edited in the
+// browser to act as someone else.
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 24 * time.Hour
+)
+
+var sessionKey []byte
+
+func loadSessionKey() {
+	if key := os.Getenv("SESSION_SECRET"); key != "" {
+		sessionKey = []byte(key)
+		return
+	}
+	log.Println("Warning: SESSION_SECRET not set, using a random key; everyone is signed out after a restart")
+	sessionKey = make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("session|" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionValue is "<username>.<role>.<expiry>.<signature>", with the username
+// and role base64-encoded so they cannot contain the separator.
+func sessionValue(username, role string, expires time.Time) string {
+	payload := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(username)),
+		base64.RawURLEncoding.EncodeToString([]byte(role)),
+		strconv.FormatInt(expires.Unix(), 10),
+	}, ".")
+	return payload + "." + signSession(payload)
+}
+
+// parseSession returns the username and role of a session cookie value that
+// is signed and has not expired.
+func parseSession(value string) (string, string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(signSession(payload)), []byte(sig)) {
+		return "", "", false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return "", "", false
+	}
+	username, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(username) == 0 {
+		return "", "", false
+	}
+	role, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return string(username), string(role), true
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, user User) {
+	expires := time.Now().Add(sessionLifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sessionValue(user.Username, user.Role, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(publicBase, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// sessionUser returns who the request's session cookie was issued to.
+func sessionUser(r *http.Request) (string, string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", "", false
+	}
+	return parseSession(cookie.Value)
+}
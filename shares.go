@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultShareHours = 24
+	maxShareHours     = 7 * 24
+)
+
+// ShareLink gives read-only, login-free access to one prescription until it
+// expires or the patient revokes it.
+type ShareLink struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	PrescriptionID primitive.ObjectID `bson:"prescription_id"`
+	PatientID      string             `bson:"patient_id"`
+	CreatedAt      time.Time          `bson:"created_at"`
+	ExpiresAt      time.Time          `bson:"expires_at"`
+	RevokedAt      *time.Time         `bson:"revoked_at,omitempty"`
+	AccessCount    int                `bson:"access_count"`
+	LastAccessedAt *time.Time         `bson:"last_accessed_at,omitempty"`
+}
+
+// ShareAccess is one entry in the audit trail of a share link.
+type ShareAccess struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ShareID   primitive.ObjectID `bson:"share_id" json:"-"`
+	Action    string             `bson:"action" json:"action"` // "view" or "pdf"
+	IP        string             `bson:"ip" json:"ip"`
+	UserAgent string             `bson:"user_agent" json:"user_agent"`
+	Time      time.Time          `bson:"time" json:"time"`
+}
+
+type CreateShareRequest struct {
+	PrescriptionID string `json:"prescription_id"`
+	Hours          int    `json:"hours"`
+}
+
+var (
+	shareLinksColl    *mongo.Collection
+	shareAccessesColl *mongo.Collection
+)
+
+// shareToken is "<link id>.<signature>"; the signature covers the expiry so
+// tokens cannot be guessed or stretched without the signing key.
+func shareToken(link ShareLink) string {
+	return link.ID.Hex() + "." + signShare(link.ID.Hex(), link.ExpiresAt)
+}
+
+func signShare(id string, expires time.Time) string {
+	mac := hmac.New(sha256.New, reportSigningKey)
+	mac.Write([]byte("share|" + id + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func shareURL(r *http.Request, link ShareLink) string {
+	return publicBaseURL() + "/s/" + shareToken(link)
+}
+
+// trustedProxies are the addresses, from TRUSTED_PROXIES, whose
+// X-Forwarded-For headers are believed.
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of IP
+// addresses and CIDR ranges.
+func loadTrustedProxies() {
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("Error loading TRUSTED_PROXIES: %v", err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the connection's address or, when that is a trusted proxy, the
+// last X-Forwarded-For hop that is not one. Hops to the left of it were sent
+// by the client and could be anything.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// sharesHandler manages the logged-in patient's share links:
+// GET lists active links, POST creates one, DELETE ?id= revokes one.
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, loggedIn := getLoggedInUser(r)
+	if !loggedIn {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listShares(w, r, username)
+	case http.MethodPost:
+		createShare(w, r, username)
+	case http.MethodDelete:
+		revokeShare(w, r, username)
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createShare(w http.ResponseWriter, r *http.Request, username string) {
+	var req CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, r, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	if req.Hours == 0 {
+		req.Hours = defaultShareHours
+	}
+	if req.Hours < 1 || req.Hours > maxShareHours {
+		httpError(w, r, "invalid_share_hours", http.StatusBadRequest, map[string]string{"hours": strconv.Itoa(maxShareHours)})
+		return
+	}
+
+	objID, err := primitive.ObjectIDFromHex(req.PrescriptionID)
+	if err != nil {
+		httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
+		return
+	}
+	prescription, err := findUserPrescription(objID, username)
+	if err != nil {
+		writePrescriptionLookupError(w, r, err)
+		return
+	}
+	if prescription.Withheld() {
+		httpError(w, r, "under_review", http.StatusConflict)
+		return
+	}
+
+	link, err := newShareLink(r, username, objID, req.Hours)
+	if err != nil {
+		log.Printf("Error creating share link: %v", err)
+		httpError(w, r, "create_share_failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(shareJSON(r, link, nil))
+}
+
+// newShareLink saves and audits a link to one of username's prescriptions.
+func newShareLink(r *http.Request, username string, prescriptionID primitive.ObjectID, hours int) (ShareLink, error) {
+	now := time.Now()
+	link := ShareLink{
+		ID:             primitive.NewObjectID(),
+		PrescriptionID: prescriptionID,
+		PatientID:      username,
+		CreatedAt:      now,
+		// Whole seconds, so the signed expiry matches what Mongo stores
+		ExpiresAt: now.Add(time.Duration(hours) * time.Hour).Truncate(time.Second),
+	}
+	if _, err := shareLinksColl.InsertOne(context.Background(), link); err != nil {
+		return link, err
+	}
+
+	recordAudit(r, username, username, auditShare, prescriptionID.Hex())
+	return link, nil
+}
+
+func listShares(w http.ResponseWriter, r *http.Request, username string) {
+	filter := bson.M{
+		"patient_id": username,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	if id := r.URL.Query().Get("prescription_id"); id != "" {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			httpError(w, r, "invalid_prescription_id", http.StatusBadRequest)
+			return
+		}
+		filter["prescription_id"] = objID
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := shareLinksColl.Find(context.Background(), filter, opts)
+	if err != nil {
+		log.Printf("Error fetching share links: %v", err)
+		httpError(w, r, "fetch_shares_failed", http.StatusInternalServerError)
+		return
+	}
+	var links []ShareLink
+	if err := cursor.All(context.Background(), &links); err != nil {
+		log.Printf("Error decoding share links: %v", err)
+		httpError(w, r, "fetch_shares_failed", http.StatusInternalServerError)
+		return
+	}
+
+	shares := []map[string]interface{}{}
+	for _, link := range links {
+		shares = append(shares, shareJSON(r, link, recentShareAccesses(link.ID, 10)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"shares": shares})
+}
+
+func revokeShare(w http.ResponseWriter, r *http.Request, username string) {
+	objID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		httpError(w, r, "invalid_share_id", http.StatusBadRequest)
+		return
+	}
+
+	var link ShareLink
+	err = shareLinksColl.FindOneAndUpdate(context.Background(), bson.M{
+		"_id":        objID,
+		"patient_id": username,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": time.Now()}}).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		httpError(w, r, "share_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error revoking share link: %v", err)
+		httpError(w, r, "revoke_share_failed", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, username, username, auditShareRevoke, link.PrescriptionID.Hex())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Share link revoked",
+		"id":      objID.Hex(),
+	})
+}
+
+// revokePrescriptionShares ends every link to a prescription, e.g. when it is
+// deleted.
+func revokePrescriptionShares(prescriptionID primitive.ObjectID) {
+	_, err := shareLinksColl.UpdateMany(context.Background(), bson.M{
+		"prescription_id": prescriptionID,
+		"revoked_at":      bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		log.Printf("Error revoking share links: %v", err)
+	}
+}
+
+func shareJSON(r *http.Request, link ShareLink, accesses []ShareAccess) map[string]interface{} {
+	if accesses == nil {
+		accesses = []ShareAccess{}
+	}
+	return map[string]interface{}{
+		"id":               link.ID.Hex(),
+		"prescription_id":  link.PrescriptionID.Hex(),
+		"url":              shareURL(r, link),
+		"created_at":       link.CreatedAt,
+		"expires_at":       link.ExpiresAt,
+		"access_count":     link.AccessCount,
+		"last_accessed_at": link.LastAccessedAt,
+		"accesses":         accesses,
+	}
+}
+
+func recentShareAccesses(shareID primitive.ObjectID, limit int64) []ShareAccess {
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit)
+	cursor, err := shareAccessesColl.Find(context.Background(), bson.M{"share_id": shareID}, opts)
+	if err != nil {
+		log.Printf("Error fetching share accesses: %v", err)
+		return nil
+	}
+	var accesses []ShareAccess
+	if err := cursor.All(context.Background(), &accesses); err != nil {
+		log.Printf("Error decoding share accesses: %v", err)
+	}
+	return accesses
+}
+
+// recordShareAccess bumps the link's counter and appends to its audit trail.
+func recordShareAccess(r *http.Request, link ShareLink, action string) {
+	now := time.Now()
+	_, err := shareLinksColl.UpdateOne(context.Background(), bson.M{"_id": link.ID}, bson.M{
+		"$inc": bson.M{"access_count": 1},
+		"$set": bson.M{"last_accessed_at": now},
+	})
+	if err != nil {
+		log.Printf("Error updating share link access count: %v", err)
+	}
+
+	_, err = shareAccessesColl.InsertOne(context.Background(), ShareAccess{
+		ShareID:   link.ID,
+		Action:    action,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Time:      now,
+	})
+	if err != nil {
+		log.Printf("Error recording share access: %v", err)
+	}
+}
+
+type SharedMedicine struct {
+	Name, Dosage, Purpose, Instructions, Warnings, Status string
+}
+
+type SharedPageData struct {
+	Status      string // "active", "expired", "revoked" or "invalid"
+	Token       string
+	ExpiresAt   time.Time
+	UploadDate  time.Time
+	PatientName string
+	Prescriber  string
+	Medicines   []SharedMedicine
+	Warnings    []SafetyWarning
+	Lang        string
+}
+
+// resolveShareToken checks the token's signature, then loads the link. The
+// returned status is "active" only when the link can be used.
+func resolveShareToken(token string) (ShareLink, string, error) {
+	var link ShareLink
+	id, sig, ok := strings.Cut(token, ".")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if !ok || err != nil {
+		return link, "invalid", nil
+	}
+
+	err = shareLinksColl.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		return link, "invalid", nil
+	} else if err != nil {
+		return link, "", err
+	}
+
+	switch {
+	case !hmac.Equal([]byte(sig), []byte(signShare(id, link.ExpiresAt))):
+		return link, "invalid", nil
+	case link.RevokedAt != nil:
+		return link, "revoked", nil
+	case time.Now().After(link.ExpiresAt):
+		return link, "expired", nil
+	}
+	return link, "active", nil
+}
+
+// sharedPrescriptionHandler serves a share link without requiring a login:
+// GET /s/{token} shows the analysis, GET /s/{token}/pdf downloads the report.
+func sharedPrescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/s/")
+	token, wantPDF := strings.CutSuffix(path, "/pdf")
+
+	link, status, err := resolveShareToken(token)
+	if err != nil {
+		log.Printf("Error fetching share link: %v", err)
+		httpError(w, r, "internal", http.StatusInternalServerError)
+		return
+	}
+	if status != "active" {
+		writeSharedPage(w, r, SharedPageData{Status: status})
+		return
+	}
+
+	var prescription Prescription
+	err = prescriptionsColl.FindOne(context.Background(), bson.M{"_id": link.PrescriptionID}).Decode(&prescription)
+	if err == mongo.ErrNoDocuments {
+		writeSharedPage(w, r, SharedPageData{Status: "revoked"})
+		return
+	} else if err != nil {
+		log.Printf("Error fetching shared prescription: %v", err)
+		httpError(w, r, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	lang := r.URL.Query().Get("lang")
+	if _, ok := lookupLanguage(lang); !ok {
+		lang = languageOrDefault(prescription.Language).Code
+	}
+
+	// Shared links may be forwarded; keep them out of caches and search engines
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	actor := "share:" + link.ID.Hex()
+	if wantPDF {
+		recordShareAccess(r, link, "pdf")
+		recordAudit(r, actor, link.PatientID, auditSharedDownload, prescription.ID.Hex())
+		writePrescriptionReport(w, r, prescription, lang, fmt.Sprintf("prescription-analysis-%s.pdf", prescription.ID.Hex()))
+		return
+	}
+
+	recordShareAccess(r, link, "view")
+	recordAudit(r, actor, link.PatientID, auditSharedView, prescription.ID.Hex())
+
+	var analysis map[string]interface{}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(prescription.Analysis)), &analysis); err != nil {
+		log.Printf("Error parsing analysis data: %v", err)
+		httpError(w, r, "parse_analysis_failed", http.StatusInternalServerError)
+		return
+	}
+
+	data := SharedPageData{
+		Status:      status,
+		Token:       token,
+		ExpiresAt:   link.ExpiresAt,
+		UploadDate:  prescription.UploadDate,
+		PatientName: analysisText(analysis["patient_name"]),
+		Prescriber:  analysisText(analysis["prescriber"]),
+		Warnings:    userPregnancyWarnings(link.PatientID, prescription.Analysis, lang),
+		Lang:        lang,
+	}
+	medicines, _ := analysis["medicines"].([]interface{})
+	for _, med := range medicines {
+		if medicine, ok := med.(map[string]interface{}); ok {
+			data.Medicines = append(data.Medicines, SharedMedicine{
+				Name:         analysisText(medicine["name"]),
+				Dosage:       analysisText(medicine["dosage"]),
+				Purpose:      analysisText(medicine["purpose"]),
+				Instructions: analysisText(medicine["instructions"]),
+				Warnings:     analysisText(medicine["warnings"]),
+				Status:       analysisText(medicine["dosage_appropriate"]),
+			})
+		}
+	}
+	writeSharedPage(w, r, data)
+}
+
+func writeSharedPage(w http.ResponseWriter, r *http.Request, data SharedPageData) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch data.Status {
+	case "expired", "revoked":
+		w.WriteHeader(http.StatusGone)
+	case "invalid":
+		w.WriteHeader(http.StatusNotFound)
+	}
+	lang := data.Lang
+	if lang == "" {
+		lang = requestLang(r)
+	}
+	renderTemplate(w, lang, "shared.html", data)
+}
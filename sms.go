@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SMS channel for users without a smartphone. Gateways deliver inbound
+// messages to /sms/inbound?token=<SMS_WEBHOOK_TOKEN>; Twilio and Plivo style
+// forms (From, Body or Text), Vonage style parameters (msisdn, text) and JSON
+// bodies with from and text are understood. The number is matched to an
+// account by User.Phone, and numbers nobody has linked get an SMS-only
+// account. A message can start with a keyword:
+//
+//	HELP                        what the service can do
+//	LINK <code>                 link the number to a web account
+//	LANG <code>                 reply language, e.g. LANG ta
+//	SYM [age] [m|f] <symptoms>  symptom check instead of a general question
+//
+// Everything else goes to the health assistant. Replies are split into
+// single-SMS segments and returned in the webhook response (TwiML to Twilio,
+// JSON otherwise), or POSTed one by one to SMS_REPLY_URL when it is set.
+
+const smsUsernamePrefix = "sms-"
+
+const (
+	gsm7SegmentLength = 160
+	ucs2SegmentLength = 70
+)
+
+var (
+	gsm7Basic    = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extended = "^{}\\[~]|€\f"
+)
+
+// InboundSMS is a received message, whatever gateway sent it.
+type InboundSMS struct {
+	From   string
+	To     string
+	Text   string
+	ID     string
+	Twilio bool // reply with TwiML
+}
+
+// A web account links a number through the profile, which issues a code;
+// texting LINK <code> from that number proves it belongs to the user.
+const phoneLinkTTL = 15 * time.Minute
+
+var errInvalidPhone = errors.New("invalid phone number")
+
+// PhoneLink is a number waiting to be confirmed from the phone itself.
+type PhoneLink struct {
+	Phone     string    `bson:"phone" json:"phone"`
+	Code      string    `bson:"code" json:"code"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// Gateways retry webhooks that time out; a retried message ID is answered
+// without asking the model again.
+var (
+	seenMessagesMu sync.Mutex
+	seenMessages   = map[string]time.Time{}
+)
+
+func ensureSMSIndexes() error {
+	_, err := usersColl.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "phone", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"phone": bson.M{"$type": "string"}}),
+	})
+	return err
+}
+
+func smsCountryCode() string {
+	if code := strings.TrimPrefix(os.Getenv("SMS_COUNTRY_CODE"), "+"); code != "" {
+		return code
+	}
+	return "91"
+}
+
+func smsMaxSegments() int {
+	if n, err := strconv.Atoi(os.Getenv("SMS_MAX_SEGMENTS")); err == nil && n > 0 {
+		return n
+	}
+	return 6
+}
+
+// normalizePhone returns the number in E.164 form ("+919812345678"), adding
+// SMS_COUNTRY_CODE to national numbers, or "" if it is not a phone number.
+func normalizePhone(number string) string {
+	number = strings.TrimSpace(number)
+	var b strings.Builder
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	digits := b.String()
+	switch {
+	case strings.HasPrefix(number, "+"):
+	case strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case len(digits) == 11 && digits[0] == '0':
+		digits = smsCountryCode() + digits[1:]
+	case len(digits) == 10:
+		digits = smsCountryCode() + digits
+	}
+	if len(digits) < 8 || len(digits) > 15 {
+		return ""
+	}
+	return "+" + digits
+}
+
+// parseInboundSMS reads the common gateway formats.
+func parseInboundSMS(r *http.Request) (InboundSMS, error) {
+	fields := map[string]string{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return InboundSMS{}, err
+		}
+		for k, v := range body {
+			if s, ok := v.(string); ok {
+				fields[k] = s
+			}
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return InboundSMS{}, err
+		}
+		for k := range r.Form {
+			fields[k] = r.Form.Get(k)
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := fields[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	msg := InboundSMS{
+		From:   first("From", "from", "msisdn", "sender"),
+		To:     first("To", "to"),
+		Text:   strings.TrimSpace(first("Body", "Text", "text", "message", "content", "body")),
+		ID:     first("MessageSid", "SmsSid", "MessageUUID", "messageId", "message_id", "id"),
+		Twilio: fields["MessageSid"] != "" || fields["SmsSid"] != "",
+	}
+	if msg.From == "" {
+		return msg, fmt.Errorf("no sender number")
+	}
+	return msg, nil
+}
+
+// setPhone starts linking number to username, or unlinks the current number
+// when number is blank.
+func setPhone(username, number string) error {
+	ctx := context.Background()
+	if strings.TrimSpace(number) == "" {
+		_, err := usersColl.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$unset": bson.M{"phone": "", "phone_link": ""}})
+		return err
+	}
+	phone := normalizePhone(number)
+	if phone == "" {
+		return errInvalidPhone
+	}
+
+	var user User
+	if err := usersColl.FindOne(ctx, bson.M{"username": username}).Decode(&user); err != nil {
+		return err
+	}
+	if user.Phone == phone || (user.PhoneLink != nil && user.PhoneLink.Phone == phone && time.Now().Before(user.PhoneLink.ExpiresAt)) {
+		return nil
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	_, err = usersColl.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"phone_link": PhoneLink{
+		Phone:     phone,
+		Code:      fmt.Sprintf("%06d", n.Int64()),
+		ExpiresAt: time.Now().Add(phoneLinkTTL),
+	}}})
+	return err
+}
+
+// linkPhone moves phone to the account that is waiting for code. The number
+// leaves whichever account had it; an SMS-only account hands everything it
+// owns over and is removed.
+func linkPhone(phone, code string) (User, error) {
+	ctx := context.Background()
+	var user User
+	err := usersColl.FindOne(ctx, bson.M{
+		"phone_link.phone":      phone,
+		"phone_link.code":       code,
+		"phone_link.expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&user)
+	if err != nil {
+		return user, err
+	}
+
+	var previous User
+	err = usersColl.FindOne(ctx, bson.M{"phone": phone}).Decode(&previous)
+	switch {
+	case err == mongo.ErrNoDocuments:
+	case err != nil:
+		return user, err
+	case previous.Username == user.Username:
+	case strings.HasPrefix(previous.Username, smsUsernamePrefix) && previous.Password == "":
+		if err := handOverRecords(ctx, previous.Username, user.Username); err != nil {
+			return user, err
+		}
+		if _, err := usersColl.DeleteOne(ctx, bson.M{"username": previous.Username}); err != nil {
+			return user, err
+		}
+	default:
+		if _, err := usersColl.UpdateOne(ctx, bson.M{"username": previous.Username}, bson.M{"$unset": bson.M{"phone": ""}}); err != nil {
+			return user, err
+		}
+	}
+
+	_, err = usersColl.UpdateOne(ctx, bson.M{"username": user.Username}, bson.M{
+		"$set":   bson.M{"phone": phone},
+		"$unset": bson.M{"phone_link": ""},
+	})
+	return user, err
+}
+
+// handOverRecords gives everything from owns to to: prescriptions and their
+// images, voice recordings, share links, earlier versions, chat history and
+// API tokens. The audit log is append-only and keeps the old name. Running it
+// twice is harmless, so a link that fails half-way can simply be retried.
+func handOverRecords(ctx context.Context, from, to string) error {
+	steps := []struct {
+		what  string
+		coll  *mongo.Collection
+		field string
+	}{
+		{"prescriptions", prescriptionsColl, "patient_id"},
+		{"images", imagesBucket.GetFilesCollection(), "metadata.patient_id"},
+		{"voice recordings", audioBucket.GetFilesCollection(), "metadata.patient_id"},
+		{"share links", shareLinksColl, "patient_id"},
+		{"analysis revisions", analysisRevisionsColl, "patient_id"},
+		{"chat history", chatMessagesColl, "username"},
+		{"API tokens", apiTokensColl, "username"},
+	}
+	for _, step := range steps {
+		if _, err := step.coll.UpdateMany(ctx, bson.M{step.field: from}, bson.M{"$set": bson.M{step.field: to}}); err != nil {
+			return fmt.Errorf("moving %s: %w", step.what, err)
+		}
+	}
+	return nil
+}
+
+// phoneUser finds the account linked to phone, creating a phone-only one (no
+// password, so it cannot sign in on the web) for numbers seen the first time.
+func phoneUser(phone string) (User, bool, error) {
+	ctx := context.Background()
+	var user User
+	err := usersColl.FindOne(ctx, bson.M{"phone": phone}).Decode(&user)
+	if err != mongo.ErrNoDocuments {
+		return user, false, err
+	}
+
+	language := os.Getenv("SMS_DEFAULT_LANGUAGE")
+	if _, ok := lookupLanguage(language); !ok {
+		language = defaultLanguage
+	}
+	username := smsUsernamePrefix + strings.TrimPrefix(phone, "+")
+	retired, err := usernameRetired(username)
+	if err != nil {
+		return user, false, err
+	}
+	if retired {
+		// The number's earlier account was deleted; start a new history
+		username += "-" + primitive.NewObjectID().Hex()
+	}
+	user = User{
+		Username: username,
+		Role:     "patient",
+		Phone:    phone,
+		Language: language,
+	}
+	if _, err := usersColl.InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// Another message from the same number got there first
+			err = usersColl.FindOne(ctx, bson.M{"phone": phone}).Decode(&user)
+			return user, false, err
+		}
+		return user, false, err
+	}
+	return user, true, nil
+}
+
+// smsInboundHandler answers an inbound SMS: POST /sms/inbound
+func smsInboundHandler(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("SMS_WEBHOOK_TOKEN")
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	given := r.URL.Query().Get("token")
+	if given == "" {
+		given = r.Header.Get("X-Webhook-Token")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msg, err := parseInboundSMS(r)
+	if err != nil {
+		log.Printf("Error parsing inbound SMS: %v", err)
+		httpError(w, r, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	phone := normalizePhone(msg.From)
+	if phone == "" {
+		httpError(w, r, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	if msg.ID != "" && messageSeen(msg.ID) {
+		writeSMSReply(w, msg, nil)
+		return
+	}
+
+	if reply, ok := linkPhoneReply(phone, msg.Text); ok {
+		writeSMSReply(w, msg, splitSMS(reply, smsMaxSegments()))
+		return
+	}
+
+	user, created, err := phoneUser(phone)
+	if err != nil {
+		log.Printf("Error finding SMS user: %v", err)
+		httpError(w, r, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	reply := answerText(r.Context(), "sms", user, phone, msg.Text)
+	if created {
+		reply = translate(languageOrDefault(user.Language).Code, "sms.welcome") + "\n" + reply
+	}
+	writeSMSReply(w, msg, splitSMS(reply, smsMaxSegments()))
+}
+
+// messageSeen records a gateway message ID and reports whether it was
+// already handled in the last ten minutes.
+func messageSeen(id string) bool {
+	seenMessagesMu.Lock()
+	defer seenMessagesMu.Unlock()
+	now := time.Now()
+	for k, t := range seenMessages {
+		if now.Sub(t) > 10*time.Minute {
+			delete(seenMessages, k)
+		}
+	}
+	if _, ok := seenMessages[id]; ok {
+		return true
+	}
+	seenMessages[id] = now
+	return false
+}
+
+// linkPhoneReply handles a "LINK <code>" message; ok is false for any other
+// text.
+func linkPhoneReply(phone, text string) (reply string, ok bool) {
+	keyword, code, _ := strings.Cut(strings.TrimSpace(text), " ")
+	if !strings.EqualFold(keyword, "LINK") {
+		return "", false
+	}
+	user, err := linkPhone(phone, strings.TrimSpace(code))
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Error linking phone: %v", err)
+		}
+		return translate(defaultLanguage, "sms.link_failed"), true
+	}
+	lang := languageOrDefault(user.Language).Code
+	return translate(lang, "sms.linked", map[string]string{"username": user.Username}), true
+}
+
+// answerText runs the keyword or question in a text message and returns the
+// reply in the user's language. channel ("sms" or "whatsapp") names the rate
+// limits and the help text.
+func answerText(ctx context.Context, channel string, user User, phone, text string) string {
+	lang := languageOrDefault(user.Language)
+	keyword, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToUpper(keyword) {
+	case "", "HELP":
+		return translate(lang.Code, channel+".help")
+	case "LANG":
+		next, ok := lookupLanguageName(rest)
+		if !ok {
+			var codes []string
+			for _, l := range supportedLanguages {
+				codes = append(codes, l.Code)
+			}
+			return translate(lang.Code, "sms.unknown_language", map[string]string{"codes": strings.Join(codes, ", ")})
+		}
+		if _, err := usersColl.UpdateOne(ctx, bson.M{"username": user.Username}, bson.M{"$set": bson.M{"language": next.Code}}); err != nil {
+			log.Printf("Error saving SMS language: %v", err)
+			return translate(lang.Code, "sms.failed")
+		}
+		return translate(next.Code, "sms.language_set", map[string]string{"language": next.NativeName})
+	}
+
+	if ok, wait := allowScopes(channel, map[string]string{"user": user.Username, "phone": phone}); !ok {
+		return translate(lang.Code, "limits.rate_limited", map[string]string{"wait": formatWait(lang.Code, wait)})
+	}
+	usage, refused := chargePhoneQuota(user.Username, phone, lang.Code)
+	if refused != "" {
+		return refused
+	}
+
+	var response string
+	var cached bool
+	var err error
+	if strings.EqualFold(keyword, "SYM") {
+		if rest == "" {
+			usage.refund()
+			return translate(lang.Code, channel+".help")
+		}
+		response, cached, err = askDiseasePrediction(ctx, user.Username, lang, parseSMSSymptoms(rest))
+	} else {
+		response, cached, err = askChat(ctx, user.Username, lang, text)
+	}
+	if err != nil || cached {
+		usage.refund()
+	}
+	if err != nil {
+		log.Printf("Error answering SMS: %v", err)
+		var aiErr *AIError
+		if errors.As(err, &aiErr) {
+			return translate(lang.Code, "ai."+aiErr.Kind)
+		}
+		return translate(lang.Code, "sms.failed")
+	}
+	return response
+}
+
+// chargePhoneQuota charges the number's quota and the account's, returning
+// the refusal message if either is used up.
+func chargePhoneQuota(username, phone, lang string) (quotaUsage, string) {
+	quota := limits.Quotas.Default
+	if limits.Quotas.SMS != nil {
+		quota = *limits.Quotas.SMS
+	}
+	if q, ok := limits.Quotas.Phones[phone]; ok {
+		quota = q
+	}
+
+	phoneUsage, err := consumeQuota("phone:"+phone, quota)
+	if err == nil && phoneUsage.Exceeded == "" {
+		var userUsage quotaUsage
+		userUsage, err = consumeAIQuota(username)
+		if err == nil && userUsage.Exceeded != "" {
+			phoneUsage.refund()
+			phoneUsage = userUsage
+		} else {
+			phoneUsage.charged = append(phoneUsage.charged, userUsage.charged...)
+		}
+	}
+	if err != nil {
+		log.Printf("Error checking SMS quota for %s: %v", phone, err)
+		return phoneUsage, translate(lang, "sms.failed")
+	}
+	if phoneUsage.Exceeded != "" {
+		return phoneUsage, translate(lang, "limits.quota_"+phoneUsage.Exceeded, map[string]string{
+			"limit": strconv.FormatInt(phoneUsage.Limit, 10),
+			"wait":  formatWait(lang, time.Until(phoneUsage.ResetsAt)),
+		})
+	}
+	return phoneUsage, ""
+}
+
+// parseSMSSymptoms reads "SYM 34 f fever and cough": an optional age and
+// gender before the symptoms.
+func parseSMSSymptoms(text string) DiseasePredictionRequest {
+	var req DiseasePredictionRequest
+	words := strings.Fields(text)
+	if len(words) > 1 {
+		if age, err := strconv.Atoi(words[0]); err == nil && age > 0 && age < 130 {
+			req.Age = words[0]
+			words = words[1:]
+		}
+	}
+	if len(words) > 1 {
+		switch strings.ToLower(words[0]) {
+		case "m", "male":
+			req.Gender, words = "male", words[1:]
+		case "f", "female":
+			req.Gender, words = "female", words[1:]
+		}
+	}
+	req.Symptoms = strings.Join(words, " ")
+	return req
+}
+
+// lookupLanguageName accepts a language code or its English or native name.
+func lookupLanguageName(s string) (Language, bool) {
+	s = strings.TrimSpace(s)
+	for _, l := range supportedLanguages {
+		if strings.EqualFold(s, l.Code) || strings.EqualFold(s, l.Name) || s == l.NativeName {
+			return l, true
+		}
+	}
+	return Language{}, false
+}
+
+// smsLength is the message length in the units an SMS counts: GSM 03.38
+// septets when every character is in that alphabet, UTF-16 units otherwise.
+func smsLength(s string) (int, bool) {
+	n := 0
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune(gsm7Basic, c):
+			n++
+		case strings.ContainsRune(gsm7Extended, c):
+			n += 2
+		default:
+			return len(utf16.Encode([]rune(s))), false
+		}
+	}
+	return n, true
+}
+
+// splitSMS breaks text into messages that each fit one SMS, numbered
+// "(1/3) ", at most max of them; a longer text is cut short with "...".
+// Indic scripts need UCS-2, which fits 70 characters rather than 160.
+func splitSMS(text string, max int) []string {
+	text = strings.Join(strings.Fields(text), " ")
+	total, gsm := smsLength(text)
+	limit := ucs2SegmentLength
+	if gsm {
+		limit = gsm7SegmentLength
+	}
+	if total <= limit {
+		return []string{text}
+	}
+
+	// Room for the "(i/n) " counter
+	capacity := limit - len(fmt.Sprintf("(%d/%d) ", max, max))
+	var segments []string
+	var current strings.Builder
+	currentLen := 0
+	flush := func() {
+		if current.Len() > 0 {
+			segments = append(segments, current.String())
+			current.Reset()
+			currentLen = 0
+		}
+	}
+	for _, word := range strings.Fields(text) {
+		wordLen, _ := smsLength(word)
+		if !gsm {
+			wordLen = len(utf16.Encode([]rune(word)))
+		}
+		sep := 0
+		if currentLen > 0 {
+			sep = 1
+		}
+		if currentLen+sep+wordLen <= capacity {
+			if sep == 1 {
+				current.WriteByte(' ')
+			}
+			current.WriteString(word)
+			currentLen += sep + wordLen
+			continue
+		}
+		flush()
+		// A word longer than a whole segment is split mid-word
+		for _, c := range word {
+			cLen, _ := smsLength(string(c))
+			if !gsm {
+				cLen = len(utf16.Encode([]rune{c}))
+			}
+			if currentLen+cLen > capacity {
+				flush()
+			}
+			current.WriteRune(c)
+			currentLen += cLen
+		}
+	}
+	flush()
+
+	if len(segments) > max {
+		segments = segments[:max]
+		last := []rune(segments[max-1])
+		for {
+			n, _ := smsLength(string(last) + "...")
+			if !gsm {
+				n = len(utf16.Encode(last)) + 3
+			}
+			if n <= capacity || len(last) == 0 {
+				break
+			}
+			last = last[:len(last)-1]
+		}
+		segments[max-1] = strings.TrimSpace(string(last)) + "..."
+	}
+	for i := range segments {
+		segments[i] = fmt.Sprintf("(%d/%d) %s", i+1, len(segments), segments[i])
+	}
+	return segments
+}
+
+// writeSMSReply delivers the reply segments: to SMS_REPLY_URL when it is
+// set, otherwise in the webhook response.
+func writeSMSReply(w http.ResponseWriter, msg InboundSMS, segments []string) {
+	if replyURL := os.Getenv("SMS_REPLY_URL"); replyURL != "" {
+		for _, segment := range segments {
+			if err := postSMS(replyURL, msg.To, msg.From, segment); err != nil {
+				log.Printf("Error sending SMS reply: %v", err)
+				break
+			}
+		}
+		segments = nil
+	}
+
+	if msg.Twilio {
+		type twimlMessage struct {
+			Body string `xml:",chardata"`
+		}
+		reply := struct {
+			XMLName  xml.Name       `xml:"Response"`
+			Messages []twimlMessage `xml:"Message"`
+		}{}
+		for _, segment := range segments {
+			reply.Messages = append(reply.Messages, twimlMessage{segment})
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	if segments == nil {
+		segments = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"to":       msg.From,
+		"messages": segments,
+	})
+}
+
+// postSMS sends one message through the gateway's HTTP API.
+func postSMS(url, from, to, text string) error {
+	body, err := json.Marshal(map[string]string{"from": from, "to": to, "text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := os.Getenv("SMS_REPLY_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("gateway answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// useTestDatabase points the collections at a throwaway database on
+// MONGODB_TEST_URI, which is dropped afterwards. Tests that need MongoDB are
+// skipped without it.
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+	ctx := context.Background()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := c.Database(fmt.Sprintf("cura_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		c.Disconnect(ctx)
+	})
+
+	usersColl = db.Collection("users")
+	prescriptionsColl = db.Collection("prescriptions")
+	shareLinksColl = db.Collection("share_links")
+	shareAccessesColl = db.Collection("share_accesses")
+	chatMessagesColl = db.Collection("chat_messages")
+	auditColl = db.Collection("audit_log")
+	apiTokensColl = db.Collection("api_tokens")
+	analysisRevisionsColl = db.Collection("analysis_revisions")
+	retiredUsernamesColl = db.Collection("retired_usernames")
+	if imagesBucket, err = gridfs.NewBucket(db, options.GridFSBucket().SetName("prescription_images")); err != nil {
+		t.Fatal(err)
+	}
+	if audioBucket, err = gridfs.NewBucket(db, options.GridFSBucket().SetName("chat_audio")); err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, encryptionKeySize)
+	rand.Read(key)
+	encryptionKeys = keyring{primary: "test", keys: map[string][]byte{"test": key}}
+}
+
+func TestLinkPhoneHandsOverWhatsAppUploads(t *testing.T) {
+	useTestDatabase(t)
+	ctx := context.Background()
+	const phone = "+919800000001"
+
+	// A prescription sent over WhatsApp belongs to the phone-only account
+	smsUser, created, err := phoneUser(phone)
+	if err != nil || !created {
+		t.Fatalf("phoneUser: %v (created %v)", err, created)
+	}
+	imageID, err := storePrescriptionImage(smsUser.Username, "whatsapp.jpg", []byte("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prescription := Prescription{
+		PatientID:  smsUser.Username,
+		ImageID:    imageID,
+		Analysis:   `{"medicines": [{"name": "Metformin 500mg", "dosage": "twice a day"}]}`,
+		Language:   "en",
+		UploadDate: time.Now(),
+	}
+	result, err := prescriptionsColl.InsertOne(ctx, prescription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prescriptionID := result.InsertedID.(primitive.ObjectID)
+	if _, err := shareLinksColl.InsertOne(ctx, ShareLink{
+		PrescriptionID: prescriptionID,
+		PatientID:      smsUser.Username,
+		CreatedAt:      time.Now(),
+		ExpiresAt:      time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := analysisRevisionsColl.InsertOne(ctx, AnalysisRevision{
+		PrescriptionID: prescriptionID,
+		PatientID:      smsUser.Username,
+		Version:        1,
+		Author:         "model",
+		AuthorRole:     "model",
+		Analysis:       prescription.Analysis,
+		CreatedAt:      time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The number is then linked to a web account
+	if _, err := usersColl.InsertOne(ctx, User{Username: "asha", Password: hashPassword("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPhone("asha", phone); err != nil {
+		t.Fatal(err)
+	}
+	var asha User
+	if err := usersColl.FindOne(ctx, bson.M{"username": "asha"}).Decode(&asha); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := linkPhone(phone, asha.PhoneLink.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := searchPrescriptions(ctx, "asha", HistoryQuery{Medicine: "metformin", Sort: "newest", Page: 1, PerPage: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Prescriptions[0].ID != prescriptionID {
+		t.Fatalf("history of the web account has %d prescriptions, want the WhatsApp upload", page.Total)
+	}
+	meta, err := prescriptionImageMetadata(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.PatientID != "asha" {
+		t.Errorf("image belongs to %q, want asha", meta.PatientID)
+	}
+	for name, coll := range map[string]*mongo.Collection{"share links": shareLinksColl, "revisions": analysisRevisionsColl} {
+		if n, err := coll.CountDocuments(ctx, bson.M{"patient_id": "asha"}); err != nil || n != 1 {
+			t.Errorf("%s of the web account: %d (%v), want 1", name, n, err)
+		}
+	}
+	if n, err := usersColl.CountDocuments(ctx, bson.M{"username": smsUser.Username}); err != nil || n != 0 {
+		t.Errorf("phone-only account still exists (%d, %v)", n, err)
+	}
+}
@@ -52,7 +52,8 @@ document.addEventListener('DOMContentLoaded', () => {
       });
       
       const result = await response.json();
-      addMessage('bot', result.response);
+      // Errors (rate limits, quota, AI outages) carry a message in the user's language
+      addMessage('bot', response.ok ? result.response : result.message);
     } catch (error) {
       console.error('Error:', error);
       addMessage('bot', 'Sorry, there was an error processing your request.');
@@ -76,13 +77,104 @@ document.addEventListener('DOMContentLoaded', () => {
       });
       
       const result = await response.json();
-      addMessage('bot', result.response);
+      addMessage('bot', response.ok ? result.response : result.message);
     } catch (error) {
       console.error('Error:', error);
       addMessage('bot', 'Sorry, there was an error processing your query.');
     }
   });
 
+  // Voice questions: record with the microphone and send the audio; the
+  // server answers with the transcript so the user sees what was understood
+  const voiceBtn = document.querySelector('.voice-btn');
+  const voiceSymptomsBtn = document.querySelector('.voice-symptoms-btn');
+  const keepAudio = document.getElementById('keepAudio');
+  let recorder = null;
+
+  function voiceText(key) {
+    const el = document.querySelector(`#voiceTexts [data-i18n="voice.${key}"]`);
+    return el ? el.textContent : key;
+  }
+
+  function recordingType() {
+    if (!window.MediaRecorder || !navigator.mediaDevices) return null;
+    return ['audio/webm', 'audio/ogg'].find(t => MediaRecorder.isTypeSupported(t)) || null;
+  }
+
+  async function toggleRecording(button, onDone) {
+    if (recorder) {
+      recorder.stop();
+      return;
+    }
+    const mimeType = recordingType();
+    if (!mimeType) {
+      addMessage('bot', voiceText('mic_unavailable'));
+      return;
+    }
+    let stream;
+    try {
+      stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+    } catch (error) {
+      addMessage('bot', voiceText('mic_unavailable'));
+      return;
+    }
+    const chunks = [];
+    recorder = new MediaRecorder(stream, { mimeType });
+    recorder.addEventListener('dataavailable', e => chunks.push(e.data));
+    recorder.addEventListener('stop', () => {
+      stream.getTracks().forEach(t => t.stop());
+      button.classList.remove('recording');
+      button.title = '';
+      recorder = null;
+      onDone(new Blob(chunks, { type: mimeType }));
+    });
+    recorder.start();
+    button.classList.add('recording');
+    button.title = voiceText('recording');
+  }
+
+  async function sendVoice(url, audio, fields) {
+    const body = new FormData();
+    body.append('audio', audio, 'question' + (audio.type === 'audio/ogg' ? '.ogg' : '.webm'));
+    body.append('keep_audio', keepAudio && keepAudio.checked ? 'true' : 'false');
+    Object.entries(fields || {}).forEach(([k, v]) => body.append(k, v));
+    try {
+      const response = await fetch(url, { method: 'POST', body });
+      const result = await response.json();
+      if (!response.ok) {
+        addMessage('bot', result.message);
+        return;
+      }
+      addMessage('user', '🎤 ' + result.transcript);
+      addMessage('bot', result.response);
+    } catch (error) {
+      console.error('Error:', error);
+      addMessage('bot', 'Sorry, there was an error processing your query.');
+    }
+  }
+
+  if (voiceBtn) {
+    voiceBtn.addEventListener('click', () => {
+      toggleRecording(voiceBtn, audio => sendVoice('/chat', audio));
+    });
+  }
+
+  if (voiceSymptomsBtn) {
+    voiceSymptomsBtn.addEventListener('click', () => {
+      const form = document.getElementById('diseaseForm');
+      if (!recorder && !form.elements.age.reportValidity()) return;
+      toggleRecording(voiceSymptomsBtn, audio => {
+        const fields = {
+          age: form.elements.age.value,
+          gender: form.elements.gender.value,
+          medical_history: form.elements.medical_history.value
+        };
+        document.getElementById('general_section').click();
+        sendVoice('/predict-disease', audio, fields);
+      });
+    });
+  }
+
   function addMessage(sender, text) {
     const messageDiv = document.createElement('div');
     messageDiv.classList.add('message', `${sender}-message`);
@@ -1,31 +1,63 @@
 /* Simple client-side i18n with JSON locale files and data attributes
-   - Uses localStorage 'cura_lang'
-   - Detects from navigator.language if none set
+   - Pages arrive already translated by the server; this handles switching
+     language without a reload and the strings scripts insert later
+   - Supported languages come from the server's registry (/languages)
+   - Uses the 'cura_lang' cookie (set from the account on login), then localStorage
+   - Otherwise keeps the language the server negotiated from Accept-Language (<html lang>)
+   - Keys missing from a locale fall back to English
    - Replaces text for elements with data-i18n
    - Supports attribute translations via data-i18n-attr="attr:key,attr2:key2"
 */
 (function() {
   const DEFAULT_LANG = 'en';
-  const SUPPORTED = ['en','pa','hi'];
+  let LANGUAGES = [{ code: 'en', native_name: 'English' }];
+  let SUPPORTED = ['en'];
+
+  function loadLanguages() {
+    return fetch('/languages').then(r => {
+      if (!r.ok) throw new Error('Languages not available');
+      return r.json();
+    }).then(data => {
+      LANGUAGES = data.languages;
+      SUPPORTED = LANGUAGES.map(l => l.code);
+    }).catch(() => {});
+  }
+
+  function getCookieLang() {
+    const m = document.cookie.match(/(?:^|;\s*)cura_lang=([^;]+)/);
+    return m ? m[1] : null;
+  }
 
   function getSavedLang() {
     try { return localStorage.getItem('cura_lang'); } catch(e) { return null; }
   }
 
   function detectLang() {
+    const cookie = getCookieLang();
+    if (cookie && SUPPORTED.includes(cookie)) return cookie;
     const saved = getSavedLang();
     if (saved && SUPPORTED.includes(saved)) return saved;
-    const nav = (navigator.language || navigator.userLanguage || '').toLowerCase();
-    const cand = nav.split('-')[0];
-    if (SUPPORTED.includes(cand)) return cand;
+    const served = document.documentElement.getAttribute('lang');
+    if (served && SUPPORTED.includes(served)) return served;
     return DEFAULT_LANG;
   }
 
   function setLang(lang) {
     try { localStorage.setItem('cura_lang', lang); } catch(e) {}
+    // Lets the server answer errors in the same language
+    document.cookie = `cura_lang=${lang}; path=/; max-age=31536000; SameSite=Lax`;
     document.documentElement.setAttribute('lang', lang);
   }
 
+  // Saves the choice on the account when signed in; the server also sets the cookie
+  function savePreference(lang) {
+    fetch('/languages', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ language: lang })
+    }).catch(() => {});
+  }
+
   function fetchLocale(lang) {
     const url = `/static/locales/${lang}.json`;
     return fetch(url).then(r => {
@@ -34,6 +66,23 @@
     });
   }
 
+  function merge(base, over) {
+    const out = Object.assign({}, base);
+    Object.keys(over || {}).forEach(k => {
+      const v = over[k];
+      out[k] = (v && typeof v === 'object' && base[k] && typeof base[k] === 'object') ? merge(base[k], v) : v;
+    });
+    return out;
+  }
+
+  // English fills any keys a locale has not translated yet
+  let english = null;
+  async function fetchDict(lang) {
+    if (!english) english = await fetchLocale(DEFAULT_LANG).catch(() => ({}));
+    if (lang === DEFAULT_LANG) return english;
+    return merge(english, await fetchLocale(lang));
+  }
+
   function get(obj, path) {
     return path.split('.').reduce((o,k) => (o && o[k] != null) ? o[k] : null, obj);
   }
@@ -65,14 +114,9 @@
     const select = document.createElement('select');
     select.id = 'languageSelect';
     select.className = 'lang-select';
-    const options = [
-      ['en','English'],
-      ['hi','हिन्दी'],
-      ['pa','ਪੰਜਾਬੀ']
-    ];
-    options.forEach(([val,label]) => {
+    LANGUAGES.forEach(l => {
       const opt = document.createElement('option');
-      opt.value = val; opt.textContent = label; select.appendChild(opt);
+      opt.value = l.code; opt.textContent = l.native_name; select.appendChild(opt);
     });
     select.value = current;
     // Place near auth-buttons if present
@@ -92,28 +136,24 @@
   }
 
   async function init() {
+    await loadLanguages();
     const lang = detectLang();
     setLang(lang);
     try {
-      const dict = await fetchLocale(lang);
-      applyTranslations(dict);
+      applyTranslations(await fetchDict(lang));
     } catch(e) {
-      if (lang !== DEFAULT_LANG) {
-        try {
-          const dict = await fetchLocale(DEFAULT_LANG);
-          applyTranslations(dict);
-        } catch(_) {}
-      }
+      if (english) applyTranslations(english);
     }
     const sel = ensureLanguageSelector(lang);
     sel.addEventListener('change', async (e) => {
       const next = e.target.value;
       if (!SUPPORTED.includes(next)) return;
       setLang(next);
+      savePreference(next);
       try {
-        const dict = await fetchLocale(next);
-        applyTranslations(dict);
+        applyTranslations(await fetchDict(next));
       } catch(_) {}
+      document.dispatchEvent(new CustomEvent('cura:languagechange', { detail: next }));
     });
   }
 
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Uploads are checked before anything is stored or sent to the model: the
+// request size is capped, the type is sniffed from the content (the
+// browser's Content-Type is ignored), image dimensions are read from the
+// header before decoding, and images are re-encoded, which drops EXIF/GPS and
+// other metadata. Photos larger than maxStoredSide are downscaled. PDFs are
+// parsed and rewritten without their document info and XMP metadata, and
+// refused if they have more than maxPDFPages pages or carry scripts, actions
+// that open other files, or attached files.
+const (
+	maxUploadBytes = 15 << 20
+	maxImagePixels = 50_000_000
+	maxStoredSide  = 3000
+	maxPDFPages    = 10
+)
+
+var allowedUploadTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+var (
+	errUnsupportedUpload = errors.New("unsupported file type")
+	errUploadTooLarge    = errors.New("image dimensions too large")
+	errInvalidImage      = errors.New("invalid image")
+	errInvalidPDF        = errors.New("invalid PDF")
+	errPDFTooManyPages   = errors.New("too many PDF pages")
+	errPDFActiveContent  = errors.New("PDF with active content")
+)
+
+// activePDFKeys are dictionary keys that only appear with scripts, embedded
+// files, multimedia or XFA forms.
+var activePDFKeys = []string{"JS", "JavaScript", "EmbeddedFile", "EmbeddedFiles", "RichMedia", "XFA"}
+
+// activePDFActions are the action types (an action dictionary's /S) that run
+// code, open other files or send form data.
+var activePDFActions = map[string]bool{
+	"JavaScript": true, "Launch": true, "SubmitForm": true, "ImportData": true,
+	"GoToR": true, "GoToE": true, "Rendition": true, "Sound": true, "Movie": true,
+}
+
+func init() {
+	// Keep pdfcpu from writing a configuration directory on first use
+	api.DisableConfigDir()
+}
+
+// sanitizeUpload validates an upload and returns the bytes to keep and their
+// content type. PDFs come back rewritten without metadata; images come back
+// as JPEG or PNG without metadata, upright and at most maxStoredSide pixels
+// on a side.
+func sanitizeUpload(data []byte) ([]byte, string, error) {
+	contentType := http.DetectContentType(data)
+	if !allowedUploadTypes[contentType] {
+		return nil, contentType, errUnsupportedUpload
+	}
+	if contentType == "application/pdf" {
+		data, err := sanitizePDF(data)
+		return data, contentType, err
+	}
+
+	// Refuse decompression bombs before allocating the pixels
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, contentType, errInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, contentType, errInvalidImage
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, contentType, errUploadTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, contentType, errInvalidImage
+	}
+
+	img := src
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w > maxStoredSide || h > maxStoredSide {
+		if w >= h {
+			w, h = maxStoredSide, h*maxStoredSide/w
+		} else {
+			w, h = w*maxStoredSide/h, maxStoredSide
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+		img = dst
+	}
+
+	// The orientation tag is lost with the rest of the EXIF data, so apply it
+	if contentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	var buf bytes.Buffer
+	if contentType == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, contentType, err
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// sanitizePDF checks a PDF's pages and content and rewrites it without the
+// document info dictionary and XMP metadata streams.
+func sanitizePDF(data []byte) ([]byte, error) {
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	ctx, err := api.ReadAndValidate(bytes.NewReader(data), conf)
+	if err != nil {
+		return nil, errInvalidPDF
+	}
+	if ctx.PageCount < 1 {
+		return nil, errInvalidPDF
+	}
+	if ctx.PageCount > maxPDFPages {
+		return nil, errPDFTooManyPages
+	}
+
+	for _, entry := range ctx.Table {
+		if entry == nil || entry.Free || entry.Object == nil {
+			continue
+		}
+		var dict types.Dict
+		switch obj := entry.Object.(type) {
+		case types.Dict:
+			dict = obj
+		case types.StreamDict:
+			dict = obj.Dict
+		default:
+			continue
+		}
+		if activePDFDict(dict) {
+			return nil, errPDFActiveContent
+		}
+		dict.Delete("Metadata")
+		dict.Delete("PieceInfo")
+	}
+	for _, key := range []string{"OpenAction", "AA"} {
+		if action, ok := ctx.RootDict.Find(key); ok {
+			if dict, err := ctx.DereferenceDict(action); err == nil && activePDFDict(dict) {
+				return nil, errPDFActiveContent
+			}
+		}
+	}
+	ctx.Info = nil
+
+	var buf bytes.Buffer
+	if err := api.WriteContext(ctx, &buf); err != nil {
+		return nil, errInvalidPDF
+	}
+	return buf.Bytes(), nil
+}
+
+// activePDFDict reports whether dict is or holds active content.
+func activePDFDict(dict types.Dict) bool {
+	for _, key := range activePDFKeys {
+		if _, ok := dict.Find(key); ok {
+			return true
+		}
+	}
+	if action := dict.NameEntry("S"); action != nil && activePDFActions[*action] {
+		return true
+	}
+	return false
+}
+
+// jpegOrientation reads the EXIF orientation (1-8) of a JPEG, or 1 if it has
+// none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			i++ // fill byte
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			i += 2 // markers without a length
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			return 1 // image data starts; metadata comes before it
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < entries; k++ {
+		entry := ifd + 2 + 12*k
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation flips and rotates img so it displays upright for the
+// given EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to display
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° anticlockwise to display
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// uploadErrorMessage maps a sanitizeUpload error to a translated message and
+// status code.
+func uploadErrorMessage(lang string, err error) (string, int) {
+	switch err {
+	case errUnsupportedUpload:
+		return translate(lang, "upload.unsupported"), http.StatusUnsupportedMediaType
+	case errUploadTooLarge:
+		return translate(lang, "upload.too_large"), http.StatusRequestEntityTooLarge
+	case errInvalidImage:
+		return translate(lang, "upload.invalid"), http.StatusBadRequest
+	case errInvalidPDF:
+		return translate(lang, "upload.invalid_pdf"), http.StatusBadRequest
+	case errPDFTooManyPages:
+		return translate(lang, "upload.too_many_pages"), http.StatusRequestEntityTooLarge
+	case errPDFActiveContent:
+		return translate(lang, "upload.active_content"), http.StatusUnprocessableEntity
+	}
+	return translate(lang, "upload.invalid"), http.StatusInternalServerError
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// reportSigningKey signs the digest printed on every PDF report so the
+// verification page can tell our reports from forged ones.
+var reportSigningKey []byte
+
+func loadReportSigningKey() {
+	if key := os.Getenv("REPORT_SIGNING_KEY"); key != "" {
+		reportSigningKey = []byte(key)
+		return
+	}
+	log.Println("Warning: REPORT_SIGNING_KEY not set, using a random key; report QR codes and share links will stop working after a restart")
+	reportSigningKey = make([]byte, 32)
+	if _, err := rand.Read(reportSigningKey); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// analysisDigest is the SHA-256 of the stored analysis text.
+func analysisDigest(analysis string) string {
+	sum := sha256.Sum256([]byte(analysis))
+	return hex.EncodeToString(sum[:])
+}
+
+func signReport(prescriptionID, digest string) string {
+	mac := hmac.New(sha256.New, reportSigningKey)
+	mac.Write([]byte(prescriptionID + "|" + digest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// publicBase is PUBLIC_BASE_URL, the scheme and host used in links that leave
+// the app (QR codes, share links, FHIR references). It is required rather than
+// taken from the request, where a forged Host header would put another site
+// into a signed report.
+var publicBase string
+
+func loadPublicBaseURL() {
+	base := strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+	u, err := url.Parse(base)
+	if base == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatal("PUBLIC_BASE_URL must be the address users reach the app at, e.g. https://cura.example.com or http://localhost:8080")
+	}
+	publicBase = base
+}
+
+func publicBaseURL() string {
+	return publicBase
+}
+
+func reportVerificationURL(r *http.Request, prescription Prescription) string {
+	id := prescription.ID.Hex()
+	digest := analysisDigest(prescription.Analysis)
+	q := url.Values{}
+	q.Set("id", id)
+	q.Set("h", digest)
+	q.Set("sig", signReport(id, digest))
+	return publicBaseURL() + "/verify-report?" + q.Encode()
+}
+
+type VerifyPageData struct {
+	Status         string // "valid", "superseded", "altered", "invalid" or "missing"
+	ReportID       string
+	Digest         string
+	UploadDate     time.Time
+	Medicines      []string
+	Version        int    // the version on the report, if superseded
+	CurrentVersion int    // the version in the record, if superseded
+	CurrentURL     string // the verification page of the current version, if superseded
+}
+
+// verifyReportHandler is the public page behind the QR code on PDF reports:
+// GET /verify-report?id=...&h=...&sig=...  (add format=json for JSON)
+func verifyReportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, digest, sig := q.Get("id"), q.Get("h"), q.Get("sig")
+	data := VerifyPageData{ReportID: id, Digest: digest}
+
+	expected := signReport(id, digest)
+	if id == "" || !hmac.Equal([]byte(expected), []byte(sig)) {
+		data.Status = "invalid"
+		writeVerifyResult(w, r, data)
+		return
+	}
+
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		data.Status = "invalid"
+		writeVerifyResult(w, r, data)
+		return
+	}
+
+	var prescription Prescription
+	err = prescriptionsColl.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&prescription)
+	if err == mongo.ErrNoDocuments {
+		data.Status = "missing"
+		writeVerifyResult(w, r, data)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching prescription for verification: %v", err)
+		httpError(w, r, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	data.UploadDate = prescription.UploadDate
+	if analysisDigest(prescription.Analysis) != digest {
+		version, err := reportedVersion(prescription, digest)
+		if err != nil {
+			log.Printf("Error fetching revisions for verification: %v", err)
+			httpError(w, r, "internal", http.StatusInternalServerError)
+			return
+		}
+		if version == 0 {
+			data.Status = "altered"
+			writeVerifyResult(w, r, data)
+			return
+		}
+		recordAudit(r, "public", prescription.PatientID, auditVerify, id)
+		data.Status = "superseded"
+		data.Version, data.CurrentVersion = version, prescription.currentVersion()
+		data.CurrentURL = reportVerificationURL(r, prescription)
+		writeVerifyResult(w, r, data)
+		return
+	}
+
+	// Medicine names let the reader compare the printout with the record
+	var parsed struct {
+		Medicines []struct {
+			Name   string `json:"name"`
+			Dosage string `json:"dosage"`
+		} `json:"medicines"`
+	}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(prescription.Analysis)), &parsed); err == nil {
+		for _, m := range parsed.Medicines {
+			data.Medicines = append(data.Medicines, strings.TrimSpace(m.Name+" "+m.Dosage))
+		}
+	}
+	recordAudit(r, "public", prescription.PatientID, auditVerify, id)
+
+	data.Status = "valid"
+	writeVerifyResult(w, r, data)
+}
+
+// reportedVersion is the earlier version of the prescription's analysis
+// whose digest is digest, or 0 if there is none. A report printed before a
+// correction carries such a digest.
+func reportedVersion(prescription Prescription, digest string) (int, error) {
+	if prescription.OriginalAnalysis != "" && analysisDigest(prescription.OriginalAnalysis) == digest {
+		return 1, nil
+	}
+	ctx := context.Background()
+	cursor, err := analysisRevisionsColl.Find(ctx, bson.M{"prescription_id": prescription.ID})
+	if err != nil {
+		return 0, err
+	}
+	var revisions []AnalysisRevision
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return 0, err
+	}
+	for _, revision := range revisions {
+		if analysisDigest(revision.Analysis) == digest {
+			return revision.Version, nil
+		}
+	}
+	return 0, nil
+}
+
+func writeVerifyResult(w http.ResponseWriter, r *http.Request, data VerifyPageData) {
+	if r.URL.Query().Get("format") == "json" {
+		result := map[string]interface{}{
+			"status":      data.Status,
+			"report_id":   data.ReportID,
+			"digest":      data.Digest,
+			"upload_date": data.UploadDate,
+			"medicines":   data.Medicines,
+		}
+		if data.Status == "superseded" {
+			result["version"] = data.Version
+			result["current_version"] = data.CurrentVersion
+			result["current_url"] = data.CurrentURL
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	renderTemplate(w, requestLang(r), "verify.html", data)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// Voice questions: /chat and /predict-disease also accept a multipart form
+// with a recorded question in the "audio" field (WebM, Ogg or WAV). The model
+// transcribes it, answers in the language that was spoken and returns the
+// transcript so the user can check what was understood. Only the transcript
+// is saved unless the form sets keep_audio=true, in which case the recording
+// is stored encrypted in the "chat_audio" GridFS bucket.
+const maxAudioBytes = 10 << 20
+
+var audioBucket *gridfs.Bucket
+
+var errUnsupportedAudio = errors.New("unsupported audio type")
+
+// VoiceQuestion is a validated recording from the request.
+type VoiceQuestion struct {
+	Audio     []byte
+	MimeType  string
+	KeepAudio bool
+}
+
+// VoiceAnswer is the JSON the voice prompts ask the model for.
+type VoiceAnswer struct {
+	Transcript string `json:"transcript"`
+	Language   string `json:"language"`
+	Response   string `json:"response"`
+}
+
+// isVoiceRequest reports whether the request carries a recording rather
+// than the usual JSON body.
+func isVoiceRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// audioMimeType identifies the recording from its header; the browser's
+// Content-Type is ignored, as for prescription uploads.
+func audioMimeType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "audio/webm", nil
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "audio/ogg", nil
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WAVE":
+		return "audio/wav", nil
+	}
+	return "", errUnsupportedAudio
+}
+
+// readVoiceQuestion parses the multipart form and validates the recording.
+// On failure it has already written the error response.
+func readVoiceQuestion(w http.ResponseWriter, r *http.Request) (*VoiceQuestion, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAudioBytes)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, translate(requestLang(r), "voice.too_big"), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		httpError(w, r, "upload_failed", http.StatusBadRequest)
+		return nil, false
+	}
+
+	file, _, err := r.FormFile("audio")
+	if err != nil {
+		httpError(w, r, "upload_failed", http.StatusBadRequest)
+		return nil, false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		httpError(w, r, "upload_failed", http.StatusBadRequest)
+		return nil, false
+	}
+	mimeType, err := audioMimeType(data)
+	if err != nil {
+		http.Error(w, translate(requestLang(r), "voice.unsupported"), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	return &VoiceQuestion{
+		Audio:     data,
+		MimeType:  mimeType,
+		KeepAudio: r.FormValue("keep_audio") == "true",
+	}, true
+}
+
+// answerVoiceQuestion sends the recording with the named prompt, saves the
+// transcript and answer to the chat history and replies with both.
+func answerVoiceQuestion(w http.ResponseWriter, r *http.Request, username, mode, promptName string, question *VoiceQuestion, data VoicePromptData) {
+	prompt, promptVersion, err := renderPrompt(promptName, data)
+	if err != nil {
+		log.Printf("Error rendering prompt: %v", err)
+		httpError(w, r, "request_failed", http.StatusInternalServerError)
+		return
+	}
+
+	text, err := askGeminiAudio(r.Context(), prompt, question.Audio, question.MimeType)
+	if err != nil {
+		writeAIError(w, r, err)
+		return
+	}
+
+	var answer VoiceAnswer
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(strings.TrimSpace(text))), &answer); err != nil {
+		log.Printf("Error parsing %s answer: %v", promptVersion, err)
+		writeAIError(w, r, &AIError{Kind: aiBadAnswer, Message: "unparseable voice answer"})
+		return
+	}
+	if strings.TrimSpace(answer.Transcript) == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "not_understood",
+			"message": translate(data.LanguageCode, "voice.not_understood"),
+		})
+		return
+	}
+	if _, ok := lookupLanguage(answer.Language); !ok {
+		answer.Language = data.LanguageCode
+	}
+
+	message := ChatMessage{
+		Username:  username,
+		Mode:      mode,
+		Message:   answer.Transcript,
+		Response:  answer.Response,
+		CreatedAt: time.Now(),
+		Voice:     true,
+		Language:  answer.Language,
+	}
+	if question.KeepAudio {
+		id, err := uploadEncryptedFile(audioBucket, "question"+audioExtension(question.MimeType), question.Audio, imageMetadata{
+			PatientID:   username,
+			ContentType: question.MimeType,
+		})
+		if err != nil {
+			log.Printf("Error storing voice recording: %v", err)
+		} else {
+			message.AudioID = id
+		}
+	}
+	if _, err := chatMessagesColl.InsertOne(context.Background(), message); err != nil {
+		log.Printf("Error saving chat message: %v", err)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response":    answer.Response,
+		"transcript":  answer.Transcript,
+		"language":    answer.Language,
+		"audio_saved": !message.AudioID.IsZero(),
+	})
+}
+
+func audioExtension(mimeType string) string {
+	switch mimeType {
+	case "audio/webm":
+		return ".webm"
+	case "audio/ogg":
+		return ".ogg"
+	case "audio/wav":
+		return ".wav"
+	}
+	return ""
+}
+
+// loadChatAudio returns a kept recording and its content type.
+func loadChatAudio(id primitive.ObjectID) ([]byte, string, error) {
+	return loadEncryptedFile(audioBucket, id)
+}
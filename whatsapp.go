@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WhatsApp bot, modelled on the WhatsApp Cloud API. Meta verifies the
+// webhook with GET /whatsapp/webhook?hub.mode=subscribe&hub.verify_token=...
+// and then POSTs messages signed with the app secret (X-Hub-Signature-256).
+// A photo or PDF of a prescription is analysed like a dashboard upload and
+// answered with a short summary in the user's language, the reminder times
+// and a share link to the full report; text messages are handled as on the
+// SMS channel and numbers map to accounts the same way. Replies are sent
+// through the Graph API at WHATSAPP_API_URL, for which cmd/whatsappstub can
+// stand in locally.
+
+const (
+	defaultWhatsAppAPIURL = "https://graph.facebook.com/v21.0"
+	maxWhatsAppText       = 4096
+	whatsappReplyTimeout  = 3 * time.Minute
+)
+
+var errWhatsAppMediaTooBig = errors.New("media file too large")
+
+type whatsappPayload struct {
+	Object string `json:"object"`
+	Entry  []struct {
+		Changes []struct {
+			Field string `json:"field"`
+			Value struct {
+				Metadata struct {
+					PhoneNumberID string `json:"phone_number_id"`
+				} `json:"metadata"`
+				Messages []whatsappMessage `json:"messages"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+type whatsappMessage struct {
+	From string `json:"from"` // the sender's number, digits only
+	ID   string `json:"id"`
+	Type string `json:"type"` // "text", "image", "document", ...
+	Text *struct {
+		Body string `json:"body"`
+	} `json:"text,omitempty"`
+	Image    *whatsappMedia `json:"image,omitempty"`
+	Document *whatsappMedia `json:"document,omitempty"`
+}
+
+type whatsappMedia struct {
+	ID       string `json:"id"`
+	MimeType string `json:"mime_type"`
+	Filename string `json:"filename,omitempty"`
+	Caption  string `json:"caption,omitempty"`
+}
+
+func whatsappAPIURL() string {
+	if url := os.Getenv("WHATSAPP_API_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return defaultWhatsAppAPIURL
+}
+
+// whatsappWebhookHandler verifies the webhook (GET) and receives messages
+// (POST): /whatsapp/webhook
+func whatsappWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("WHATSAPP_APP_SECRET")
+	if secret == "" || os.Getenv("WHATSAPP_ACCESS_TOKEN") == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		token := os.Getenv("WHATSAPP_VERIFY_TOKEN")
+		if q.Get("hub.mode") != "subscribe" || token == "" ||
+			subtle.ConstantTimeCompare([]byte(q.Get("hub.verify_token")), []byte(token)) != 1 {
+			httpError(w, r, "unauthorized", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(q.Get("hub.challenge")))
+
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		if !validWhatsAppSignature(secret, body, r.Header.Get("X-Hub-Signature-256")) {
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var payload whatsappPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			httpError(w, r, "invalid_request", http.StatusBadRequest)
+			return
+		}
+
+		// Meta expects a quick 200 and retries otherwise, but an analysis
+		// takes longer, so messages are answered in the background
+		for _, entry := range payload.Entry {
+			for _, change := range entry.Changes {
+				for _, msg := range change.Value.Messages {
+					if msg.ID != "" && messageSeen(msg.ID) {
+						continue
+					}
+					go handleWhatsAppMessage(r.Clone(context.Background()), change.Value.Metadata.PhoneNumberID, msg)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		httpError(w, r, "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validWhatsAppSignature checks the "sha256=<hex>" HMAC of the body.
+func validWhatsAppSignature(secret string, body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	given, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// handleWhatsAppMessage answers one message. r is a copy of the webhook
+// request, used for the audit log.
+func handleWhatsAppMessage(r *http.Request, phoneNumberID string, msg whatsappMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), whatsappReplyTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	send := func(text string) {
+		if err := sendWhatsAppText(ctx, phoneNumberID, msg.From, text); err != nil {
+			log.Printf("Error sending WhatsApp reply: %v", err)
+		}
+	}
+
+	phone := normalizePhone("+" + msg.From)
+	if phone == "" {
+		log.Printf("Ignoring WhatsApp message from invalid number %q", msg.From)
+		return
+	}
+	if msg.Type == "text" && msg.Text != nil {
+		if reply, ok := linkPhoneReply(phone, msg.Text.Body); ok {
+			send(reply)
+			return
+		}
+	}
+
+	user, created, err := phoneUser(phone)
+	if err != nil {
+		log.Printf("Error finding WhatsApp user: %v", err)
+		return
+	}
+	lang := languageOrDefault(user.Language).Code
+	if created {
+		send(translate(lang, "sms.welcome"))
+	}
+
+	switch {
+	case msg.Type == "text" && msg.Text != nil:
+		send(answerText(ctx, "whatsapp", user, phone, msg.Text.Body))
+	case msg.Type == "image" && msg.Image != nil:
+		send(analyzeWhatsAppPrescription(r, phoneNumberID, user, phone, *msg.Image, send))
+	case msg.Type == "document" && msg.Document != nil:
+		send(analyzeWhatsAppPrescription(r, phoneNumberID, user, phone, *msg.Document, send))
+	default:
+		send(translate(lang, "whatsapp.help"))
+	}
+}
+
+// analyzeWhatsAppPrescription downloads the photo, runs it through
+// analyzePrescription and returns the reply.
+func analyzeWhatsAppPrescription(r *http.Request, phoneNumberID string, user User, phone string, media whatsappMedia, send func(string)) string {
+	lang := languageOrDefault(user.Language).Code
+	if ok, wait := allowScopes("whatsapp", map[string]string{"user": user.Username, "phone": phone}); !ok {
+		return translate(lang, "limits.rate_limited", map[string]string{"wait": formatWait(lang, wait)})
+	}
+	usage, refused := chargePhoneQuota(user.Username, phone, lang)
+	if refused != "" {
+		return refused
+	}
+
+	send(translate(lang, "whatsapp.analysing"))
+	data, err := downloadWhatsAppMedia(r.Context(), media.ID)
+	if err != nil {
+		usage.refund()
+		if err == errWhatsAppMediaTooBig {
+			return translate(lang, "upload.file_too_big")
+		}
+		log.Printf("Error downloading WhatsApp media: %v", err)
+		return translate(lang, "whatsapp.download_failed")
+	}
+
+	filename := media.Filename
+	if filename == "" {
+		filename = "whatsapp-" + media.ID
+	}
+	result, err := analyzePrescription(r, user.Username, AnalysisUpload{
+		Filename: filename,
+		Data:     data,
+		Language: lang,
+		WhatsApp: phoneNumberID,
+	})
+	if err != nil || result.Duplicate != "" {
+		usage.refund()
+	}
+	var retake *RetakeError
+	var aiErr *AIError
+	switch {
+	case errors.As(err, &retake):
+		return retakeMessage(lang, retake.Quality)
+	case errors.As(err, &aiErr):
+		log.Printf("Error calling Gemini: %v", err)
+		return translate(lang, "ai."+aiErr.Kind)
+	case err != nil && result.Rejected:
+		message, _ := uploadErrorMessage(lang, err)
+		return message
+	case err != nil:
+		log.Printf("Error analyzing WhatsApp prescription: %v", err)
+		return translate(lang, "sms.failed")
+	}
+	switch prescription := result.Prescription; {
+	case prescription.Withheld() && prescription.Review.Status == reviewPending:
+		return translate(lang, "review.whatsapp_pending")
+	case prescription.Withheld():
+		return reviewOutcomeText(lang, prescription)
+	}
+	return whatsappSummary(r, user.Username, lang, result)
+}
+
+// whatsappSummary is the short reply to an analysed prescription: doctor,
+// medicines, warnings, reminder times and a link to the full report.
+func whatsappSummary(r *http.Request, username, lang string, result AnalysisResult) string {
+	prescription := result.Prescription
+	var analysis map[string]interface{}
+	if err := json.Unmarshal([]byte(cleanAnalysisJSON(prescription.Analysis)), &analysis); err != nil {
+		log.Printf("Error parsing analysis data: %v", err)
+	}
+	// The reply carries the analysis; a duplicate was logged when it was found
+	if !prescription.ID.IsZero() && result.Duplicate == "" {
+		recordAudit(r, username, username, auditView, prescription.ID.Hex())
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + translate(lang, "whatsapp.summary_title") + "*\n")
+	if result.Duplicate != "" {
+		b.WriteString(translate(lang, "whatsapp.duplicate") + "\n")
+	}
+	if prescriber := analysisText(analysis["prescriber"]); prescriber != "" {
+		b.WriteString(translate(lang, "whatsapp.prescriber", map[string]string{"name": prescriber}) + "\n")
+	}
+	if date := analysisText(analysis["date"]); date != "" {
+		b.WriteString(translate(lang, "whatsapp.date", map[string]string{"date": date}) + "\n")
+	}
+
+	medicines, _ := analysis["medicines"].([]interface{})
+	if len(medicines) > 0 {
+		b.WriteString("\n*" + translate(lang, "whatsapp.medicines") + "*\n")
+	}
+	for _, med := range medicines {
+		medicine, ok := med.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		line := "• " + analysisText(medicine["name"])
+		if dosage := analysisText(medicine["dosage"]); dosage != "" {
+			line += " " + dosage
+		}
+		if purpose := analysisText(medicine["purpose"]); purpose != "" {
+			line += " – " + purpose
+		}
+		b.WriteString(line + "\n")
+	}
+
+	for _, warning := range userPregnancyWarnings(username, prescription.Analysis, lang) {
+		b.WriteString("⚠️ " + warning.Title + ": " + warning.Message + "\n")
+	}
+
+	b.WriteString("\n*" + translate(lang, "whatsapp.reminders") + "*\n")
+	reminders := reminderSchedule(prescription.Analysis)
+	if len(reminders) == 0 {
+		b.WriteString(translate(lang, "whatsapp.no_reminders") + "\n")
+	}
+	for _, reminder := range reminders {
+		var doses []string
+		for _, dose := range reminder.Doses {
+			doses = append(doses, reminderDoseText(lang, dose))
+		}
+		b.WriteString("⏰ " + reminder.Time + " – " + strings.Join(doses, ", ") + "\n")
+	}
+
+	if !prescription.ID.IsZero() {
+		link, err := newShareLink(r, username, prescription.ID, defaultShareHours)
+		if err != nil {
+			log.Printf("Error creating share link: %v", err)
+		} else {
+			b.WriteString("\n" + translate(lang, "whatsapp.report", map[string]string{
+				"url":   shareURL(r, link),
+				"hours": strconv.Itoa(defaultShareHours),
+			}) + "\n")
+		}
+	}
+	b.WriteString("\n_" + translate(lang, "whatsapp.disclaimer") + "_")
+	return b.String()
+}
+
+// reminderDoseText is e.g. "Paracetamol (after food, 5 days)".
+func reminderDoseText(lang string, dose ReminderDose) string {
+	var notes []string
+	if dose.Food != "" {
+		notes = append(notes, translate(lang, "whatsapp.food_"+dose.Food))
+	}
+	if dose.Days > 0 {
+		notes = append(notes, translate(lang, "whatsapp.days", map[string]string{"n": strconv.Itoa(dose.Days)}))
+	}
+	if len(notes) == 0 {
+		return dose.Medicine
+	}
+	return dose.Medicine + " (" + strings.Join(notes, ", ") + ")"
+}
+
+// whatsappAPI calls the Graph API and decodes the JSON answer into out.
+func whatsappAPI(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, whatsappAPIURL()+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("WHATSAPP_ACCESS_TOKEN"))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(detail))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// downloadWhatsAppMedia looks up the media's URL and fetches the file.
+func downloadWhatsAppMedia(ctx context.Context, id string) ([]byte, error) {
+	var media struct {
+		URL      string `json:"url"`
+		FileSize int64  `json:"file_size"`
+	}
+	if err := whatsappAPI(ctx, http.MethodGet, "/"+id, nil, &media); err != nil {
+		return nil, err
+	}
+	if media.FileSize > maxUploadBytes {
+		return nil, errWhatsAppMediaTooBig
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, media.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("WHATSAPP_ACCESS_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media download: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUploadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUploadBytes {
+		return nil, errWhatsAppMediaTooBig
+	}
+	return data, nil
+}
+
+// sendWhatsAppText sends a text message, cut to WhatsApp's length limit.
+func sendWhatsAppText(ctx context.Context, phoneNumberID, to, text string) error {
+	if runes := []rune(text); len(runes) > maxWhatsAppText {
+		text = string(runes[:maxWhatsAppText-1]) + "…"
+	}
+	return whatsappAPI(ctx, http.MethodPost, "/"+phoneNumberID+"/messages", map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                to,
+		"type":              "text",
+		"text": map[string]interface{}{
+			"preview_url": true,
+			"body":        text,
+		},
+	}, nil)
+}